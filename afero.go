@@ -2,12 +2,14 @@
 package afero // import "github.com/Maldris/go-billy-afero"
 
 import (
+	"context"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/pkg/errors"
@@ -24,12 +26,36 @@ type Afero struct {
 	fs    afero.Fs
 	root  string
 	Debug bool
+
+	// base is the path of this filesystem within the one returned by New,
+	// it changes with every Chroot.
+	base string
+
+	noRenameFallback bool
+	allowRootRemoval bool
+	protected        []string
+	trash            *trash
+	versions         *versions
+	auditor          *auditor
+	limits           *limits
+	retrier          *retrier
+	cache            *metaCache
+	handles          *handles
+	hashes           *treeHashes
+	integrity        *integrity
+	readAhead        int
+	writeBehind      int
+	ctx              context.Context
 }
 
 // New returns a new OS filesystem.
-func New(fs afero.Fs, root string, debug bool) billy.Filesystem {
+func New(fs afero.Fs, root string, debug bool, opts ...Option) billy.Filesystem {
 	// TODO: rewrite this
-	return &Afero{fs: fs, root: root, Debug: debug}
+	a := &Afero{fs: fs, root: root, Debug: debug, base: "/"}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
 }
 
 // Create creates the named file with mode 0666 (before umask), truncating
@@ -46,25 +72,75 @@ func (fs *Afero) Create(filename string) (billy.File, error) {
 // instead. It opens the named file with specified flag (O_RDONLY etc.) and
 // perm, (0666 etc.) if applicable. If successful, methods on the returned
 // File can be used for I/O.
-func (fs *Afero) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+func (fs *Afero) OpenFile(filename string, flag int, perm os.FileMode) (_ billy.File, err error) {
 	if fs.Debug {
 		log.Println("OpenFile ", filename)
 	}
+	fs.limitOp()
+	writing := flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0
+	if writing {
+		defer fs.audit(AuditRecord{Op: "open", Path: filename, Flag: flag, Perm: perm}, &err)
+		defer fs.invalidate(filename, false)
+	}
+	if fs.handles != nil {
+		if err := fs.handles.reserve(filename); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				fs.handles.unreserve()
+			}
+		}()
+	}
 	if flag&os.O_CREATE != 0 {
 		if err := fs.createDir(filename); err != nil {
 			return nil, err
 		}
 	}
 
-	f, err := fs.fs.OpenFile(filename, flag, perm)
+	if fs.versions != nil && flag&os.O_TRUNC != 0 {
+		if err := fs.snapshot(filename); err != nil {
+			return nil, err
+		}
+	}
+
+	var f afero.File
+	err = fs.retry(retryOpen(flag), func() (err error) {
+		f, err = fs.fs.OpenFile(filename, flag, perm)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
+	if fs.versions != nil && flag&(os.O_WRONLY|os.O_RDWR) != 0 && flag&(os.O_TRUNC|os.O_APPEND) == 0 {
+		f = &versionedFile{File: f, snapshot: func() error { return fs.snapshot(filename) }}
+	}
+	if fs.integrity != nil {
+		if f, err = fs.newCheckedFile(f, filename, flag); err != nil {
+			return nil, err
+		}
+	}
+	if fs.auditor != nil && writing {
+		f = &auditedFile{File: f, fs: fs, name: filename}
+	}
+	if (fs.cache != nil || fs.hashes != nil) && writing {
+		f = &cachedFile{File: f, fs: fs, name: filename}
+	}
+	if fs.limits != nil && fs.limits.bytes != nil {
+		f = &limitedFile{File: f, bytes: fs.limits.bytes}
+	}
+	if fs.readAhead > 0 || fs.writeBehind > 0 {
+		f = newBufferedFile(f, fs.readAhead, fs.writeBehind)
+	}
 	name := filepath.ToSlash(f.Name())
 	if strings.HasPrefix(name, fs.root) {
 		name = strings.TrimPrefix(name, fs.root)
 	}
-	return &file{File: f, name: name}, err
+	bf := &file{File: f, name: name}
+	if fs.handles != nil {
+		fs.handles.add(bf, fs.virtual(filename), flag, fs.Debug)
+	}
+	return bf, err
 }
 
 func (fs *Afero) createDir(fullpath string) error {
@@ -73,7 +149,8 @@ func (fs *Afero) createDir(fullpath string) error {
 	}
 	dir := path.Dir(fullpath)
 	if dir != "." {
-		if err := fs.MkdirAll(dir, defaultDirectoryMode); err != nil {
+		// not fs.MkdirAll, the parents are part of the calling operation
+		if err := fs.fs.MkdirAll(dir, defaultDirectoryMode); err != nil {
 			return err
 		}
 	}
@@ -82,19 +159,31 @@ func (fs *Afero) createDir(fullpath string) error {
 }
 
 // ReadDir reads the directory named by dirname and returns a list of
-// directory entries sorted by filename.
+// directory entries sorted by filename, less the staging directory of
+// operations done in several steps.
 func (fs *Afero) ReadDir(path string) ([]os.FileInfo, error) {
 	if fs.Debug {
 		log.Println("ReadDir ", path)
 	}
-	l, err := afero.ReadDir(fs.fs, path)
+	v, err := fs.cached(cacheReadDir, path, func() (interface{}, error) {
+		fs.limitOp()
+		var l []os.FileInfo
+		err := fs.retry("ReadDir", func() (err error) {
+			l, err = afero.ReadDir(fs.fs, path)
+			return err
+		})
+		return l, err
+	})
 	if err != nil {
 		return nil, err
 	}
+	l := v.([]os.FileInfo)
 
-	var s = make([]os.FileInfo, len(l))
-	for i, f := range l {
-		s[i] = f
+	var s = make([]os.FileInfo, 0, len(l))
+	for _, f := range l {
+		if f.Name() != stagingName {
+			s = append(s, f)
+		}
 	}
 
 	return s, nil
@@ -103,26 +192,44 @@ func (fs *Afero) ReadDir(path string) ([]os.FileInfo, error) {
 // Rename renames (moves) oldpath to newpath. If newpath already exists and
 // is not a directory, Rename replaces it. OS-specific restrictions may
 // apply when oldpath and newpath are in different directories.
-func (fs *Afero) Rename(from, to string) error {
+func (fs *Afero) Rename(from, to string) (err error) {
 	if fs.Debug {
 		log.Println("Rename \n", from, "\n", to)
 	}
+	defer fs.audit(AuditRecord{Op: "rename", Path: from, NewPath: to}, &err)
+	defer fs.invalidate(from, true)
+	defer fs.invalidate(to, true)
+	defer fs.moveChecksums(from, to, &err)
 	if err := fs.createDir(to); err != nil {
 		return err
 	}
+	if fs.versions != nil {
+		if err := fs.snapshot(to); err != nil {
+			return err
+		}
+	}
 
-	return fs.fs.Rename(from, to)
+	err = fs.retry("Rename", func() error { return renameVerified(fs.fs, from, to) })
+	if err != nil && !fs.noRenameFallback && isRenameUnsupported(err) {
+		if fs.Debug {
+			log.Println("Rename falling back to copy: ", err)
+		}
+		return fs.renameByCopy(from, to, err)
+	}
+	return err
 }
 
 // MkdirAll creates a directory named path, along with any necessary
 // parents, and returns nil, or else returns an error. The permission bits
 // perm are used for all directories that MkdirAll creates. If path is/
 // already a directory, MkdirAll does nothing and returns nil.
-func (fs *Afero) MkdirAll(path string, perm os.FileMode) error {
+func (fs *Afero) MkdirAll(path string, perm os.FileMode) (err error) {
 	if fs.Debug {
 		log.Println("MkdirAll ", path)
 	}
-	return fs.fs.MkdirAll(path, defaultDirectoryMode)
+	defer fs.audit(AuditRecord{Op: "mkdirall", Path: path, Perm: perm}, &err)
+	defer fs.invalidate(path, false)
+	return fs.retry("MkdirAll", func() error { return fs.fs.MkdirAll(path, defaultDirectoryMode) })
 }
 
 // Open opens the named file for reading. If successful, methods on the
@@ -140,15 +247,36 @@ func (fs *Afero) Stat(filename string) (os.FileInfo, error) {
 	if fs.Debug {
 		log.Println("Stat ", filename)
 	}
-	return fs.fs.Stat(filename)
+	v, err := fs.cachedLinked(cacheStat, filename, func() (interface{}, bool, error) {
+		fs.limitOp()
+		var fi os.FileInfo
+		err := fs.retry("Stat", func() (err error) {
+			fi, err = fs.fs.Stat(filename)
+			return err
+		})
+		if fs.cache == nil {
+			return fi, false, err
+		}
+		// the result of a link changes with its target, wherever that is
+		lfi, _, lerr := lstat(fs.fs, filename)
+		return fi, lerr == nil && lfi.Mode()&os.ModeSymlink != 0, err
+	})
+	fi, _ := v.(os.FileInfo)
+	return fi, err
 }
 
 // Remove removes the named file or directory.
-func (fs *Afero) Remove(filename string) error {
+func (fs *Afero) Remove(filename string) (err error) {
 	if fs.Debug {
 		log.Println("Remove ", filename)
 	}
-	return fs.fs.Remove(filename)
+	defer fs.audit(AuditRecord{Op: "remove", Path: filename}, &err)
+	defer fs.invalidate(filename, false)
+	defer fs.dropChecksums(filename, false, &err)
+	if fs.trash != nil {
+		return fs.trashRemove(filename, false)
+	}
+	return fs.retry("Remove", func() error { return fs.fs.Remove(filename) })
 }
 
 // TempFile creates a new temporary file in the directory dir with a name
@@ -159,18 +287,53 @@ func (fs *Afero) Remove(filename string) error {
 // same file. The caller can use f.Name() to find the pathname of the file.
 // It is the caller's responsibility to remove the file when no longer
 // needed.
-func (fs *Afero) TempFile(dir, prefix string) (billy.File, error) {
+func (fs *Afero) TempFile(dir, prefix string) (_ billy.File, err error) {
 	if fs.Debug {
 		log.Println("TempFile ", dir, "\n", prefix)
 	}
+	created := dir
+	defer func() { fs.audit(AuditRecord{Op: "tempfile", Path: created}, &err) }()
+	defer func() { fs.invalidate(created, false) }()
+	if fs.handles != nil {
+		if err := fs.handles.reserve(dir); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				fs.handles.unreserve()
+			}
+		}()
+	}
 	if err := fs.createDir(dir + "/"); err != nil {
 		return nil, err
 	}
 
-	f, err := afero.TempFile(fs.fs, dir, prefix)
+	var f afero.File
+	err = fs.retry("TempFile", func() (err error) {
+		f, err = afero.TempFile(fs.fs, dir, prefix)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
+	created = path.Join(dir, filepath.Base(f.Name()))
+	if fs.integrity != nil {
+		if f, err = fs.newCheckedFile(f, created, os.O_RDWR|os.O_CREATE|os.O_EXCL); err != nil {
+			return nil, err
+		}
+	}
+	if fs.auditor != nil {
+		f = &auditedFile{File: f, fs: fs, name: created}
+	}
+	if fs.cache != nil || fs.hashes != nil {
+		f = &cachedFile{File: f, fs: fs, name: created}
+	}
+	if fs.limits != nil && fs.limits.bytes != nil {
+		f = &limitedFile{File: f, bytes: fs.limits.bytes}
+	}
+	if fs.readAhead > 0 || fs.writeBehind > 0 {
+		f = newBufferedFile(f, fs.readAhead, fs.writeBehind)
+	}
 	name := filepath.ToSlash(f.Name())
 	if strings.HasPrefix(name, fs.root) {
 		name = strings.TrimPrefix(name, fs.root)
@@ -178,7 +341,11 @@ func (fs *Afero) TempFile(dir, prefix string) (billy.File, error) {
 	if fs.Debug {
 		log.Println("Tempfile created: ", name)
 	}
-	return &file{File: f, name: name}, nil
+	bf := &file{File: f, name: name}
+	if fs.handles != nil {
+		fs.handles.add(bf, fs.virtual(created), os.O_RDWR|os.O_CREATE|os.O_EXCL, fs.Debug)
+	}
+	return bf, nil
 }
 
 // Join joins any number of path elements into a single path, adding a
@@ -194,11 +361,20 @@ func (fs *Afero) Join(elem ...string) string {
 
 // RemoveAll removes a directory path and any children it contains. It
 // does not fail if the path does not exist (return nil).
-func (fs *Afero) RemoveAll(filePath string) error {
+func (fs *Afero) RemoveAll(filePath string) (err error) {
 	if fs.Debug {
 		log.Println("RemoveAll ", filePath)
 	}
-	return fs.fs.RemoveAll(path.Clean(filePath))
+	defer fs.audit(AuditRecord{Op: "removeall", Path: filePath}, &err)
+	defer fs.invalidate(filePath, true)
+	defer fs.dropChecksums(path.Clean(filePath), true, &err)
+	if err := fs.checkRemoveAll(filePath); err != nil {
+		return err
+	}
+	if fs.trash != nil {
+		return fs.trashRemove(path.Clean(filePath), true)
+	}
+	return fs.retry("RemoveAll", func() error { return fs.fs.RemoveAll(path.Clean(filePath)) })
 }
 
 // Lstat returns a FileInfo describing the named file. If the file is a
@@ -209,7 +385,16 @@ func (fs *Afero) Lstat(filename string) (os.FileInfo, error) {
 		log.Println("Lstat ", filename)
 	}
 	if lstater, ok := fs.fs.(afero.Lstater); ok {
-		fileInfo, _, err := lstater.LstatIfPossible(filename)
+		v, err := fs.cached(cacheLstat, filename, func() (interface{}, error) {
+			fs.limitOp()
+			var fileInfo os.FileInfo
+			err := fs.retry("Lstat", func() (err error) {
+				fileInfo, _, err = lstater.LstatIfPossible(filename)
+				return err
+			})
+			return fileInfo, err
+		})
+		fileInfo, _ := v.(os.FileInfo)
 		return fileInfo, err
 	}
 	return fs.Stat(path.Clean(filename))
@@ -218,16 +403,18 @@ func (fs *Afero) Lstat(filename string) (os.FileInfo, error) {
 // Symlink creates a symbolic-link from link to target. target may be an
 // absolute or relative path, and need not refer to an existing node.
 // Parent directories of link are created as necessary.
-func (fs *Afero) Symlink(target, link string) error {
+func (fs *Afero) Symlink(target, link string) (err error) {
 	if fs.Debug {
 		log.Println("Symlink ", target, "\n", link)
 	}
+	defer fs.audit(AuditRecord{Op: "symlink", Path: link, Target: target}, &err)
+	defer fs.invalidate(link, false)
 	if err := fs.createDir(link); err != nil {
 		return err
 	}
 
 	if linker, ok := fs.fs.(afero.Linker); ok {
-		return linker.SymlinkIfPossible(target, link)
+		return fs.retry("Symlink", func() error { return linker.SymlinkIfPossible(target, link) })
 	}
 
 	return &os.LinkError{Op: "symlink", Old: target, New: link, Err: afero.ErrNoSymlink}
@@ -239,7 +426,15 @@ func (fs *Afero) Readlink(link string) (string, error) {
 		log.Println("Readlink ", link)
 	}
 	if reader, ok := fs.fs.(afero.LinkReader); ok {
-		dest, err := reader.ReadlinkIfPossible(link)
+		v, err := fs.cached(cacheReadlink, link, func() (interface{}, error) {
+			var dest string
+			err := fs.retry("Readlink", func() (err error) {
+				dest, err = reader.ReadlinkIfPossible(link)
+				return err
+			})
+			return dest, err
+		})
+		dest, _ := v.(string)
 		if err != nil {
 			return dest, err
 		}
@@ -250,6 +445,36 @@ func (fs *Afero) Readlink(link string) (string, error) {
 	return "", &os.PathError{Op: "readlink", Path: link, Err: afero.ErrNoReadlink}
 }
 
+// Chmod changes the mode of the named file to mode.
+func (fs *Afero) Chmod(name string, mode os.FileMode) (err error) {
+	if fs.Debug {
+		log.Println("Chmod ", name, " ", mode)
+	}
+	defer fs.audit(AuditRecord{Op: "chmod", Path: name, Perm: mode}, &err)
+	defer fs.invalidate(name, false)
+	return fs.retry("Chmod", func() error { return fs.fs.Chmod(name, mode) })
+}
+
+// Lchown is not supported by afero filesystems.
+func (fs *Afero) Lchown(name string, uid, gid int) error {
+	return &os.PathError{Op: "lchown", Path: name, Err: billy.ErrNotSupported}
+}
+
+// Chown is not supported by afero filesystems.
+func (fs *Afero) Chown(name string, uid, gid int) error {
+	return &os.PathError{Op: "chown", Path: name, Err: billy.ErrNotSupported}
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (fs *Afero) Chtimes(name string, atime time.Time, mtime time.Time) (err error) {
+	if fs.Debug {
+		log.Println("Chtimes ", name, " ", atime, " ", mtime)
+	}
+	defer fs.audit(AuditRecord{Op: "chtimes", Path: name}, &err)
+	defer fs.invalidate(name, false)
+	return fs.retry("Chtimes", func() error { return fs.fs.Chtimes(name, atime, mtime) })
+}
+
 // Chroot returns a new filesystem from the same type where the new root is
 // the given path. Files outside of the designated directory tree cannot be
 // accessed.
@@ -266,7 +491,11 @@ func (fs *Afero) Chroot(fPath string) (billy.Filesystem, error) {
 		return nil, errors.New("Cannot set root, not a directory")
 	}
 
-	return &Afero{fs: afero.NewBasePathFs(fs.fs, fPath), root: path.Join(fs.root, fPath), Debug: fs.Debug}, nil
+	chroot := *fs
+	chroot.fs = afero.NewBasePathFs(fs.fs, fPath)
+	chroot.root = path.Join(fs.root, fPath)
+	chroot.base = fs.virtual(fPath)
+	return &chroot, nil
 }
 
 // Root returns the root path of the filesystem.
@@ -288,8 +517,9 @@ func (fs *Afero) Capabilities() billy.Capability {
 // file is a wrapper for an os.File which adds support for file locking.
 type file struct {
 	afero.File
-	name string
-	m    sync.Mutex
+	name    string
+	handles *handles
+	m       sync.Mutex
 }
 
 // Lock requests that a file is lock
@@ -307,3 +537,11 @@ func (f *file) Unlock() error {
 func (f *file) Name() string {
 	return f.name
 }
+
+// Close closes the file, which is no longer tracked as open.
+func (f *file) Close() error {
+	if f.handles != nil {
+		f.handles.remove(f)
+	}
+	return f.File.Close()
+}
@@ -0,0 +1,576 @@
+package afero
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/spf13/afero"
+)
+
+// archiveMaxLinks bounds the symlinks followed resolving a path.
+const archiveMaxLinks = 40
+
+// archiveEntry is a file, directory or symlink of an archive.
+type archiveEntry struct {
+	name     string
+	mode     os.FileMode
+	size     int64
+	modTime  time.Time
+	link     string
+	children []string
+
+	// ra reads the content of entries stored uncompressed, others are read
+	// from the start with open.
+	ra   io.ReaderAt
+	open func() (io.ReadCloser, error)
+}
+
+// ArchiveFs is a read-only afero.Fs serving the content of a tar or zip
+// archive. Entries stored uncompressed are read at random, compressed ones
+// are decompressed from their start, making backward seeks costly.
+type ArchiveFs struct {
+	entries map[string]*archiveEntry
+}
+
+// NewTarFs indexes the tar archive of the given size read from r, which may
+// be gzipped.
+func NewTarFs(r io.ReaderAt, size int64) (*ArchiveFs, error) {
+	magic := make([]byte, 2)
+	gzipped := false
+	if _, err := r.ReadAt(magic, 0); err == nil {
+		gzipped = magic[0] == 0x1f && magic[1] == 0x8b
+	}
+	reader := func() (*tar.Reader, io.Closer, error) {
+		sr := io.NewSectionReader(r, 0, size)
+		if !gzipped {
+			return tar.NewReader(sr), ioutil.NopCloser(nil), nil
+		}
+		gz, err := gzip.NewReader(sr)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(gz), gz, nil
+	}
+	// entry reads the archive again up to the i-th header.
+	entry := func(i int) func() (io.ReadCloser, error) {
+		return func() (io.ReadCloser, error) {
+			tr, closer, err := reader()
+			if err != nil {
+				return nil, err
+			}
+			for j := 0; j <= i; j++ {
+				if _, err := tr.Next(); err != nil {
+					closer.Close()
+					return nil, err
+				}
+			}
+			return struct {
+				io.Reader
+				io.Closer
+			}{tr, closer}, nil
+		}
+	}
+
+	a := newArchiveFs()
+	var sr *io.SectionReader
+	var tr *tar.Reader
+	if gzipped {
+		var closer io.Closer
+		var err error
+		if tr, closer, err = reader(); err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+	} else {
+		// offsets of the content are only known reading the archive directly
+		sr = io.NewSectionReader(r, 0, size)
+		tr = tar.NewReader(sr)
+	}
+	hardlinks := map[string]string{}
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		e := &archiveEntry{
+			name:    mountPath(hdr.Name),
+			mode:    hdr.FileInfo().Mode(),
+			modTime: hdr.ModTime,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+			e.size = hdr.Size
+			e.open = entry(i)
+			if sr != nil && !tarSparse(hdr) {
+				offset, _ := sr.Seek(0, io.SeekCurrent)
+				e.ra = io.NewSectionReader(r, offset, hdr.Size)
+			}
+		case tar.TypeSymlink:
+			e.link = hdr.Linkname
+		case tar.TypeLink:
+			hardlinks[e.name] = mountPath(hdr.Linkname)
+		}
+		if err := a.add(e); err != nil {
+			return nil, err
+		}
+	}
+	for name, target := range hardlinks {
+		for i := 0; i < archiveMaxLinks && hardlinks[target] != ""; i++ {
+			target = hardlinks[target]
+		}
+		e, t := a.entries[name], a.entries[target]
+		if t == nil || !t.mode.IsRegular() {
+			return nil, &os.LinkError{Op: "link", Old: target, New: name, Err: os.ErrNotExist}
+		}
+		e.size, e.ra, e.open = t.size, t.ra, t.open
+	}
+	return a, nil
+}
+
+func tarSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// NewZipFs indexes the zip archive of the given size read from r.
+func NewZipFs(r io.ReaderAt, size int64) (*ArchiveFs, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	a := newArchiveFs()
+	for _, f := range zr.File {
+		e := &archiveEntry{
+			name:    mountPath(f.Name),
+			mode:    f.Mode(),
+			modTime: f.Modified,
+		}
+		switch {
+		case e.mode&os.ModeSymlink != 0:
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			link, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			e.link = string(link)
+		case e.mode.IsRegular():
+			e.size = int64(f.UncompressedSize64)
+			e.open = f.Open
+			if f.Method == zip.Store {
+				offset, err := f.DataOffset()
+				if err != nil {
+					return nil, err
+				}
+				e.ra = io.NewSectionReader(r, offset, e.size)
+			}
+		}
+		if err := a.add(e); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// NewTar returns a read-only billy filesystem over a tar archive.
+func NewTar(r io.ReaderAt, size int64, root string, debug bool) (billy.Filesystem, error) {
+	a, err := NewTarFs(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return New(a, root, debug), nil
+}
+
+// NewZip returns a read-only billy filesystem over a zip archive.
+func NewZip(r io.ReaderAt, size int64, root string, debug bool) (billy.Filesystem, error) {
+	a, err := NewZipFs(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return New(a, root, debug), nil
+}
+
+func newArchiveFs() *ArchiveFs {
+	return &ArchiveFs{entries: map[string]*archiveEntry{
+		"/": {name: "/", mode: os.ModeDir | defaultDirectoryMode},
+	}}
+}
+
+// add indexes e, creating the parent directories archives may omit. Later
+// entries replace earlier ones of the same name, but an entry below one that
+// is not a directory is an error.
+func (a *ArchiveFs) add(e *archiveEntry) error {
+	if e.name == "/" {
+		return nil
+	}
+	parent := a.entries[path.Dir(e.name)]
+	if parent == nil {
+		if err := a.add(&archiveEntry{name: path.Dir(e.name), mode: os.ModeDir | defaultDirectoryMode}); err != nil {
+			return err
+		}
+		parent = a.entries[path.Dir(e.name)]
+	}
+	if !parent.mode.IsDir() {
+		return &os.PathError{Op: "open", Path: e.name, Err: syscall.ENOTDIR}
+	}
+	if old := a.entries[e.name]; old != nil {
+		if old.mode.IsDir() && e.mode.IsDir() {
+			old.mode, old.modTime = e.mode, e.modTime
+			return nil
+		}
+	} else {
+		base := path.Base(e.name)
+		i := sort.SearchStrings(parent.children, base)
+		parent.children = append(parent.children, "")
+		copy(parent.children[i+1:], parent.children[i:])
+		parent.children[i] = base
+	}
+	a.entries[e.name] = e
+	return nil
+}
+
+// lookup finds the entry of name, following symlinks in its parents and,
+// with follow, in name itself.
+func (a *ArchiveFs) lookup(op, name string, follow bool) (*archiveEntry, error) {
+	p := mountPath(name)
+	links := 0
+resolve:
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	e := a.entries["/"]
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		if !e.mode.IsDir() {
+			return nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		dir := e.name
+		if e = a.entries[path.Join(dir, part)]; e == nil {
+			return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		if e.mode&os.ModeSymlink != 0 && (follow || i < len(parts)-1) {
+			if links++; links > archiveMaxLinks {
+				return nil, &os.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+			}
+			target := e.link
+			if !path.IsAbs(target) {
+				target = path.Join(dir, target)
+			}
+			p = mountPath(path.Join(append([]string{target}, parts[i+1:]...)...))
+			goto resolve
+		}
+	}
+	return e, nil
+}
+
+func (a *ArchiveFs) readOnly(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: syscall.EROFS}
+}
+
+// Name returns the name of this filesystem.
+func (a *ArchiveFs) Name() string {
+	return "ArchiveFs"
+}
+
+// Create fails, archives are read-only.
+func (a *ArchiveFs) Create(name string) (afero.File, error) {
+	return nil, a.readOnly("open", name)
+}
+
+// Open opens the named file for reading.
+func (a *ArchiveFs) Open(name string) (afero.File, error) {
+	e, err := a.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveFile{fs: a, e: e, name: name}, nil
+}
+
+// OpenFile opens the named file, which must be for reading only.
+func (a *ArchiveFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, a.readOnly("open", name)
+	}
+	return a.Open(name)
+}
+
+// Mkdir fails, archives are read-only.
+func (a *ArchiveFs) Mkdir(name string, perm os.FileMode) error {
+	return a.readOnly("mkdir", name)
+}
+
+// MkdirAll fails, archives are read-only.
+func (a *ArchiveFs) MkdirAll(name string, perm os.FileMode) error {
+	return a.readOnly("mkdir", name)
+}
+
+// Remove fails, archives are read-only.
+func (a *ArchiveFs) Remove(name string) error {
+	return a.readOnly("remove", name)
+}
+
+// RemoveAll fails, archives are read-only.
+func (a *ArchiveFs) RemoveAll(name string) error {
+	return a.readOnly("remove", name)
+}
+
+// Rename fails, archives are read-only.
+func (a *ArchiveFs) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EROFS}
+}
+
+// Stat returns the FileInfo of the named entry, following symlinks.
+func (a *ArchiveFs) Stat(name string) (os.FileInfo, error) {
+	e, err := a.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return archiveInfo{e}, nil
+}
+
+// Chmod fails, archives are read-only.
+func (a *ArchiveFs) Chmod(name string, mode os.FileMode) error {
+	return a.readOnly("chmod", name)
+}
+
+// Chtimes fails, archives are read-only.
+func (a *ArchiveFs) Chtimes(name string, atime, mtime time.Time) error {
+	return a.readOnly("chtimes", name)
+}
+
+// LstatIfPossible implements afero.Lstater.
+func (a *ArchiveFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	e, err := a.lookup("lstat", name, false)
+	if err != nil {
+		return nil, true, err
+	}
+	return archiveInfo{e}, true, nil
+}
+
+// SymlinkIfPossible fails, archives are read-only.
+func (a *ArchiveFs) SymlinkIfPossible(oldname, newname string) error {
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: syscall.EROFS}
+}
+
+// ReadlinkIfPossible implements afero.LinkReader.
+func (a *ArchiveFs) ReadlinkIfPossible(name string) (string, error) {
+	e, err := a.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if e.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return e.link, nil
+}
+
+// archiveInfo is the FileInfo of an archive entry.
+type archiveInfo struct {
+	e *archiveEntry
+}
+
+func (fi archiveInfo) Name() string {
+	return path.Base(fi.e.name)
+}
+
+func (fi archiveInfo) Size() int64 {
+	return fi.e.size
+}
+
+func (fi archiveInfo) Mode() os.FileMode {
+	return fi.e.mode
+}
+
+func (fi archiveInfo) ModTime() time.Time {
+	return fi.e.modTime
+}
+
+func (fi archiveInfo) IsDir() bool {
+	return fi.e.mode.IsDir()
+}
+
+func (fi archiveInfo) Sys() interface{} {
+	return nil
+}
+
+// archiveFile reads an archive entry. Entries without random access are
+// read by a stream, reopened when reading backwards.
+type archiveFile struct {
+	fs     *ArchiveFs
+	e      *archiveEntry
+	name   string
+	pos    int64
+	dirPos int
+
+	stream    io.ReadCloser
+	streamPos int64
+	m         sync.Mutex
+}
+
+func (f *archiveFile) Name() string {
+	return f.name
+}
+
+func (f *archiveFile) Stat() (os.FileInfo, error) {
+	return archiveInfo{f.e}, nil
+}
+
+func (f *archiveFile) Read(p []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	n, err := f.readAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *archiveFile) ReadAt(p []byte, off int64) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.readAt(p, off)
+}
+
+func (f *archiveFile) readAt(p []byte, off int64) (int, error) {
+	if f.e.mode.IsDir() {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EINVAL}
+	}
+	if off >= f.e.size {
+		return 0, io.EOF
+	}
+	if f.e.ra != nil {
+		return f.e.ra.ReadAt(p, off)
+	}
+
+	if f.stream == nil || off < f.streamPos {
+		if f.stream != nil {
+			f.stream.Close()
+		}
+		stream, err := f.e.open()
+		if err != nil {
+			f.stream = nil
+			return 0, err
+		}
+		f.stream, f.streamPos = stream, 0
+	}
+	if off > f.streamPos {
+		n, err := io.CopyN(ioutil.Discard, f.stream, off-f.streamPos)
+		f.streamPos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(f.stream, p)
+	f.streamPos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *archiveFile) Seek(offset int64, whence int) (int64, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.e.size
+	}
+	if offset < 0 {
+		return f.pos, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *archiveFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.e.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	children := f.e.children[f.dirPos:]
+	if count > 0 {
+		if len(children) == 0 {
+			return nil, io.EOF
+		}
+		if len(children) > count {
+			children = children[:count]
+		}
+	}
+	f.dirPos += len(children)
+	list := make([]os.FileInfo, len(children))
+	for i, child := range children {
+		list[i] = archiveInfo{f.fs.entries[path.Join(f.e.name, child)]}
+	}
+	return list, nil
+}
+
+func (f *archiveFile) Readdirnames(n int) ([]string, error) {
+	list, err := f.Readdir(n)
+	names := make([]string, len(list))
+	for i, fi := range list {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+func (f *archiveFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *archiveFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.Write(p)
+}
+
+func (f *archiveFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *archiveFile) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *archiveFile) Sync() error {
+	return nil
+}
+
+func (f *archiveFile) Close() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.stream != nil {
+		err := f.stream.Close()
+		f.stream = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package afero
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+var archiveContent = bytes.Repeat([]byte("archived content "), 1000)
+
+func testTar(gzipped bool) []byte {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if gzipped {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "repo/", Mode: 0700})
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "repo/dir/file", Mode: 0640, Size: int64(len(archiveContent))})
+	tw.Write(archiveContent)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "repo/small", Mode: 0644, Size: 5})
+	tw.Write([]byte("small"))
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "repo/link", Linkname: "dir/file"})
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "repo/dirlink", Linkname: "/repo/dir"})
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeLink, Name: "repo/hardlink", Linkname: "repo/small"})
+	tw.Close()
+	if gz != nil {
+		gz.Close()
+	}
+	return buf.Bytes()
+}
+
+func testArchive(t *testing.T, fs billy.Filesystem) {
+	fi, err := fs.Stat("/repo/dir/file")
+	if err != nil || fi.Size() != int64(len(archiveContent)) || fi.Mode() != 0640 {
+		t.Error("Unexpected file info: ", fi, err)
+		return
+	}
+	if fi, err := fs.Stat("/repo"); err != nil || fi.Mode() != os.ModeDir|0700 {
+		t.Error("Unexpected directory info: ", fi, err)
+	}
+	if list, err := fs.ReadDir("/repo"); err != nil || len(list) != 5 || list[0].Name() != "dir" {
+		t.Error("Unexpected listing: ", list, err)
+	}
+
+	if fi, err := fs.Lstat("/repo/link"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Error("Lstat did not report a symlink: ", fi, err)
+	}
+	if dest, err := fs.Readlink("/repo/link"); err != nil || dest != "dir/file" {
+		t.Error("Unexpected link destination: ", dest, err)
+	}
+	if fi, err := fs.Stat("/repo/link"); err != nil || fi.Size() != int64(len(archiveContent)) {
+		t.Error("Stat did not follow the link: ", fi, err)
+	}
+	if _, err := fs.Stat("/repo/dirlink/file"); err != nil {
+		t.Error("Error resolving through a directory link: ", err)
+	}
+
+	f, err := fs.Open("/repo/link")
+	if err != nil {
+		t.Error("Error opening file: ", err)
+		return
+	}
+	p := make([]byte, 100)
+	if _, err := f.ReadAt(p, 5000); err != nil || !bytes.Equal(p, archiveContent[5000:5100]) {
+		t.Error("ReadAt content differs: ", err)
+	}
+	if _, err := f.ReadAt(p, 100); err != nil || !bytes.Equal(p, archiveContent[100:200]) {
+		t.Error("ReadAt backwards differs: ", err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil || !bytes.Equal(data, archiveContent) {
+		t.Error("Read content differs: ", err)
+	}
+	f.Close()
+	if f, err := fs.Open("/repo/hardlink"); err == nil {
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+		if string(data) != "small" {
+			t.Error("Unexpected hard link content: ", string(data))
+		}
+	} else {
+		t.Error("Error opening hard link: ", err)
+	}
+
+	if _, err := fs.Create("/repo/new"); err == nil {
+		t.Error("Created a file in an archive")
+	}
+	if err := fs.Remove("/repo/small"); err == nil {
+		t.Error("Removed a file from an archive")
+	}
+
+	chroot, err := fs.Chroot("/repo/dir")
+	if err != nil {
+		t.Error("Error creating chroot: ", err)
+		return
+	}
+	if fi, err := chroot.Stat("/file"); err != nil || fi.Size() != int64(len(archiveContent)) {
+		t.Error("Unexpected file info in chroot: ", fi, err)
+	}
+}
+
+func TestTarArchive(t *testing.T) {
+	for _, gzipped := range []bool{false, true} {
+		data := testTar(gzipped)
+		fs, err := NewTar(bytes.NewReader(data), int64(len(data)), "/", false)
+		if err != nil {
+			t.Error("Error reading archive: ", err)
+			return
+		}
+		testArchive(t, fs)
+	}
+}
+
+func TestZipArchive(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	add := func(name string, mode os.FileMode, method uint16, content []byte) {
+		hdr := &zip.FileHeader{Name: name, Method: method}
+		hdr.SetMode(mode)
+		w, _ := zw.CreateHeader(hdr)
+		w.Write(content)
+	}
+	add("repo/", os.ModeDir|0700, zip.Store, nil)
+	add("repo/dir/file", 0640, zip.Deflate, archiveContent)
+	add("repo/small", 0644, zip.Store, []byte("small"))
+	add("repo/link", os.ModeSymlink|0777, zip.Store, []byte("dir/file"))
+	add("repo/dirlink", os.ModeSymlink|0777, zip.Store, []byte("/repo/dir"))
+	add("repo/hardlink", 0644, zip.Deflate, []byte("small"))
+	zw.Close()
+
+	fs, err := NewZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), "/", false)
+	if err != nil {
+		t.Error("Error reading archive: ", err)
+		return
+	}
+	testArchive(t, fs)
+}
+
+func TestArchiveFileAsDirectory(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "repo/file", Mode: 0644, Size: 5})
+	tw.Write([]byte("small"))
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "repo/file/nested", Mode: 0644, Size: 5})
+	tw.Write([]byte("small"))
+	tw.Close()
+
+	_, err := NewTarFs(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if perr, ok := err.(*os.PathError); !ok || perr.Err != syscall.ENOTDIR || perr.Path != "/repo/file/nested" {
+		t.Error("Unexpected error indexing an entry below a file: ", err)
+	}
+}
+
+func TestArchiveConcurrentRead(t *testing.T) {
+	data := testTar(true)
+	fs, err := NewTar(bytes.NewReader(data), int64(len(data)), "/", false)
+	if err != nil {
+		t.Error("Error reading archive: ", err)
+		return
+	}
+	f, err := fs.Open("/repo/dir/file")
+	if err != nil {
+		t.Error("Error opening file: ", err)
+		return
+	}
+	defer f.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := make([]byte, 100)
+			for j := 0; j < 50; j++ {
+				f.Seek(int64(j*100), io.SeekStart)
+				f.Read(p)
+				f.ReadAt(p, int64(j*10))
+			}
+		}()
+	}
+	wg.Wait()
+	p := make([]byte, 100)
+	if _, err := f.ReadAt(p, 500); err != nil || !bytes.Equal(p, archiveContent[500:600]) {
+		t.Error("Unexpected content after concurrent reads: ", err)
+	}
+}
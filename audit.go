@@ -0,0 +1,192 @@
+package afero
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// ErrAuditChainBroken is returned by VerifyAuditLog when a record does not
+// follow from the one before it.
+var ErrAuditChainBroken = errors.New("Audit log hash chain is broken")
+
+// AuditRecord is a single line of the audit log, describing one mutating
+// operation.
+type AuditRecord struct {
+	Time  time.Time `json:"time"`
+	Actor string    `json:"actor,omitempty"`
+	Op    string    `json:"op"`
+	// Path and NewPath are relative to the root passed to New.
+	Path    string      `json:"path"`
+	NewPath string      `json:"newPath,omitempty"`
+	Target  string      `json:"target,omitempty"`
+	Flag    int         `json:"flag,omitempty"`
+	Perm    os.FileMode `json:"perm,omitempty"`
+	Bytes   int64       `json:"bytes,omitempty"`
+	// Result is "ok" or the error the operation returned.
+	Result string `json:"result"`
+	// Prev and Hash chain the records when enabled, Hash covering the
+	// record with Hash unset.
+	Prev string `json:"prev,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+type actorKey struct{}
+
+// ContextWithActor returns a context carrying actor, for use with
+// Afero.WithContext.
+func ContextWithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor set with ContextWithActor, if any.
+func ActorFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// WithContext returns a filesystem sharing all state with fs whose audit
+// records carry the actor of ctx.
+func (fs *Afero) WithContext(ctx context.Context) billy.Filesystem {
+	c := *fs
+	c.ctx = ctx
+	return &c
+}
+
+// auditor writes records to a single writer, one JSON document per line.
+type auditor struct {
+	w     io.Writer
+	chain bool
+	prev  string
+	now   func() time.Time
+	m     sync.Mutex
+}
+
+func newAuditor(w io.Writer, chain bool, now func() time.Time) *auditor {
+	return &auditor{w: w, chain: chain, now: now}
+}
+
+func (a *auditor) write(rec AuditRecord) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	rec.Time = a.now()
+	if a.chain {
+		rec.Prev = a.prev
+		hash, err := auditHash(rec)
+		if err != nil {
+			return err
+		}
+		rec.Hash = hash
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := a.w.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	a.prev = rec.Hash
+	return nil
+}
+
+// audit records rec once the operation has finished, for use with defer.
+// err points at the result of the operation, an audit failure is returned
+// through it if the operation itself succeeded.
+func (fs *Afero) audit(rec AuditRecord, err *error) {
+	if fs.auditor == nil {
+		return
+	}
+	rec.Actor = ActorFromContext(fs.ctx)
+	rec.Path = fs.virtual(rec.Path)
+	if rec.NewPath != "" {
+		rec.NewPath = fs.virtual(rec.NewPath)
+	}
+	rec.Result = "ok"
+	if *err != nil {
+		rec.Result = (*err).Error()
+	}
+	if werr := fs.auditor.write(rec); werr != nil && *err == nil {
+		*err = errors.Wrap(werr, "Error writing audit record")
+	}
+}
+
+// VerifyAuditLog checks the hash chain of an audit log written with
+// chaining enabled, returning ErrAuditChainBroken at the first record that
+// was altered, removed or reordered.
+func VerifyAuditLog(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	prev := ""
+	for line := 1; scanner.Scan(); line++ {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return errors.Wrapf(err, "Error reading audit record %d", line)
+		}
+		hash := rec.Hash
+		rec.Hash = ""
+		expect, err := auditHash(rec)
+		if err != nil {
+			return err
+		}
+		if rec.Prev != prev || hash != expect {
+			return errors.Wrapf(ErrAuditChainBroken, "record %d", line)
+		}
+		prev = hash
+	}
+	return scanner.Err()
+}
+
+func auditHash(rec AuditRecord) (string, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(rec.Prev), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditedFile records the bytes written through it when it is closed.
+type auditedFile struct {
+	afero.File
+	fs      *Afero
+	name    string
+	written int64
+}
+
+func (f *auditedFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	atomic.AddInt64(&f.written, int64(n))
+	return n, err
+}
+
+func (f *auditedFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	atomic.AddInt64(&f.written, int64(n))
+	return n, err
+}
+
+func (f *auditedFile) WriteString(s string) (int, error) {
+	n, err := f.File.WriteString(s)
+	atomic.AddInt64(&f.written, int64(n))
+	return n, err
+}
+
+func (f *auditedFile) Close() (err error) {
+	defer f.fs.audit(AuditRecord{Op: "close", Path: f.name, Bytes: atomic.LoadInt64(&f.written)}, &err)
+	return f.File.Close()
+}
@@ -0,0 +1,105 @@
+package afero
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+func readAuditLog(t *testing.T, log *bytes.Buffer) []AuditRecord {
+	var records []AuditRecord
+	scanner := bufio.NewScanner(bytes.NewReader(log.Bytes()))
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal("Error parsing audit record: ", err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestAudit(t *testing.T) {
+	var log bytes.Buffer
+	fs := New(afero.NewMemMapFs(), "/", false, WithAudit(&log, false)).(*Afero)
+	actorFs := fs.WithContext(ContextWithActor(context.Background(), "alice"))
+
+	f, err := actorFs.Create("/dir/file")
+	if err != nil {
+		t.Error("Error creating file: ", err)
+		return
+	}
+	if _, err := f.Write([]byte(rootFileCont)); err != nil {
+		t.Error("Error writing file: ", err)
+	}
+	f.Close()
+
+	if _, err := fs.Stat("/dir/file"); err != nil {
+		t.Error("Error stating file: ", err)
+	}
+	if err := fs.Rename("/dir/file", "/dir/moved"); err != nil {
+		t.Error("Error renaming file: ", err)
+	}
+	if err := fs.Remove("/dir/missing"); err == nil {
+		t.Error("Removed a file that does not exist")
+	}
+
+	records := readAuditLog(t, &log)
+	ops := []string{}
+	for _, rec := range records {
+		ops = append(ops, rec.Op)
+	}
+	if strings.Join(ops, ",") != "open,close,rename,remove" {
+		t.Error("Audit log does not record the mutating operations: ", ops)
+		return
+	}
+
+	if records[0].Actor != "alice" || records[0].Path != "/dir/file" || records[0].Flag == 0 {
+		t.Error("Open record does not describe the operation: ", records[0])
+	}
+	if records[1].Bytes != int64(len(rootFileCont)) {
+		t.Error("Close record does not report the bytes written: ", records[1].Bytes)
+	}
+	if records[2].Actor != "" || records[2].NewPath != "/dir/moved" || records[2].Result != "ok" {
+		t.Error("Rename record does not describe the operation: ", records[2])
+	}
+	if records[3].Result == "ok" {
+		t.Error("Failed remove recorded as successful")
+	}
+	if records[0].Hash != "" {
+		t.Error("Records hashed without chaining enabled")
+	}
+}
+
+func TestAuditChain(t *testing.T) {
+	var log bytes.Buffer
+	fs := New(afero.NewMemMapFs(), "/", false, WithAudit(&log, true))
+
+	for _, dir := range []string{"/a", "/b", "/c"} {
+		if err := fs.MkdirAll(dir, defaultDirectoryMode); err != nil {
+			t.Error("Error making directory: ", err)
+			return
+		}
+	}
+
+	if err := VerifyAuditLog(bytes.NewReader(log.Bytes())); err != nil {
+		t.Error("Untouched audit log does not verify: ", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	tampered := strings.Join([]string{lines[0], strings.Replace(lines[1], `"/b"`, `"/x"`, 1), lines[2]}, "\n")
+	if err := VerifyAuditLog(strings.NewReader(tampered)); !errors.Is(err, ErrAuditChainBroken) {
+		t.Error("Altered audit record was not detected: ", err)
+	}
+
+	removed := strings.Join([]string{lines[0], lines[2]}, "\n")
+	if err := VerifyAuditLog(strings.NewReader(removed)); !errors.Is(err, ErrAuditChainBroken) {
+		t.Error("Removed audit record was not detected: ", err)
+	}
+}
@@ -0,0 +1,190 @@
+package afero
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// bufferedFile reads ahead and holds back writes to cut down the calls made
+// to the backend. At most one of the buffers holds data at a time, anything
+// else first flushes pending writes and seeks the backend file back over
+// data read ahead but not consumed, so it sees the position and content the
+// caller expects.
+type bufferedFile struct {
+	afero.File
+	readAhead   int
+	writeBehind int
+
+	rbuf []byte
+	rpos int
+	wbuf []byte
+	// err is the first failed deferred write, returned from then on.
+	err error
+	m   sync.Mutex
+}
+
+func newBufferedFile(f afero.File, readAhead, writeBehind int) *bufferedFile {
+	return &bufferedFile{File: f, readAhead: readAhead, writeBehind: writeBehind}
+}
+
+// flush writes the pending data to the backend.
+func (f *bufferedFile) flush() error {
+	if f.err != nil {
+		return f.err
+	}
+	for written := 0; written < len(f.wbuf); {
+		n, err := f.File.Write(f.wbuf[written:])
+		written += n
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			f.err = err
+			break
+		}
+	}
+	f.wbuf = f.wbuf[:0]
+	return f.err
+}
+
+// settle flushes pending writes and drops read ahead data, leaving the
+// backend file at the position of the caller.
+func (f *bufferedFile) settle() error {
+	if err := f.flush(); err != nil {
+		return err
+	}
+	return f.unread()
+}
+
+// unread drops read ahead data, seeking the backend file back over it.
+func (f *bufferedFile) unread() error {
+	unread := len(f.rbuf) - f.rpos
+	f.rbuf, f.rpos = f.rbuf[:0], 0
+	if unread > 0 {
+		if _, err := f.File.Seek(int64(-unread), io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *bufferedFile) Read(p []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if err := f.flush(); err != nil {
+		return 0, err
+	}
+	if f.rpos == len(f.rbuf) {
+		if f.readAhead <= 0 || len(p) >= f.readAhead {
+			return f.File.Read(p)
+		}
+		if cap(f.rbuf) < f.readAhead {
+			f.rbuf = make([]byte, f.readAhead)
+		}
+		n, err := f.File.Read(f.rbuf[:f.readAhead])
+		f.rbuf, f.rpos = f.rbuf[:n], 0
+		if n == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, f.rbuf[f.rpos:])
+	f.rpos += n
+	return n, nil
+}
+
+func (f *bufferedFile) Write(p []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if err := f.unread(); err != nil {
+		return 0, err
+	}
+	if f.writeBehind <= 0 {
+		return f.File.Write(p)
+	}
+	if len(f.wbuf)+len(p) > f.writeBehind {
+		if err := f.flush(); err != nil {
+			return 0, err
+		}
+		if len(p) >= f.writeBehind {
+			return f.File.Write(p)
+		}
+	}
+	if f.wbuf == nil {
+		f.wbuf = make([]byte, 0, f.writeBehind)
+	}
+	f.wbuf = append(f.wbuf, p...)
+	return len(p), nil
+}
+
+func (f *bufferedFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *bufferedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if err := f.flush(); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *bufferedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if err := f.settle(); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *bufferedFile) Seek(offset int64, whence int) (int64, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if err := f.settle(); err != nil {
+		return 0, err
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *bufferedFile) Truncate(size int64) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if err := f.settle(); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *bufferedFile) Stat() (os.FileInfo, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if err := f.flush(); err != nil {
+		return nil, err
+	}
+	return f.File.Stat()
+}
+
+func (f *bufferedFile) Sync() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if err := f.flush(); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+// Close flushes pending writes, returning the first deferred write error
+// even though the file is closed regardless.
+func (f *bufferedFile) Close() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	err := f.flush()
+	if cerr := f.File.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,151 @@
+package afero
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// countingFs counts the reads and writes made on its files.
+type countingFs struct {
+	afero.Fs
+	reads, writes int
+	writeErr      error
+	closeErr      error
+}
+
+func (c *countingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := c.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &countingFile{File: f, fs: c}, nil
+}
+
+type countingFile struct {
+	afero.File
+	fs *countingFs
+}
+
+func (f *countingFile) Read(p []byte) (int, error) {
+	f.fs.reads++
+	return f.File.Read(p)
+}
+
+func (f *countingFile) Write(p []byte) (int, error) {
+	f.fs.writes++
+	if f.fs.writeErr != nil {
+		return 0, f.fs.writeErr
+	}
+	return f.File.Write(p)
+}
+
+func (f *countingFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	return f.fs.closeErr
+}
+
+func TestBufferedWrites(t *testing.T) {
+	backend := &countingFs{Fs: afero.NewMemMapFs()}
+	fs := New(backend, "/", false, WithBuffering(0, 64))
+
+	f, err := fs.Create("/file")
+	if err != nil {
+		t.Error("Error creating file: ", err)
+		return
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := f.Write([]byte("0123456789")); err != nil {
+			t.Error("Error writing file: ", err)
+			return
+		}
+	}
+	// ReadAt sees held back writes
+	p := make([]byte, 4)
+	if _, err := f.ReadAt(p, 96); err != nil || string(p) != "6789" {
+		t.Error("Unexpected ReadAt result: ", string(p), err)
+	}
+	if _, err := f.Write([]byte("end")); err != nil {
+		t.Error("Error writing file: ", err)
+		return
+	}
+	if err := f.Close(); err != nil {
+		t.Error("Error closing file: ", err)
+		return
+	}
+	if backend.writes != 3 {
+		t.Error("Expected 3 backend writes, got: ", backend.writes)
+	}
+	data, _ := afero.ReadFile(backend.Fs, "/file")
+	if len(data) != 103 || string(data[100:]) != "end" {
+		t.Error("Unexpected file content: ", string(data))
+	}
+}
+
+func TestBufferedReads(t *testing.T) {
+	backend := &countingFs{Fs: afero.NewMemMapFs()}
+	afero.WriteFile(backend.Fs, "/file", []byte("0123456789abcdef"), 0644)
+	fs := New(backend, "/", false, WithBuffering(8, 8))
+
+	f, err := fs.OpenFile("/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Error("Error opening file: ", err)
+		return
+	}
+	p := make([]byte, 2)
+	for i := 0; i < 3; i++ {
+		f.Read(p)
+	}
+	if backend.reads != 1 || string(p) != "45" {
+		t.Error("Reads were not buffered: ", backend.reads, string(p))
+	}
+
+	// seeks and writes apply at the position of the caller
+	if pos, err := f.Seek(2, io.SeekCurrent); err != nil || pos != 8 {
+		t.Error("Unexpected seek position: ", pos, err)
+		return
+	}
+	f.Read(p)
+	if string(p) != "89" {
+		t.Error("Unexpected read after seek: ", string(p))
+	}
+	f.Write([]byte("AB"))
+	f.Seek(0, io.SeekStart)
+	all, err := ioutil.ReadAll(f)
+	if err != nil || string(all) != "0123456789ABcdef" {
+		t.Error("Unexpected read after write: ", string(all), err)
+	}
+	if err := f.Truncate(12); err != nil {
+		t.Error("Error truncating file: ", err)
+	}
+	f.Close()
+
+	data, _ := afero.ReadFile(backend.Fs, "/file")
+	if string(data) != "0123456789AB" {
+		t.Error("Unexpected file content: ", string(data))
+	}
+}
+
+func TestBufferedWriteError(t *testing.T) {
+	backend := &countingFs{Fs: afero.NewMemMapFs()}
+	fs := New(backend, "/", false, WithBuffering(0, 64))
+
+	f, err := fs.Create("/file")
+	if err != nil {
+		t.Error("Error creating file: ", err)
+		return
+	}
+	backend.writeErr = errors.New("disk full")
+	if _, err := f.Write([]byte("data")); err != nil {
+		t.Error("Write was not held back: ", err)
+	}
+	if err := f.Close(); err != backend.writeErr {
+		t.Error("Close did not return the write error: ", err)
+	}
+}
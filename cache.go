@@ -0,0 +1,229 @@
+package afero
+
+import (
+	"container/list"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// CacheStats reports the effectiveness of the metadata cache, see
+// WithMetadataCache.
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	// Entries is the number of results currently cached.
+	Entries int
+}
+
+const (
+	cacheStat     = "stat"
+	cacheLstat    = "lstat"
+	cacheReadDir  = "readdir"
+	cacheReadlink = "readlink"
+)
+
+var cacheKinds = []string{cacheStat, cacheLstat, cacheReadDir, cacheReadlink}
+
+// cacheKey identifies a cached result by operation and virtual path, so
+// entries are shared by every Chroot.
+type cacheKey struct {
+	kind string
+	path string
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	value   interface{}
+	err     error
+	expires time.Time
+}
+
+// metaCache is a least recently used cache of metadata results. Every
+// invalidation bumps the generation, results loaded across one are not
+// stored as they may predate the mutation.
+type metaCache struct {
+	ttl     time.Duration
+	max     int
+	clock   clock
+	entries map[cacheKey]*list.Element
+	// linked holds the entries of Stat calls on symbolic links, which may
+	// resolve to any path and so are dropped on every invalidation.
+	linked map[cacheKey]*list.Element
+	lru    *list.List
+	gen    uint64
+	stats  CacheStats
+	m      sync.Mutex
+}
+
+func newMetaCache(ttl time.Duration, max int, c clock) *metaCache {
+	return &metaCache{ttl: ttl, max: max, clock: c, entries: map[cacheKey]*list.Element{}, linked: map[cacheKey]*list.Element{}, lru: list.New()}
+}
+
+func (c *metaCache) get(key cacheKey) (interface{}, error, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		if c.ttl <= 0 || c.clock.Now().Before(entry.expires) {
+			c.lru.MoveToFront(el)
+			c.stats.Hits++
+			return entry.value, entry.err, true
+		}
+		c.remove(el)
+	}
+	c.stats.Misses++
+	return nil, nil, false
+}
+
+func (c *metaCache) generation() uint64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.gen
+}
+
+func (c *metaCache) put(key cacheKey, value interface{}, err error, linked bool, gen uint64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	entry := &cacheEntry{key: key, value: value, err: err, expires: c.clock.Now().Add(c.ttl)}
+	c.entries[key] = c.lru.PushFront(entry)
+	if linked {
+		c.linked[key] = c.entries[key]
+	}
+	for c.max > 0 && c.lru.Len() > c.max {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *metaCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+	delete(c.linked, el.Value.(*cacheEntry).key)
+}
+
+// invalidate drops the results for name and its ancestors, whose listings
+// and times a mutation of name may change, those of Stat calls through
+// symbolic links, and with tree set the results for everything below name.
+func (c *metaCache) invalidate(name string, tree bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.gen++
+	for _, el := range c.linked {
+		c.remove(el)
+	}
+	for dir := name; ; dir = path.Dir(dir) {
+		for _, kind := range cacheKinds {
+			if el, ok := c.entries[cacheKey{kind, dir}]; ok {
+				c.remove(el)
+			}
+		}
+		if dir == "/" {
+			break
+		}
+	}
+	if !tree {
+		return
+	}
+	for key, el := range c.entries {
+		if isBelow(key.path, name) {
+			c.remove(el)
+		}
+	}
+}
+
+// cached returns the result of load for the kind of lookup of name, from
+// the metadata cache when enabled. Missing files are cached as well, go-git
+// probes for many.
+func (fs *Afero) cached(kind, name string, load func() (interface{}, error)) (interface{}, error) {
+	return fs.cachedLinked(kind, name, func() (interface{}, bool, error) {
+		value, err := load()
+		return value, false, err
+	})
+}
+
+// cachedLinked is cached for loads that report whether they followed a
+// symbolic link.
+func (fs *Afero) cachedLinked(kind, name string, load func() (interface{}, bool, error)) (interface{}, error) {
+	c := fs.cache
+	if c == nil {
+		value, _, err := load()
+		return value, err
+	}
+	key := cacheKey{kind: kind, path: fs.virtual(name)}
+	if value, err, ok := c.get(key); ok {
+		return value, err
+	}
+	gen := c.generation()
+	value, linked, err := load()
+	if err == nil || os.IsNotExist(err) {
+		c.put(key, value, err, linked, gen)
+	}
+	return value, err
+}
+
+// invalidate drops the cached metadata and hashes a mutation of name may
+// have changed.
+func (fs *Afero) invalidate(name string, tree bool) {
+	if fs.cache != nil {
+		fs.cache.invalidate(fs.virtual(name), tree)
+	}
+	if fs.hashes != nil {
+		fs.hashes.invalidate(fs.virtual(name), tree)
+	}
+}
+
+// CacheStats returns the hit and miss counts of the metadata cache, shared
+// by every Chroot. It is zero without WithMetadataCache.
+func (fs *Afero) CacheStats() CacheStats {
+	if fs.cache == nil {
+		return CacheStats{}
+	}
+	fs.cache.m.Lock()
+	defer fs.cache.m.Unlock()
+	stats := fs.cache.stats
+	stats.Entries = fs.cache.lru.Len()
+	return stats
+}
+
+// cachedFile invalidates the metadata and hashes of its file as it changes.
+type cachedFile struct {
+	afero.File
+	fs   *Afero
+	name string
+}
+
+func (f *cachedFile) Write(p []byte) (int, error) {
+	defer f.fs.invalidate(f.name, false)
+	return f.File.Write(p)
+}
+
+func (f *cachedFile) WriteAt(p []byte, off int64) (int, error) {
+	defer f.fs.invalidate(f.name, false)
+	return f.File.WriteAt(p, off)
+}
+
+func (f *cachedFile) WriteString(s string) (int, error) {
+	defer f.fs.invalidate(f.name, false)
+	return f.File.WriteString(s)
+}
+
+func (f *cachedFile) Truncate(size int64) error {
+	defer f.fs.invalidate(f.name, false)
+	return f.File.Truncate(size)
+}
+
+func (f *cachedFile) Close() error {
+	defer f.fs.invalidate(f.name, false)
+	return f.File.Close()
+}
@@ -0,0 +1,189 @@
+package afero
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/spf13/afero"
+)
+
+func newCacheTestFs(ttl time.Duration, max int) (*Afero, afero.Fs, *fakeClock) {
+	c := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	backend := afero.NewMemMapFs()
+	fs := New(backend, "/", false, WithMetadataCache(ttl, max)).(*Afero)
+	fs.cache.clock = c
+	return fs, backend, c
+}
+
+func TestCacheHits(t *testing.T) {
+	fs, backend, _ := newCacheTestFs(time.Minute, 0)
+	afero.WriteFile(backend, "/file", []byte("data"), 0644)
+
+	for i := 0; i < 3; i++ {
+		if _, err := fs.Stat("/file"); err != nil {
+			t.Error("Error stating file: ", err)
+			return
+		}
+	}
+	stats := fs.CacheStats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Error("Unexpected cache stats: ", stats)
+	}
+
+	// missing files are cached until created through the filesystem
+	if _, err := fs.Stat("/new"); !os.IsNotExist(err) {
+		t.Error("Expected new to be missing, got: ", err)
+		return
+	}
+	afero.WriteFile(backend, "/new", []byte("data"), 0644)
+	if _, err := fs.Stat("/new"); !os.IsNotExist(err) {
+		t.Error("Expected the cached result, got: ", err)
+	}
+	f, err := fs.Create("/new")
+	if err != nil {
+		t.Error("Error creating file: ", err)
+		return
+	}
+	f.Close()
+	if _, err := fs.Stat("/new"); err != nil {
+		t.Error("Create did not invalidate the cache: ", err)
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	fs, _, _ := newCacheTestFs(time.Minute, 0)
+	if err := fs.MkdirAll("/a/sub", 0755); err != nil {
+		t.Error("Error creating directory: ", err)
+		return
+	}
+	if l, err := fs.ReadDir("/a/sub"); err != nil || len(l) != 0 {
+		t.Error("Expected an empty directory, got: ", l, err)
+		return
+	}
+
+	// a Chroot shares the cache
+	chroot, err := fs.Chroot("/a")
+	if err != nil {
+		t.Error("Error creating chroot: ", err)
+		return
+	}
+	f, err := chroot.Create("/sub/file")
+	if err != nil {
+		t.Error("Error creating file: ", err)
+		return
+	}
+	f.Close()
+	if l, err := fs.ReadDir("/a/sub"); err != nil || len(l) != 1 {
+		t.Error("Create did not invalidate the parent listing: ", l, err)
+	}
+	if _, err := fs.Stat("/a/sub/file"); err != nil {
+		t.Error("Error stating file: ", err)
+		return
+	}
+
+	if err := fs.Rename("/a", "/b"); err != nil {
+		t.Error("Error renaming directory: ", err)
+		return
+	}
+	if _, err := fs.Stat("/a/sub/file"); !os.IsNotExist(err) {
+		t.Error("Rename did not invalidate the subtree: ", err)
+	}
+	if _, err := fs.Stat("/b/sub/file"); err != nil {
+		t.Error("Error stating renamed file: ", err)
+	}
+}
+
+func TestCacheBounds(t *testing.T) {
+	fs, backend, c := newCacheTestFs(time.Minute, 2)
+	for _, name := range []string{"/1", "/2", "/3"} {
+		fs.Stat(name)
+	}
+	stats := fs.CacheStats()
+	if stats.Entries != 2 || stats.Evictions != 1 {
+		t.Error("Cache was not bounded: ", stats)
+	}
+
+	afero.WriteFile(backend, "/3", []byte("data"), 0644)
+	c.Sleep(time.Minute)
+	if _, err := fs.Stat("/3"); err != nil {
+		t.Error("Cached result did not expire: ", err)
+	}
+}
+
+func TestCacheSymlink(t *testing.T) {
+	dir, err := afero.TempDir(afero.NewOsFs(), tempDir, "cache.")
+	if err != nil {
+		t.Error("Error creating temp directory: ", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	fs := New(afero.NewBasePathFs(afero.NewOsFs(), dir), "/", false, WithMetadataCache(time.Minute, 0)).(*Afero)
+
+	if err := util.WriteFile(fs, "/a", []byte("a"), 0644); err != nil {
+		t.Error("Error writing file: ", err)
+		return
+	}
+	if err := util.WriteFile(fs, "/b", []byte("bb"), 0644); err != nil {
+		t.Error("Error writing file: ", err)
+		return
+	}
+	if err := fs.Symlink("a", "/link"); err != nil {
+		t.Error("Error creating symlink: ", err)
+		return
+	}
+	if fi, err := fs.Stat("/link"); err != nil || fi.Size() != 1 {
+		t.Error("Unexpected Stat of link: ", fi, err)
+		return
+	}
+
+	// writing through the target path
+	if err := util.WriteFile(fs, "/a", []byte("aaa"), 0644); err != nil {
+		t.Error("Error writing file: ", err)
+		return
+	}
+	if fi, err := fs.Stat("/link"); err != nil || fi.Size() != 3 {
+		t.Error("Stat of link is stale after writing its target: ", fi, err)
+		return
+	}
+
+	// changing the target of the link
+	if err := fs.Remove("/link"); err != nil {
+		t.Error("Error removing symlink: ", err)
+		return
+	}
+	if err := fs.Symlink("b", "/link"); err != nil {
+		t.Error("Error creating symlink: ", err)
+		return
+	}
+	if fi, err := fs.Stat("/link"); err != nil || fi.Size() != 2 {
+		t.Error("Stat of link is stale after changing its target: ", fi, err)
+		return
+	}
+
+	// a dangling link resolves once its target is created
+	if err := fs.Symlink("c", "/dangling"); err != nil {
+		t.Error("Error creating symlink: ", err)
+		return
+	}
+	if _, err := fs.Stat("/dangling"); !os.IsNotExist(err) {
+		t.Error("Expected dangling link to be missing, got: ", err)
+		return
+	}
+	if err := util.WriteFile(fs, "/c", []byte("c"), 0644); err != nil {
+		t.Error("Error writing file: ", err)
+		return
+	}
+	if _, err := fs.Stat("/dangling"); err != nil {
+		t.Error("Stat of link is stale after creating its target: ", err)
+	}
+
+	// other results are still cached
+	fs.Stat("/b")
+	hits := fs.CacheStats().Hits
+	fs.Stat("/b")
+	if fs.CacheStats().Hits != hits+1 {
+		t.Error("Stat of a plain file was not cached")
+	}
+}
@@ -0,0 +1,585 @@
+package afero
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/spf13/afero"
+)
+
+const (
+	casRefPrefix = "cas1 "
+	// casMaxRef bounds the size of a reference file, larger files are not
+	// references.
+	casMaxRef  = 128
+	casObjects = "/objects"
+	casTemp    = "/tmp"
+)
+
+// CasStats reports the space saved by a CasFs.
+type CasStats struct {
+	// Files is the number of files referencing stored objects.
+	Files   int
+	Objects int
+	// LogicalBytes is the total size of the files, PhysicalBytes the total
+	// size of the objects they share.
+	LogicalBytes  int64
+	PhysicalBytes int64
+}
+
+type casObject struct {
+	refs int
+	size int64
+}
+
+// CasFs is an afero.Fs storing the content of files once per distinct
+// content. Files in the tree filesystem are references naming an object in
+// the store filesystem by the sha256 of its content. Files opened for
+// writing are copied to a temporary file in the store, which replaces the
+// reference when closed. Objects are removed once no file refers to them.
+type CasFs struct {
+	tree  afero.Fs
+	store afero.Fs
+
+	objects map[string]*casObject
+	loaded  bool
+	temps   map[string]bool
+	m       sync.Mutex
+}
+
+// NewCasFs returns a CasFs keeping the directory tree and file references in
+// tree and the objects in store. Both are addressed with absolute paths.
+func NewCasFs(tree, store afero.Fs) *CasFs {
+	return &CasFs{tree: tree, store: store, temps: map[string]bool{}}
+}
+
+// NewCas returns a billy filesystem over a CasFs.
+func NewCas(tree, store afero.Fs, root string, debug bool) billy.Filesystem {
+	return New(NewCasFs(tree, store), root, debug)
+}
+
+func casObjectPath(hash string) string {
+	return path.Join(casObjects, hash[:2], hash)
+}
+
+func casRef(hash string, size int64) []byte {
+	return []byte(fmt.Sprintf("%s%s %d\n", casRefPrefix, hash, size))
+}
+
+// readRef returns the object the named file refers to, reporting false if
+// it is not a reference. Unless follow is set a symlink is not one, so
+// links to a file never count as references to its object.
+func readRef(fs afero.Fs, name string, follow bool) (hash string, size int64, ok bool) {
+	var fi os.FileInfo
+	var err error
+	if follow {
+		fi, err = fs.Stat(name)
+	} else {
+		fi, _, err = lstat(fs, name)
+	}
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() > casMaxRef {
+		return "", 0, false
+	}
+	data, err := afero.ReadFile(fs, name)
+	if err != nil || !strings.HasPrefix(string(data), casRefPrefix) {
+		return "", 0, false
+	}
+	if _, err := fmt.Sscanf(string(data[len(casRefPrefix):]), "%64s %d\n", &hash, &size); err != nil || len(hash) != 64 {
+		return "", 0, false
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", 0, false
+	}
+	return hash, size, true
+}
+
+// load counts the references to each object, once. It must be called with
+// the lock held.
+func (c *CasFs) load() error {
+	if c.loaded {
+		return nil
+	}
+	objects := map[string]*casObject{}
+	err := afero.Walk(c.tree, "/", func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if hash, size, ok := readRef(c.tree, name, false); ok {
+			if objects[hash] == nil {
+				objects[hash] = &casObject{size: size}
+			}
+			objects[hash].refs++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.objects, c.loaded = objects, true
+	return nil
+}
+
+// release drops a reference to hash, removing the object with the last one.
+// It must be called with the lock held.
+func (c *CasFs) release(hash string) error {
+	obj := c.objects[hash]
+	if obj == nil {
+		return nil
+	}
+	if obj.refs--; obj.refs > 0 {
+		return nil
+	}
+	delete(c.objects, hash)
+	if err := c.store.Remove(casObjectPath(hash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// commit stores the temporary file tmp as an object and points name at it,
+// releasing the object name referred to before.
+func (c *CasFs) commit(name, tmp string, perm os.FileMode) error {
+	hash, size, err := casHash(c.store, tmp)
+	if err != nil {
+		return err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.temps, tmp)
+	if err := c.load(); err != nil {
+		return err
+	}
+
+	object := casObjectPath(hash)
+	if c.objects[hash] != nil || exists(c.store, object) {
+		if err := c.store.Remove(tmp); err != nil {
+			return err
+		}
+	} else {
+		if err := c.store.MkdirAll(path.Dir(object), defaultDirectoryMode); err != nil {
+			return err
+		}
+		if err := c.store.Rename(tmp, object); err != nil {
+			return err
+		}
+	}
+	if c.objects[hash] == nil {
+		c.objects[hash] = &casObject{size: size}
+	}
+	c.objects[hash].refs++
+
+	old, _, hadOld := readRef(c.tree, name, true)
+	if err := afero.WriteFile(c.tree, name, casRef(hash, size), perm); err != nil {
+		c.release(hash)
+		return err
+	}
+	if hadOld {
+		return c.release(old)
+	}
+	return nil
+}
+
+func casHash(fs afero.Fs, name string) (string, int64, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// Stats counts the files and objects and their sizes.
+func (c *CasFs) Stats() (CasStats, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if err := c.load(); err != nil {
+		return CasStats{}, err
+	}
+	var stats CasStats
+	for _, obj := range c.objects {
+		stats.Files += obj.refs
+		stats.Objects++
+		stats.LogicalBytes += int64(obj.refs) * obj.size
+		stats.PhysicalBytes += obj.size
+	}
+	return stats, nil
+}
+
+// GC recounts the references from the tree and removes the objects and
+// temporary files nothing refers to, such as those left behind by a crash.
+func (c *CasFs) GC() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.loaded = false
+	if err := c.load(); err != nil {
+		return err
+	}
+	var orphans []string
+	err := afero.Walk(c.store, "/", func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if isBelow(name, casTemp) && !c.temps[name] || isBelow(name, casObjects) && c.objects[path.Base(name)] == nil {
+			orphans = append(orphans, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range orphans {
+		if err := c.store.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// info returns fi with the size of the object the named file refers to.
+func (c *CasFs) info(name string, fi os.FileInfo) os.FileInfo {
+	if !fi.Mode().IsRegular() {
+		return fi
+	}
+	if _, size, ok := readRef(c.tree, name, true); ok {
+		return compInfo{FileInfo: fi, size: size}
+	}
+	return fi
+}
+
+// Name returns the name of this filesystem.
+func (c *CasFs) Name() string {
+	return "CasFs"
+}
+
+// Create creates or truncates the named file.
+func (c *CasFs) Create(name string) (afero.File, error) {
+	return c.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, defaultCreateMode)
+}
+
+// Open opens the named file for reading.
+func (c *CasFs) Open(name string) (afero.File, error) {
+	return c.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file. Files opened for reading are served from
+// their object, files opened for writing from a private copy.
+func (c *CasFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	fi, err := c.tree.Stat(name)
+	switch {
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case os.IsNotExist(err) && flag&os.O_CREATE != 0:
+		// new files refer to the empty object until closed
+		if err := c.create(name, perm); err != nil {
+			return nil, err
+		}
+		return c.OpenFile(name, flag&^(os.O_CREATE|os.O_EXCL), perm)
+	case err != nil:
+		return nil, err
+	case fi.IsDir():
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		f, err := c.tree.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		return &casDir{File: f, fs: c, name: name}, nil
+	}
+
+	hash, _, ok := readRef(c.tree, name, true)
+	if !ok {
+		// not a reference, served as it is
+		return c.tree.OpenFile(name, flag, perm)
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		f, err := c.store.Open(casObjectPath(hash))
+		if err != nil {
+			return nil, err
+		}
+		return &casFile{File: f, fs: c, name: name, info: c.info(name, fi)}, nil
+	}
+
+	f, tmp, err := c.temp(flag & os.O_APPEND)
+	if err != nil {
+		return nil, err
+	}
+	if flag&os.O_TRUNC == 0 {
+		if err := copyObject(c.store, casObjectPath(hash), f); err != nil {
+			f.Close()
+			c.forget(tmp)
+			return nil, err
+		}
+	}
+	return &casFile{File: f, fs: c, name: name, tmp: tmp, perm: fi.Mode().Perm()}, nil
+}
+
+// temp creates a private file in the store.
+func (c *CasFs) temp(flag int) (afero.File, string, error) {
+	tmp := path.Join(casTemp, newID(time.Now()))
+	if err := c.store.MkdirAll(casTemp, defaultDirectoryMode); err != nil {
+		return nil, "", err
+	}
+	f, err := c.store.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL|flag, defaultCreateMode)
+	if err != nil {
+		return nil, "", err
+	}
+	c.m.Lock()
+	c.temps[tmp] = true
+	c.m.Unlock()
+	return f, tmp, nil
+}
+
+// forget removes a private file that will not be committed.
+func (c *CasFs) forget(tmp string) {
+	c.m.Lock()
+	delete(c.temps, tmp)
+	c.m.Unlock()
+	c.store.Remove(tmp)
+}
+
+// create points name at the empty object.
+func (c *CasFs) create(name string, perm os.FileMode) error {
+	f, tmp, err := c.temp(0)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		c.forget(tmp)
+		return err
+	}
+	return c.commit(name, tmp, perm)
+}
+
+func copyObject(store afero.Fs, object string, dst afero.File) error {
+	src, err := store.Open(object)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	_, err = dst.Seek(0, io.SeekStart)
+	return err
+}
+
+// Mkdir creates a directory.
+func (c *CasFs) Mkdir(name string, perm os.FileMode) error {
+	return c.tree.Mkdir(name, perm)
+}
+
+// MkdirAll creates a directory and any missing parents.
+func (c *CasFs) MkdirAll(name string, perm os.FileMode) error {
+	return c.tree.MkdirAll(name, perm)
+}
+
+// Remove removes a file or empty directory, releasing its object.
+func (c *CasFs) Remove(name string) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if err := c.load(); err != nil {
+		return err
+	}
+	hash, _, ok := readRef(c.tree, name, false)
+	if err := c.tree.Remove(name); err != nil {
+		return err
+	}
+	if ok {
+		return c.release(hash)
+	}
+	return nil
+}
+
+// RemoveAll removes a path and everything below it, releasing the objects
+// of the files removed.
+func (c *CasFs) RemoveAll(name string) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if err := c.load(); err != nil {
+		return err
+	}
+	var hashes []string
+	afero.Walk(c.tree, name, func(name string, fi os.FileInfo, err error) error {
+		if err == nil {
+			if hash, _, ok := readRef(c.tree, name, false); ok {
+				hashes = append(hashes, hash)
+			}
+		}
+		return nil
+	})
+	if err := c.tree.RemoveAll(name); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if err := c.release(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename moves oldname to newname, releasing the object of a file replaced.
+func (c *CasFs) Rename(oldname, newname string) error {
+	if path.Clean(oldname) == path.Clean(newname) {
+		_, _, err := lstat(c.tree, oldname)
+		return err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if err := c.load(); err != nil {
+		return err
+	}
+	hash, _, ok := readRef(c.tree, newname, false)
+	moved, _, _ := readRef(c.tree, oldname, false)
+	if err := c.tree.Rename(oldname, newname); err != nil {
+		return err
+	}
+	// renaming a hard link onto the same file is a no-op, nothing was
+	// replaced
+	if ok && hash == moved && exists(c.tree, oldname) {
+		return nil
+	}
+	if ok {
+		return c.release(hash)
+	}
+	return nil
+}
+
+// Stat returns the FileInfo of the named file with the size of its content.
+func (c *CasFs) Stat(name string) (os.FileInfo, error) {
+	fi, err := c.tree.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.info(name, fi), nil
+}
+
+// Chmod changes the mode of the named file.
+func (c *CasFs) Chmod(name string, mode os.FileMode) error {
+	return c.tree.Chmod(name, mode)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (c *CasFs) Chtimes(name string, atime, mtime time.Time) error {
+	return c.tree.Chtimes(name, atime, mtime)
+}
+
+// LstatIfPossible implements afero.Lstater.
+func (c *CasFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	fi, ok, err := lstat(c.tree, name)
+	if err != nil {
+		return nil, ok, err
+	}
+	return c.info(name, fi), ok, nil
+}
+
+// SymlinkIfPossible implements afero.Linker.
+func (c *CasFs) SymlinkIfPossible(oldname, newname string) error {
+	if linker, ok := c.tree.(afero.Linker); ok {
+		return linker.SymlinkIfPossible(oldname, newname)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+}
+
+// ReadlinkIfPossible implements afero.LinkReader.
+func (c *CasFs) ReadlinkIfPossible(name string) (string, error) {
+	if reader, ok := c.tree.(afero.LinkReader); ok {
+		return reader.ReadlinkIfPossible(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+}
+
+// casDir reports the content sizes of directory entries.
+type casDir struct {
+	afero.File
+	fs   *CasFs
+	name string
+}
+
+func (d *casDir) Readdir(count int) ([]os.FileInfo, error) {
+	list, err := d.File.Readdir(count)
+	for i, fi := range list {
+		list[i] = d.fs.info(path.Join(d.name, fi.Name()), fi)
+	}
+	return list, err
+}
+
+// casFile is an object opened for reading, or the private copy of a file
+// opened for writing when tmp is set.
+type casFile struct {
+	afero.File
+	fs   *CasFs
+	name string
+	info os.FileInfo
+	tmp  string
+	perm os.FileMode
+}
+
+func (f *casFile) Name() string {
+	return f.name
+}
+
+func (f *casFile) Stat() (os.FileInfo, error) {
+	if f.info != nil {
+		return f.info, nil
+	}
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return namedInfo{FileInfo: fi, name: path.Base(f.name)}, nil
+}
+
+func (f *casFile) Write(p []byte) (int, error) {
+	if f.tmp == "" {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	return f.File.Write(p)
+}
+
+func (f *casFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.tmp == "" {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *casFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *casFile) Truncate(size int64) error {
+	if f.tmp == "" {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EBADF}
+	}
+	return f.File.Truncate(size)
+}
+
+// Close stores the content written as an object and points the file at it.
+func (f *casFile) Close() error {
+	if err := f.File.Close(); err != nil || f.tmp == "" {
+		return err
+	}
+	return f.fs.commit(f.name, f.tmp, f.perm)
+}
@@ -0,0 +1,189 @@
+package afero
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestCasDeduplication(t *testing.T) {
+	tree, store := afero.NewMemMapFs(), afero.NewMemMapFs()
+	fs := NewCas(tree, store, "/", false)
+
+	content := []byte("shared content")
+	for _, name := range []string{"/a/file", "/b/file", "/c/other"} {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Error("Error creating file: ", err)
+			return
+		}
+		f.Write(content)
+		if err := f.Close(); err != nil {
+			t.Error("Error closing file: ", err)
+			return
+		}
+	}
+
+	stats, err := NewCasFs(tree, store).Stats()
+	if err != nil {
+		t.Error("Error reading stats: ", err)
+		return
+	}
+	if stats.Files != 3 || stats.Objects != 1 || stats.LogicalBytes != 3*int64(len(content)) || stats.PhysicalBytes != int64(len(content)) {
+		t.Error("Unexpected stats: ", stats)
+	}
+	if fi, err := fs.Stat("/b/file"); err != nil || fi.Size() != int64(len(content)) {
+		t.Error("Stat did not report the content size: ", fi, err)
+	}
+	if list, err := fs.ReadDir("/a"); err != nil || len(list) != 1 || list[0].Size() != int64(len(content)) {
+		t.Error("ReadDir did not report the content size: ", list, err)
+	}
+	f, _ := fs.Open("/c/other")
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Error("Wrote to a file opened for reading")
+	}
+	f.Close()
+}
+
+func TestCasCopyOnWrite(t *testing.T) {
+	tree, store := afero.NewMemMapFs(), afero.NewMemMapFs()
+	cas := NewCasFs(tree, store)
+	fs := New(cas, "/", false)
+	afero.WriteFile(cas, "/a", []byte("original"), 0644)
+	afero.WriteFile(cas, "/b", []byte("original"), 0644)
+
+	f, err := fs.OpenFile("/a", os.O_RDWR, 0)
+	if err != nil {
+		t.Error("Error opening file: ", err)
+		return
+	}
+	f.Seek(0, 2)
+	f.Write([]byte(" changed"))
+	// the change is private until closed
+	if data, _ := afero.ReadFile(cas, "/a"); string(data) != "original" {
+		t.Error("Change visible before close: ", string(data))
+	}
+	f.Close()
+
+	if data, _ := afero.ReadFile(cas, "/a"); string(data) != "original changed" {
+		t.Error("Unexpected content of the written file: ", string(data))
+	}
+	if data, _ := afero.ReadFile(cas, "/b"); string(data) != "original" {
+		t.Error("Shared file was changed: ", string(data))
+	}
+	if stats, _ := cas.Stats(); stats.Objects != 2 {
+		t.Error("Unexpected stats: ", stats)
+	}
+}
+
+func TestCasGarbageCollection(t *testing.T) {
+	tree, store := afero.NewMemMapFs(), afero.NewMemMapFs()
+	cas := NewCasFs(tree, store)
+	fs := New(cas, "/", false)
+	afero.WriteFile(cas, "/dir/a", []byte("one"), 0644)
+	afero.WriteFile(cas, "/dir/b", []byte("one"), 0644)
+	afero.WriteFile(cas, "/dir/c", []byte("two"), 0644)
+	afero.WriteFile(cas, "/d", []byte("three"), 0644)
+
+	if err := fs.Remove("/dir/a"); err != nil {
+		t.Error("Error removing file: ", err)
+		return
+	}
+	if stats, _ := cas.Stats(); stats.Objects != 3 {
+		t.Error("Object still referenced was removed: ", stats)
+	}
+	// renaming over a file releases its object
+	if err := fs.Rename("/d", "/dir/c"); err != nil {
+		t.Error("Error renaming file: ", err)
+		return
+	}
+	if stats, _ := cas.Stats(); stats.Objects != 2 || stats.Files != 2 {
+		t.Error("Replaced object was not released: ", stats)
+	}
+	if err := cas.RemoveAll("/dir"); err != nil {
+		t.Error("Error removing directory: ", err)
+		return
+	}
+	if stats, _ := cas.Stats(); stats.Objects != 0 || stats.PhysicalBytes != 0 {
+		t.Error("Objects were not released: ", stats)
+	}
+	if list, _ := afero.ReadDir(store, casObjects+"/"+casHashOf("one")[:2]); len(list) != 0 {
+		t.Error("Object files were not removed: ", list)
+	}
+
+	// GC removes what a crash left behind
+	afero.WriteFile(store, casTemp+"/leftover", []byte("partial"), 0644)
+	afero.WriteFile(store, casObjectPath(casHashOf("lost")), []byte("lost"), 0644)
+	f, _ := cas.Create("/open")
+	if err := cas.GC(); err != nil {
+		t.Error("Error collecting garbage: ", err)
+		return
+	}
+	if exists(store, casTemp+"/leftover") || exists(store, casObjectPath(casHashOf("lost"))) {
+		t.Error("Garbage was not collected")
+	}
+	f.Write([]byte("still open"))
+	if err := f.Close(); err != nil {
+		t.Error("Open file was collected: ", err)
+	}
+}
+
+func casHashOf(content string) string {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/f", []byte(content), 0644)
+	hash, _, _ := casHash(fs, "/f")
+	return hash
+}
+
+func TestCasSymlinks(t *testing.T) {
+	dir, err := afero.TempDir(afero.NewOsFs(), tempDir, "cas.")
+	if err != nil {
+		t.Error("Error creating temp dir: ", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	cas := NewCasFs(afero.NewBasePathFs(afero.NewOsFs(), dir), afero.NewMemMapFs())
+	afero.WriteFile(cas, "/a", []byte("content"), 0644)
+	if err := cas.SymlinkIfPossible("a", "/b"); err != nil {
+		t.Error("Error creating symlink: ", err)
+		return
+	}
+	if data, err := afero.ReadFile(cas, "/b"); err != nil || string(data) != "content" {
+		t.Error("Error reading through symlink: ", string(data), err)
+	}
+
+	// a fresh CasFs counts the references from the tree
+	cas = NewCasFs(cas.tree, cas.store)
+	if stats, err := cas.Stats(); err != nil || stats.Files != 1 {
+		t.Error("Symlink was counted as a reference: ", stats, err)
+	}
+	if err := cas.Remove("/b"); err != nil {
+		t.Error("Error removing symlink: ", err)
+	}
+	if data, err := afero.ReadFile(cas, "/a"); err != nil || string(data) != "content" {
+		t.Error("Removing a symlink released the object: ", string(data), err)
+	}
+}
+
+func TestCasRenameOntoItself(t *testing.T) {
+	cas := NewCasFs(afero.NewMemMapFs(), afero.NewMemMapFs())
+	afero.WriteFile(cas, "/c", []byte("content"), 0644)
+	if err := cas.Rename("/c", "/./c"); err != nil {
+		t.Error("Error renaming onto itself: ", err)
+	}
+	if data, err := afero.ReadFile(cas, "/c"); err != nil || string(data) != "content" {
+		t.Error("Renaming onto itself released the object: ", string(data), err)
+	}
+
+	afero.WriteFile(cas, "/d", []byte("content"), 0644)
+	if err := cas.Rename("/d", "/c"); err != nil {
+		t.Error("Error renaming: ", err)
+	}
+	if stats, _ := cas.Stats(); stats.Files != 1 || stats.Objects != 1 {
+		t.Error("Unexpected stats after replacing a file of the same content: ", stats)
+	}
+	if data, err := afero.ReadFile(cas, "/c"); err != nil || string(data) != "content" {
+		t.Error("Replacing a file of the same content released the object: ", string(data), err)
+	}
+}
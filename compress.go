@@ -0,0 +1,963 @@
+package afero
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// Compression selects how the files matching a CompressionRule are stored.
+type Compression uint8
+
+// Compressions, NoCompression rules keep matching files from being
+// compressed by later rules.
+const (
+	NoCompression Compression = iota
+	Gzip
+	Zstd
+)
+
+// CompressionRule compresses new files whose path matches Pattern, a
+// path.Match pattern matched against the base name when it has no slash and
+// against the absolute path otherwise.
+type CompressionRule struct {
+	Pattern     string
+	Compression Compression
+}
+
+// Compressed files start with a fixed size header, followed by frames each
+// holding one chunk of up to the chunk size plaintext bytes, compressed on
+// its own so any chunk can be read without the ones before it. The index of
+// the frames follows them. Frames replaced by writes are appended to the end
+// and the space they leave behind is reclaimed by compacting the file once
+// it makes up more than half of it.
+const (
+	compMagic      = "BACZ"
+	compVersion    = 1
+	compHeaderSize = len(compMagic) + 1 + 1 + 4 + 8 + 8
+	compEntrySize  = 8 + 4 + 1
+	compChunkSize  = 64 * 1024
+	// compMaxDirty is the number of modified chunks kept in memory.
+	compMaxDirty = 16
+	// compMaxSizes is the number of uncompressed sizes remembered by Stat.
+	compMaxSizes = 4096
+)
+
+// frame kinds
+const (
+	frameZero = iota
+	frameStored
+	frameCompressed
+)
+
+// ErrCorruptCompressed is returned reading a compressed file whose frames
+// cannot be decoded.
+var ErrCorruptCompressed = errors.New("Compressed file is corrupt")
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// zstdCodec returns the shared zstd encoder and decoder, both safe for
+// concurrent EncodeAll and DecodeAll calls.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+func compressChunk(c Compression, plain []byte) ([]byte, error) {
+	switch c {
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(plain); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(plain, nil), nil
+	}
+	return plain, nil
+}
+
+func decompressChunk(c Compression, data []byte) ([]byte, error) {
+	switch c {
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case Zstd:
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return dec.DecodeAll(data, nil)
+	}
+	return data, nil
+}
+
+// CompressedFs is an afero.Fs compressing the files of another filesystem
+// that match its rules. Other files, and those compressing does not make
+// smaller, are stored as they are, and files keep the way they are stored
+// until they are truncated on open. Sizes are reported uncompressed.
+type CompressedFs struct {
+	fs    afero.Fs
+	rules []CompressionRule
+
+	sizes map[string]compSize
+	m     sync.Mutex
+}
+
+// compSize is the uncompressed size of a file, -1 for files stored as they
+// are, valid while the backend size and modification time are unchanged.
+type compSize struct {
+	size  int64
+	mtime time.Time
+	plain int64
+}
+
+// NewCompressedFs returns a CompressedFs over fs, compressing new files with
+// the first of rules they match.
+func NewCompressedFs(fs afero.Fs, rules ...CompressionRule) *CompressedFs {
+	return &CompressedFs{fs: fs, rules: rules, sizes: map[string]compSize{}}
+}
+
+// NewCompressed returns a billy filesystem over a CompressedFs.
+func NewCompressed(fs afero.Fs, root string, debug bool, rules ...CompressionRule) billy.Filesystem {
+	return New(NewCompressedFs(fs, rules...), root, debug)
+}
+
+// compression returns the compression of new files at name.
+func (c *CompressedFs) compression(name string) Compression {
+	name = mountPath(name)
+	for _, rule := range c.rules {
+		if matchPattern(rule.Pattern, name) {
+			return rule.Compression
+		}
+	}
+	return NoCompression
+}
+
+// matchPattern reports whether the absolute path name matches pattern, a
+// path.Match pattern matched against the base name when it has no slash and
+// against the whole path otherwise.
+func matchPattern(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(name)
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// compHeader is the header of a compressed file.
+type compHeader struct {
+	compression Compression
+	chunkSize   int64
+	size        int64
+	index       int64
+}
+
+func (h compHeader) bytes() []byte {
+	buf := make([]byte, compHeaderSize)
+	n := copy(buf, compMagic)
+	buf[n] = compVersion
+	buf[n+1] = byte(h.compression)
+	binary.BigEndian.PutUint32(buf[n+2:], uint32(h.chunkSize))
+	binary.BigEndian.PutUint64(buf[n+6:], uint64(h.size))
+	binary.BigEndian.PutUint64(buf[n+14:], uint64(h.index))
+	return buf
+}
+
+// readCompHeader reads the header of f, reporting false if it is not a
+// compressed file.
+func readCompHeader(f io.ReaderAt, size int64) (compHeader, bool) {
+	var h compHeader
+	if size < int64(compHeaderSize) {
+		return h, false
+	}
+	buf := make([]byte, compHeaderSize)
+	if n, _ := f.ReadAt(buf, 0); n < len(buf) {
+		return h, false
+	}
+	n := len(compMagic)
+	if string(buf[:n]) != compMagic || buf[n] != compVersion || buf[n+1] == byte(NoCompression) || buf[n+1] > byte(Zstd) {
+		return h, false
+	}
+	h.compression = Compression(buf[n+1])
+	h.chunkSize = int64(binary.BigEndian.Uint32(buf[n+2:]))
+	h.size = int64(binary.BigEndian.Uint64(buf[n+6:]))
+	h.index = int64(binary.BigEndian.Uint64(buf[n+14:]))
+	if h.chunkSize == 0 || h.index < int64(compHeaderSize) || h.index > size {
+		return h, false
+	}
+	return h, true
+}
+
+// info returns fi with the uncompressed size of the named file. Sizes are
+// remembered so that listing a directory does not open every file in it.
+func (c *CompressedFs) info(name string, fi os.FileInfo) os.FileInfo {
+	if !fi.Mode().IsRegular() || fi.Size() < int64(compHeaderSize) {
+		return fi
+	}
+	key := mountPath(name)
+	c.m.Lock()
+	cached, ok := c.sizes[key]
+	c.m.Unlock()
+	if !ok || cached.size != fi.Size() || !cached.mtime.Equal(fi.ModTime()) {
+		f, err := c.fs.Open(name)
+		if err != nil {
+			return fi
+		}
+		h, compressed := readCompHeader(f, fi.Size())
+		f.Close()
+		cached = compSize{size: fi.Size(), mtime: fi.ModTime(), plain: -1}
+		if compressed {
+			cached.plain = h.size
+		}
+		c.m.Lock()
+		if len(c.sizes) >= compMaxSizes {
+			c.sizes = map[string]compSize{}
+		}
+		c.sizes[key] = cached
+		c.m.Unlock()
+	}
+	if cached.plain < 0 {
+		return fi
+	}
+	return compInfo{FileInfo: fi, size: cached.plain}
+}
+
+// forget drops the remembered sizes of name and the files below it.
+func (c *CompressedFs) forget(name string) {
+	name = mountPath(name)
+	c.m.Lock()
+	defer c.m.Unlock()
+	for key := range c.sizes {
+		if key == name || isBelow(key, name) {
+			delete(c.sizes, key)
+		}
+	}
+}
+
+// compInfo reports the uncompressed size of a file.
+type compInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi compInfo) Size() int64 {
+	return fi.size
+}
+
+// Name returns the name of this filesystem.
+func (c *CompressedFs) Name() string {
+	return "CompressedFs"
+}
+
+// Create creates or truncates the named file.
+func (c *CompressedFs) Create(name string) (afero.File, error) {
+	return c.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, defaultCreateMode)
+}
+
+// Open opens the named file for reading.
+func (c *CompressedFs) Open(name string) (afero.File, error) {
+	return c.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file. Files opened for writing are opened for
+// reading as well, as partial chunk writes need the rest of the chunk.
+func (c *CompressedFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	writing := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	backendFlag := flag
+	if writing {
+		backendFlag = backendFlag&^(os.O_WRONLY|os.O_APPEND) | os.O_RDWR
+	}
+	if writing {
+		c.forget(name)
+	}
+	f, err := c.fs.OpenFile(name, backendFlag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &compressedDir{File: f, fs: c, name: name}, nil
+	}
+
+	cf := &compressedFile{File: f, fs: c, name: name, append: flag&os.O_APPEND != 0, writable: writing, dirty: map[int64][]byte{}, cached: -1}
+	if h, ok := readCompHeader(f, fi.Size()); ok {
+		err = cf.readIndex(h, fi.Size())
+	} else if fi.Size() == 0 && writing && c.compression(name) != NoCompression {
+		err = cf.create(c.compression(name))
+	} else {
+		// stored as is, reopen with the flags asked for less those that
+		// already took effect
+		f.Close()
+		return c.fs.OpenFile(name, flag&^(os.O_CREATE|os.O_EXCL|os.O_TRUNC), perm)
+	}
+	if err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return cf, nil
+}
+
+// Mkdir creates a directory.
+func (c *CompressedFs) Mkdir(name string, perm os.FileMode) error {
+	return c.fs.Mkdir(name, perm)
+}
+
+// MkdirAll creates a directory and any missing parents.
+func (c *CompressedFs) MkdirAll(name string, perm os.FileMode) error {
+	return c.fs.MkdirAll(name, perm)
+}
+
+// Remove removes a file or empty directory.
+func (c *CompressedFs) Remove(name string) error {
+	defer c.forget(name)
+	return c.fs.Remove(name)
+}
+
+// RemoveAll removes a path and everything below it.
+func (c *CompressedFs) RemoveAll(name string) error {
+	defer c.forget(name)
+	return c.fs.RemoveAll(name)
+}
+
+// Rename moves oldname to newname, files keep the way they are stored.
+func (c *CompressedFs) Rename(oldname, newname string) error {
+	defer c.forget(newname)
+	defer c.forget(oldname)
+	return c.fs.Rename(oldname, newname)
+}
+
+// Stat returns the FileInfo of the named file with its uncompressed size.
+func (c *CompressedFs) Stat(name string) (os.FileInfo, error) {
+	fi, err := c.fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.info(name, fi), nil
+}
+
+// Chmod changes the mode of the named file.
+func (c *CompressedFs) Chmod(name string, mode os.FileMode) error {
+	return c.fs.Chmod(name, mode)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (c *CompressedFs) Chtimes(name string, atime, mtime time.Time) error {
+	return c.fs.Chtimes(name, atime, mtime)
+}
+
+// LstatIfPossible implements afero.Lstater.
+func (c *CompressedFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	fi, ok, err := lstat(c.fs, name)
+	if err != nil {
+		return nil, ok, err
+	}
+	return c.info(name, fi), ok, nil
+}
+
+// SymlinkIfPossible implements afero.Linker.
+func (c *CompressedFs) SymlinkIfPossible(oldname, newname string) error {
+	if linker, ok := c.fs.(afero.Linker); ok {
+		return linker.SymlinkIfPossible(oldname, newname)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+}
+
+// ReadlinkIfPossible implements afero.LinkReader.
+func (c *CompressedFs) ReadlinkIfPossible(name string) (string, error) {
+	if reader, ok := c.fs.(afero.LinkReader); ok {
+		return reader.ReadlinkIfPossible(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+}
+
+// compressedDir reports the uncompressed sizes of directory entries.
+type compressedDir struct {
+	afero.File
+	fs   *CompressedFs
+	name string
+}
+
+func (d *compressedDir) Readdir(count int) ([]os.FileInfo, error) {
+	list, err := d.File.Readdir(count)
+	for i, fi := range list {
+		list[i] = d.fs.info(path.Join(d.name, fi.Name()), fi)
+	}
+	return list, err
+}
+
+// frame locates a chunk in the backend file.
+type frame struct {
+	offset int64
+	length int64
+	kind   byte
+}
+
+// compressedFile decodes chunks on demand, caching the last one read, and
+// keeps modified chunks in memory until they are written out as new frames
+// at the end of the data. The index and header are updated by Sync and
+// Close, until then the file on the backend keeps its previous content.
+type compressedFile struct {
+	afero.File
+	fs       *CompressedFs
+	name     string
+	append   bool
+	writable bool
+
+	header   compHeader
+	frames   []frame
+	dataEnd  int64
+	garbage  int64
+	modified bool
+
+	dirty     map[int64][]byte
+	cached    int64
+	cacheData []byte
+
+	pos int64
+	m   sync.Mutex
+}
+
+func (f *compressedFile) create(c Compression) error {
+	f.header = compHeader{compression: c, chunkSize: compChunkSize, index: int64(compHeaderSize)}
+	f.dataEnd = int64(compHeaderSize)
+	f.modified = true
+	return f.commit()
+}
+
+func (f *compressedFile) readIndex(h compHeader, size int64) error {
+	f.header = h
+	count := (h.size + h.chunkSize - 1) / h.chunkSize
+	if h.index+count*compEntrySize != size {
+		return ErrCorruptCompressed
+	}
+	buf := make([]byte, count*compEntrySize)
+	if n, err := f.File.ReadAt(buf, h.index); n < len(buf) {
+		if err == nil || err == io.EOF {
+			err = ErrCorruptCompressed
+		}
+		return err
+	}
+	f.frames = make([]frame, count)
+	for i := range f.frames {
+		entry := buf[int64(i)*compEntrySize:]
+		f.frames[i] = frame{offset: int64(binary.BigEndian.Uint64(entry)), length: int64(binary.BigEndian.Uint32(entry[8:])), kind: entry[12]}
+	}
+	// the space left by earlier writes counts toward compacting, as does
+	// the index once replaced
+	f.dataEnd = size
+	f.garbage = size - int64(compHeaderSize)
+	for _, fr := range f.frames {
+		f.garbage -= fr.length
+	}
+	return nil
+}
+
+// chunkLength returns the plaintext length of chunk i.
+func (f *compressedFile) chunkLength(i int64) int64 {
+	length := f.header.size - i*f.header.chunkSize
+	if length > f.header.chunkSize {
+		length = f.header.chunkSize
+	}
+	return length
+}
+
+// chunk returns the current plaintext of chunk i, padded with zeros or cut
+// to its length. The result must not be modified.
+func (f *compressedFile) chunk(i int64) ([]byte, error) {
+	if data, ok := f.dirty[i]; ok {
+		return data, nil
+	}
+	length := f.chunkLength(i)
+	if i == f.cached && int64(len(f.cacheData)) == length {
+		return f.cacheData, nil
+	}
+	var data []byte
+	if i < int64(len(f.frames)) && f.frames[i].kind != frameZero {
+		fr := f.frames[i]
+		buf := make([]byte, fr.length)
+		if n, err := f.File.ReadAt(buf, fr.offset); n < len(buf) {
+			if err == nil || err == io.EOF {
+				err = ErrCorruptCompressed
+			}
+			return nil, err
+		}
+		data = buf
+		if fr.kind == frameCompressed {
+			var err error
+			if data, err = decompressChunk(f.header.compression, buf); err != nil {
+				return nil, &os.PathError{Op: "read", Path: f.name, Err: ErrCorruptCompressed}
+			}
+		}
+	}
+	if int64(len(data)) < length {
+		data = append(data, make([]byte, length-int64(len(data)))...)
+	}
+	f.cached, f.cacheData = i, data[:length]
+	return f.cacheData, nil
+}
+
+// writeFrame writes chunk i as a new frame at the end of the data, stored
+// as is when compressing does not make it smaller.
+func (f *compressedFile) writeFrame(i int64, plain []byte) error {
+	fr := frame{offset: f.dataEnd, kind: frameCompressed}
+	data, err := compressChunk(f.header.compression, plain)
+	if err != nil {
+		return err
+	}
+	if len(data) >= len(plain) {
+		data, fr.kind = plain, frameStored
+	}
+	if _, err := f.File.WriteAt(data, fr.offset); err != nil {
+		return err
+	}
+	fr.length = int64(len(data))
+	f.dataEnd += fr.length
+	for int64(len(f.frames)) <= i {
+		f.frames = append(f.frames, frame{})
+	}
+	f.garbage += f.frames[i].length
+	f.frames[i] = fr
+	return nil
+}
+
+// flush writes out the modified chunks before chunk keep, all of them when
+// keep is negative.
+func (f *compressedFile) flush(keep int64) error {
+	indexes := make([]int64, 0, len(f.dirty))
+	for i := range f.dirty {
+		if keep < 0 || i < keep {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Slice(indexes, func(a, b int) bool { return indexes[a] < indexes[b] })
+	for _, i := range indexes {
+		if err := f.writeFrame(i, f.dirty[i]); err != nil {
+			return err
+		}
+		delete(f.dirty, i)
+	}
+	return nil
+}
+
+// replace writes the new content of the file with write to a temporary
+// file in the staging directory of the backend, and renames it over the
+// file once complete, so that a crash leaves either version whole. The file
+// is used through the new handle from then on.
+func (f *compressedFile) replace(mode os.FileMode, write func(tmp afero.File) error) (err error) {
+	backend := f.fs.fs
+	if err := backend.MkdirAll(stagingDir, defaultDirectoryMode); err != nil {
+		return err
+	}
+	defer backend.Remove(stagingDir)
+	tmp, err := afero.TempFile(backend, stagingDir, "compressed-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			backend.Remove(tmp.Name())
+		}
+	}()
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := backend.Chmod(tmp.Name(), mode.Perm()); err != nil {
+		return err
+	}
+	if err := backend.Rename(tmp.Name(), f.name); err != nil {
+		return err
+	}
+	f.File.Close()
+	f.File = tmp
+	return nil
+}
+
+// compact rewrites the file without the space left by replaced frames.
+func (f *compressedFile) compact(mode os.FileMode) error {
+	frames := make([]frame, len(f.frames))
+	header := f.header
+	var index []byte
+	err := f.replace(mode, func(tmp afero.File) error {
+		end := int64(compHeaderSize)
+		for i, fr := range f.frames {
+			if fr.length > 0 {
+				buf := make([]byte, fr.length)
+				if _, err := f.File.ReadAt(buf, fr.offset); err != nil && err != io.EOF {
+					return err
+				}
+				if _, err := tmp.WriteAt(buf, end); err != nil {
+					return err
+				}
+			}
+			frames[i] = frame{offset: end, length: fr.length, kind: fr.kind}
+			end += fr.length
+		}
+		index = encodeIndex(frames)
+		if _, err := tmp.WriteAt(index, end); err != nil {
+			return err
+		}
+		header.index = end
+		_, err := tmp.WriteAt(header.bytes(), 0)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	f.frames, f.header = frames, header
+	f.dataEnd = header.index + int64(len(index))
+	f.garbage = int64(len(index))
+	f.modified = false
+	return nil
+}
+
+// framed returns the stored size of the file once committed.
+func (f *compressedFile) framed() int64 {
+	size := int64(compHeaderSize) + int64(len(f.frames))*compEntrySize
+	for _, fr := range f.frames {
+		size += fr.length
+	}
+	return size
+}
+
+// unframe rewrites the file as it is, without header, frames and index.
+// It is opened as any other stored file from then on.
+func (f *compressedFile) unframe(mode os.FileMode) error {
+	return f.replace(mode, func(tmp afero.File) error {
+		count := (f.header.size + f.header.chunkSize - 1) / f.header.chunkSize
+		for i := int64(0); i < count; i++ {
+			data, err := f.chunk(i)
+			if err != nil {
+				return err
+			}
+			if _, err := tmp.Write(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// encodeIndex returns the index of frames as stored after the data.
+func encodeIndex(frames []frame) []byte {
+	buf := make([]byte, int64(len(frames))*compEntrySize)
+	for i, fr := range frames {
+		entry := buf[i*compEntrySize:]
+		binary.BigEndian.PutUint64(entry, uint64(fr.offset))
+		binary.BigEndian.PutUint32(entry[8:], uint32(fr.length))
+		entry[12] = fr.kind
+	}
+	return buf
+}
+
+// commit writes out all changes, the index and the header.
+func (f *compressedFile) commit() error {
+	if !f.modified {
+		return nil
+	}
+	if err := f.flush(-1); err != nil {
+		return err
+	}
+	count := (f.header.size + f.header.chunkSize - 1) / f.header.chunkSize
+	for int64(len(f.frames)) > count {
+		f.garbage += f.frames[len(f.frames)-1].length
+		f.frames = f.frames[:len(f.frames)-1]
+	}
+	for int64(len(f.frames)) < count {
+		f.frames = append(f.frames, frame{})
+	}
+	defer f.fs.forget(f.name)
+	// compacting replaces the file, which would turn a symlink into a copy,
+	// and the file is written out in place as is when it fails
+	if f.garbage*2 > f.dataEnd {
+		if fi, _, err := lstat(f.fs.fs, f.name); err == nil && fi.Mode().IsRegular() && f.compact(fi.Mode()) == nil {
+			return nil
+		}
+	}
+
+	buf := encodeIndex(f.frames)
+	if _, err := f.File.WriteAt(buf, f.dataEnd); err != nil {
+		return err
+	}
+	f.header.index = f.dataEnd
+	if _, err := f.File.WriteAt(f.header.bytes(), 0); err != nil {
+		return err
+	}
+	if err := f.File.Truncate(f.dataEnd + int64(len(buf))); err != nil {
+		return err
+	}
+	// the index is live until the next commit, new frames go after it
+	f.dataEnd += int64(len(buf))
+	f.garbage += int64(len(buf))
+	f.modified = false
+	return nil
+}
+
+// modify returns a copy of chunk i to change, kept as dirty.
+func (f *compressedFile) modify(i int64) ([]byte, error) {
+	if data, ok := f.dirty[i]; ok {
+		return data, nil
+	}
+	data, err := f.chunk(i)
+	if err != nil {
+		return nil, err
+	}
+	data = append([]byte(nil), data...)
+	f.dirty[i] = data
+	if f.cached == i {
+		f.cached = -1
+	}
+	return data, nil
+}
+
+func (f *compressedFile) writeAt(p []byte, off int64) (int, error) {
+	if !f.writable {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if end := off + int64(len(p)); end > f.header.size {
+		if err := f.resize(end); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	for n < len(p) {
+		i := off / f.header.chunkSize
+		data, err := f.modify(i)
+		if err != nil {
+			return n, err
+		}
+		c := copy(data[off-i*f.header.chunkSize:], p[n:])
+		n += c
+		off += int64(c)
+	}
+	f.modified = true
+	// sequential writes leave full chunks behind
+	if len(f.dirty) > compMaxDirty {
+		return n, f.flush(-1)
+	}
+	if len(f.dirty) > 1 {
+		return n, f.flush((off - 1) / f.header.chunkSize)
+	}
+	return n, nil
+}
+
+// resize changes the plaintext size. The chunk cut or grown at the old end
+// is loaded into memory, frames past the new end are dropped and chunks
+// past the old end read as zeros until written.
+func (f *compressedFile) resize(size int64) error {
+	cs := f.header.chunkSize
+	old := f.header.size
+	f.cached = -1
+	f.modified = true
+	if size < old {
+		for i := range f.dirty {
+			if i*cs >= size {
+				delete(f.dirty, i)
+			}
+		}
+		for int64(len(f.frames))*cs > size+cs-1 {
+			f.garbage += f.frames[len(f.frames)-1].length
+			f.frames = f.frames[:len(f.frames)-1]
+		}
+		if size%cs != 0 {
+			last := size / cs
+			if _, err := f.modify(last); err != nil {
+				return err
+			}
+			f.dirty[last] = f.dirty[last][:size-last*cs]
+		}
+		f.header.size = size
+		return nil
+	}
+
+	if old%cs != 0 {
+		last := old / cs
+		data, err := f.modify(last)
+		if err != nil {
+			return err
+		}
+		length := size - last*cs
+		if length > cs {
+			length = cs
+		}
+		f.dirty[last] = append(data, make([]byte, length-int64(len(data)))...)
+	}
+	f.header.size = size
+	return nil
+}
+
+func (f *compressedFile) readAt(p []byte, off int64) (int, error) {
+	if off >= f.header.size {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && off < f.header.size {
+		i := off / f.header.chunkSize
+		data, err := f.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], data[off-i*f.header.chunkSize:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *compressedFile) Read(p []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	n, err := f.readAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *compressedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.readAt(p, off)
+}
+
+func (f *compressedFile) Write(p []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.append {
+		f.pos = f.header.size
+	}
+	n, err := f.writeAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *compressedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.writeAt(p, off)
+}
+
+func (f *compressedFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *compressedFile) Seek(offset int64, whence int) (int64, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.header.size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Truncate changes the uncompressed size of the file, growing it with zeros.
+func (f *compressedFile) Truncate(size int64) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if !f.writable {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EBADF}
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	if size == f.header.size {
+		return nil
+	}
+	return f.resize(size)
+}
+
+func (f *compressedFile) Stat() (os.FileInfo, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return compInfo{FileInfo: fi, size: f.header.size}, nil
+}
+
+func (f *compressedFile) Sync() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if err := f.commit(); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+// Close writes out the changes made through the file, storing it as it is
+// when framing does not make it smaller.
+func (f *compressedFile) Close() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	changed := f.modified
+	err := f.commit()
+	// files framing does not make smaller are stored as they are, as with
+	// compaction only when the file can be replaced
+	if err == nil && changed && f.framed() >= f.header.size {
+		if fi, _, lerr := lstat(f.fs.fs, f.name); lerr == nil && fi.Mode().IsRegular() {
+			f.unframe(fi.Mode())
+		}
+	}
+	if cerr := f.File.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
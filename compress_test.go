@@ -0,0 +1,231 @@
+package afero
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestCompressedRoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 5000)
+	for _, c := range []Compression{Gzip, Zstd} {
+		backend := afero.NewMemMapFs()
+		fs := NewCompressed(backend, "/", false, CompressionRule{Pattern: "*.txt", Compression: c})
+
+		f, err := fs.Create("/dir/file.txt")
+		if err != nil {
+			t.Error("Error creating file: ", err)
+			return
+		}
+		for i := 0; i < len(text); i += 1000 {
+			f.Write(text[i : i+1000])
+		}
+		if err := f.Close(); err != nil {
+			t.Error("Error closing file: ", err)
+			return
+		}
+
+		raw, _ := backend.Stat("/dir/file.txt")
+		if raw.Size() >= int64(len(text))/10 {
+			t.Error("File was not compressed: ", c, raw.Size())
+		}
+		if fi, err := fs.Stat("/dir/file.txt"); err != nil || fi.Size() != int64(len(text)) {
+			t.Error("Stat did not report the logical size: ", fi.Size(), err)
+		}
+		if list, err := fs.ReadDir("/dir"); err != nil || len(list) != 1 || list[0].Size() != int64(len(text)) {
+			t.Error("ReadDir did not report the logical size: ", list, err)
+		}
+
+		f, err = fs.Open("/dir/file.txt")
+		if err != nil {
+			t.Error("Error opening file: ", err)
+			return
+		}
+		data, err := ioutil.ReadAll(f)
+		if err != nil || !bytes.Equal(data, text) {
+			t.Error("Read content differs: ", c, err)
+		}
+		p := make([]byte, 100)
+		if _, err := f.ReadAt(p, 150000); err != nil || !bytes.Equal(p, text[150000:150100]) {
+			t.Error("ReadAt content differs: ", err)
+		}
+		f.Close()
+	}
+}
+
+func TestCompressedFallback(t *testing.T) {
+	backend := afero.NewMemMapFs()
+	fs := NewCompressed(backend, "/", false, CompressionRule{Pattern: "/vendor/*", Compression: NoCompression}, CompressionRule{Pattern: "*", Compression: Zstd})
+
+	noise := make([]byte, 3*compChunkSize)
+	rand.New(rand.NewSource(1)).Read(noise)
+	f, _ := fs.Create("/noise")
+	f.Write(noise)
+	f.Close()
+	// incompressible files are stored as they are, without framing
+	if data, _ := afero.ReadFile(backend, "/noise"); !bytes.Equal(data, noise) {
+		t.Error("Incompressible file was framed: ", len(data))
+	}
+	f, _ = fs.Create("/small")
+	f.Write([]byte("small"))
+	f.Close()
+	for i := 0; i < 3; i++ {
+		f, _ = fs.OpenFile("/small", os.O_RDWR, 0)
+		f.Write([]byte("SMALL"))
+		f.Close()
+	}
+	if data, _ := afero.ReadFile(backend, "/small"); string(data) != "SMALL" {
+		t.Error("Small file was framed: ", data)
+	}
+
+	// a file that compresses in part keeps its stored frames
+	f, _ = fs.Create("/mixed")
+	f.Write(noise[:compChunkSize])
+	f.Write(bytes.Repeat([]byte("x"), 2*compChunkSize))
+	f.Close()
+	raw, _ := backend.Stat("/mixed")
+	if raw.Size() >= int64(2*compChunkSize) {
+		t.Error("Unexpected stored size: ", raw.Size())
+	}
+	if data, err := afero.ReadFile(NewCompressedFs(backend), "/noise"); err != nil || !bytes.Equal(data, noise) {
+		t.Error("Stored content differs: ", err)
+	}
+
+	// excluded files are stored as they are
+	f, _ = fs.Create("/vendor/file")
+	f.Write([]byte("plain"))
+	f.Close()
+	if data, _ := afero.ReadFile(backend, "/vendor/file"); string(data) != "plain" {
+		t.Error("Excluded file was changed: ", string(data))
+	}
+}
+
+func TestCompressedRandomAccess(t *testing.T) {
+	backend := afero.NewMemMapFs()
+	fs := NewCompressedFs(backend, CompressionRule{Pattern: "*", Compression: Gzip})
+
+	expect := bytes.Repeat([]byte("0123456789"), compChunkSize/5)
+	afero.WriteFile(fs, "/file", expect, 0644)
+
+	f, err := fs.OpenFile("/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Error("Error opening file: ", err)
+		return
+	}
+	f.WriteAt([]byte("XXXX"), compChunkSize-2)
+	copy(expect[compChunkSize-2:], "XXXX")
+	f.Seek(-5, io.SeekEnd)
+	f.Write([]byte("tail-grown"))
+	expect = append(expect[:len(expect)-5], "tail-grown"...)
+	if err := f.Truncate(int64(len(expect) + 10)); err != nil {
+		t.Error("Error growing file: ", err)
+	}
+	expect = append(expect, make([]byte, 10)...)
+	if err := f.Close(); err != nil {
+		t.Error("Error closing file: ", err)
+		return
+	}
+
+	data, err := afero.ReadFile(fs, "/file")
+	if err != nil || !bytes.Equal(data, expect) {
+		t.Error("Content differs after random writes: ", err)
+	}
+
+	f, _ = fs.OpenFile("/file", os.O_RDWR, 0)
+	f.Truncate(compChunkSize + 3)
+	f.Truncate(compChunkSize + 20)
+	f.Close()
+	expect = append(expect[:compChunkSize+3], make([]byte, 17)...)
+	if data, err := afero.ReadFile(fs, "/file"); err != nil || !bytes.Equal(data, expect) {
+		t.Error("Content differs after truncates: ", err)
+	}
+
+	// rewriting chunks leaves garbage behind that gets compacted
+	for i := 0; i < 10; i++ {
+		f, _ = fs.OpenFile("/file", os.O_RDWR, 0)
+		f.WriteAt([]byte("rewrite"), 0)
+		f.Close()
+	}
+	copy(expect, "rewrite")
+	if data, err := afero.ReadFile(fs, "/file"); err != nil || !bytes.Equal(data, expect) {
+		t.Error("Content differs after rewrites: ", err)
+	}
+	if raw, _ := backend.Stat("/file"); raw.Size() > int64(len(expect)) {
+		t.Error("Garbage was not compacted: ", raw.Size())
+	}
+}
+
+func TestCompressedCompactReplace(t *testing.T) {
+	for _, failing := range []bool{false, true} {
+		mem := afero.NewMemMapFs()
+		var backend afero.Fs = mem
+		if failing {
+			// the file is written out in place when it can't be replaced
+			backend = exdevFs{mem}
+		}
+		fs := NewCompressedFs(backend, CompressionRule{Pattern: "*", Compression: Gzip})
+		expect := bytes.Repeat([]byte("0123456789"), compChunkSize/5)
+		afero.WriteFile(fs, "/dir/file", expect, 0640)
+		raw, _ := mem.Stat("/dir/file")
+		written := raw.Size()
+
+		for i := 0; i < 10; i++ {
+			f, _ := fs.OpenFile("/dir/file", os.O_RDWR, 0)
+			f.WriteAt([]byte("rewrite"), int64(i))
+			if err := f.Close(); err != nil {
+				t.Error("Error closing file: ", err)
+				return
+			}
+			copy(expect[i:], "rewrite")
+		}
+		if data, err := afero.ReadFile(fs, "/dir/file"); err != nil || !bytes.Equal(data, expect) {
+			t.Error("Content differs after rewrites: ", failing, err)
+		}
+		list, err := afero.ReadDir(mem, "/dir")
+		if err != nil || len(list) != 1 || list[0].Mode().Perm() != 0640 {
+			t.Error("Unexpected files after compacting: ", failing, list, err)
+		}
+		if _, err := mem.Stat(stagingDir); !os.IsNotExist(err) {
+			t.Error("Staging directory was left behind: ", failing, err)
+		}
+		if compacted := list[0].Size() < 2*written; compacted == failing {
+			t.Error("Unexpected compaction: ", failing, written, list[0].Size())
+		}
+	}
+}
+
+func TestCompressedSizes(t *testing.T) {
+	backend := afero.NewMemMapFs()
+	fs := NewCompressedFs(backend, CompressionRule{Pattern: "*.txt", Compression: Zstd})
+	text := bytes.Repeat([]byte("text"), 1000)
+	afero.WriteFile(fs, "/dir/a.txt", text, 0644)
+	afero.WriteFile(fs, "/dir/b.bin", text, 0644)
+
+	if list, err := afero.ReadDir(fs, "/dir"); err != nil || len(list) != 2 || list[0].Size() != 4000 || list[1].Size() != 4000 {
+		t.Error("Unexpected sizes: ", list, err)
+	}
+	if len(fs.sizes) != 2 {
+		t.Error("Sizes were not remembered: ", fs.sizes)
+	}
+
+	// remembered sizes follow changes made through the filesystem or not
+	f, _ := fs.OpenFile("/dir/a.txt", os.O_RDWR, 0)
+	f.Truncate(10)
+	f.Close()
+	if fi, err := fs.Stat("/dir/a.txt"); err != nil || fi.Size() != 10 {
+		t.Error("Stale size after truncate: ", fi.Size(), err)
+	}
+	fs.Rename("/dir/a.txt", "/dir/b.bin")
+	if fi, err := fs.Stat("/dir/b.bin"); err != nil || fi.Size() != 10 {
+		t.Error("Stale size after rename: ", fi.Size(), err)
+	}
+	afero.WriteFile(backend, "/dir/b.bin", text[:100], 0644)
+	if fi, err := fs.Stat("/dir/b.bin"); err != nil || fi.Size() != 100 {
+		t.Error("Stale size after a change on the backend: ", fi.Size(), err)
+	}
+}
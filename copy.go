@@ -0,0 +1,104 @@
+package afero
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// copyTree recursively copies src:from to dst:to, preserving modes, symlinks
+// and modification times.
+func copyTree(src afero.Fs, from string, dst afero.Fs, to string) error {
+	fi, _, err := lstat(src, from)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		return copySymlink(src, from, dst, to)
+	case !fi.IsDir():
+		return copyFile(src, from, dst, to, fi)
+	}
+
+	if err := dst.MkdirAll(to, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	entries, err := afero.ReadDir(src, from)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := copyTree(src, filepath.Join(from, entry.Name()), dst, filepath.Join(to, entry.Name())); err != nil {
+			return err
+		}
+	}
+	// set after the children, creating them touches the directory
+	if err := dst.Chmod(to, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return dst.Chtimes(to, fi.ModTime(), fi.ModTime())
+}
+
+// copyFile copies the regular file src:from to dst:to, where fi describes
+// the source.
+func copyFile(src afero.Fs, from string, dst afero.Fs, to string, fi os.FileInfo) error {
+	in, err := src.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := dst.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// the create mode is subject to umask
+	if err := dst.Chmod(to, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return dst.Chtimes(to, fi.ModTime(), fi.ModTime())
+}
+
+// copySymlink recreates the symlink src:from as dst:to.
+func copySymlink(src afero.Fs, from string, dst afero.Fs, to string) error {
+	target, err := readlink(src, from)
+	if err != nil {
+		return err
+	}
+	linker, ok := dst.(afero.Linker)
+	if !ok {
+		return &os.LinkError{Op: "symlink", Old: target, New: to, Err: afero.ErrNoSymlink}
+	}
+	return linker.SymlinkIfPossible(target, to)
+}
+
+// readlink returns the target of the symlink name as it would be passed to
+// SymlinkIfPossible on fs.
+func readlink(fs afero.Fs, name string) (string, error) {
+	reader, ok := fs.(afero.LinkReader)
+	if !ok {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+	}
+	target, err := reader.ReadlinkIfPossible(name)
+	if err != nil {
+		return "", err
+	}
+	// BasePathFs reads targets as real paths, but adds its base to them
+	if base, ok := fs.(interface{ RealPath(string) (string, error) }); ok {
+		if root, err := base.RealPath("/"); err == nil && isBelow(target, root) {
+			target = "/" + strings.TrimPrefix(target[len(root):], "/")
+		}
+	}
+	return target, nil
+}
@@ -0,0 +1,195 @@
+package afero
+
+import (
+	"os"
+	"path"
+	"sort"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// DiffKind is the kind of a difference between two trees.
+type DiffKind string
+
+const (
+	// DiffAdded entries only exist in the second tree.
+	DiffAdded DiffKind = "added"
+	// DiffRemoved entries only exist in the first tree.
+	DiffRemoved DiffKind = "removed"
+	// DiffModified files differ in content, or symlinks in target.
+	DiffModified DiffKind = "modified"
+	// DiffTypeChanged entries are of different types, such as a file
+	// replaced by a directory.
+	DiffTypeChanged DiffKind = "type-changed"
+	// DiffModeChanged entries differ in permissions.
+	DiffModeChanged DiffKind = "mode-changed"
+)
+
+// DiffOptions configures Diff.
+type DiffOptions struct {
+	// Content compares files by sha256 instead of size and modification
+	// time.
+	Content bool
+	// Symlinks compares the targets of symlinks.
+	Symlinks bool
+	// Ignore holds patterns, matched as by CompressionRule, of the entries
+	// to leave out. Ignored directories are skipped whole.
+	Ignore []string
+}
+
+// DiffEntry is a difference between two trees. A and B describe the entry
+// in each tree, nil where it does not exist.
+type DiffEntry struct {
+	Path string
+	Kind DiffKind
+	A, B os.FileInfo
+}
+
+// Diff lists the differences from tree a to tree b, sorted by path. The
+// entries below added or removed directories are listed too. An entry both
+// modified and with a changed mode is listed for each.
+func Diff(a, b billy.Filesystem, opts DiffOptions) ([]DiffEntry, error) {
+	d := &differ{a: a, b: b, opts: opts}
+	err := d.dir("/", true, true)
+	return d.entries, err
+}
+
+type differ struct {
+	a, b    billy.Filesystem
+	opts    DiffOptions
+	entries []DiffEntry
+}
+
+// list returns the names in the directory name of fs, nil unless it is a
+// directory there.
+func (d *differ) list(fs billy.Filesystem, name string, isDir bool) ([]string, error) {
+	if !isDir {
+		return nil, nil
+	}
+	list, err := fs.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(list))
+	for _, fi := range list {
+		if p := path.Join(name, fi.Name()); !d.ignored(p) {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d *differ) ignored(name string) bool {
+	for _, pattern := range d.opts.Ignore {
+		if matchPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// dir compares the content of the directory name in the trees where it is
+// one.
+func (d *differ) dir(name string, inA, inB bool) error {
+	an, err := d.list(d.a, name, inA)
+	if err != nil {
+		return err
+	}
+	bn, err := d.list(d.b, name, inB)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, n := range append(an, bn...) {
+		seen[n] = true
+	}
+	names := make([]string, 0, len(seen))
+	for n := range seen {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if err := d.entry(path.Join(name, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *differ) stat(fs billy.Filesystem, name string) (os.FileInfo, error) {
+	fi, err := fs.Lstat(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return fi, err
+}
+
+func (d *differ) add(name string, kind DiffKind, a, b os.FileInfo) {
+	d.entries = append(d.entries, DiffEntry{Path: name, Kind: kind, A: a, B: b})
+}
+
+func (d *differ) entry(name string) error {
+	a, err := d.stat(d.a, name)
+	if err != nil {
+		return err
+	}
+	b, err := d.stat(d.b, name)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case a == nil:
+		d.add(name, DiffAdded, nil, b)
+	case b == nil:
+		d.add(name, DiffRemoved, a, nil)
+	case a.Mode()&os.ModeType != b.Mode()&os.ModeType:
+		d.add(name, DiffTypeChanged, a, b)
+	default:
+		modified, err := d.modified(name, a, b)
+		if err != nil {
+			return err
+		}
+		if modified {
+			d.add(name, DiffModified, a, b)
+		}
+		if a.Mode().Perm() != b.Mode().Perm() && a.Mode()&os.ModeSymlink == 0 {
+			d.add(name, DiffModeChanged, a, b)
+		}
+	}
+
+	// directories replaced by files list their content as added or removed
+	inA, inB := a != nil && a.IsDir(), b != nil && b.IsDir()
+	if inA || inB {
+		return d.dir(name, inA, inB)
+	}
+	return nil
+}
+
+// modified compares entries of the same type.
+func (d *differ) modified(name string, a, b os.FileInfo) (bool, error) {
+	switch {
+	case a.Mode()&os.ModeSymlink != 0:
+		if !d.opts.Symlinks {
+			return false, nil
+		}
+		at, err := d.a.Readlink(name)
+		if err != nil {
+			return false, err
+		}
+		bt, err := d.b.Readlink(name)
+		return at != bt, err
+	case !a.Mode().IsRegular():
+		return false, nil
+	case a.Size() != b.Size():
+		return true, nil
+	case !d.opts.Content:
+		return !a.ModTime().Equal(b.ModTime()), nil
+	}
+	ah, err := hashFile(d.a, name)
+	if err != nil {
+		return false, err
+	}
+	bh, err := hashFile(d.b, name)
+	return ah != bh, err
+}
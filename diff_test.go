@@ -0,0 +1,81 @@
+package afero
+
+import (
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/spf13/afero"
+)
+
+func TestDiff(t *testing.T) {
+	a := New(afero.NewMemMapFs(), "/", false)
+	b := New(afero.NewMemMapFs(), "/", false)
+	for _, fs := range []billy.Filesystem{a, b} {
+		util.WriteFile(fs, "/same", []byte("same"), 0644)
+		util.WriteFile(fs, "/build/out.o", []byte("object"), 0644)
+	}
+	util.WriteFile(a, "/changed", []byte("before"), 0644)
+	util.WriteFile(b, "/changed", []byte("after!"), 0644)
+	util.WriteFile(a, "/script", []byte("run"), 0644)
+	util.WriteFile(b, "/script", []byte("run"), 0755)
+	util.WriteFile(a, "/gone/file", []byte("gone"), 0644)
+	util.WriteFile(b, "/new", []byte("new"), 0644)
+	util.WriteFile(a, "/kind", []byte("file"), 0644)
+	util.WriteFile(b, "/kind/child", []byte("child"), 0644)
+	util.WriteFile(b, "/build/other.o", []byte("object"), 0644)
+
+	diff, err := Diff(a, b, DiffOptions{Content: true, Ignore: []string{"*.o"}})
+	if err != nil {
+		t.Error("Error comparing trees: ", err)
+		return
+	}
+	expect := []struct {
+		path string
+		kind DiffKind
+	}{
+		{"/changed", DiffModified},
+		{"/gone", DiffRemoved},
+		{"/gone/file", DiffRemoved},
+		{"/kind", DiffTypeChanged},
+		{"/kind/child", DiffAdded},
+		{"/new", DiffAdded},
+		{"/script", DiffModeChanged},
+	}
+	if len(diff) != len(expect) {
+		t.Error("Unexpected differences: ", diff)
+		return
+	}
+	for i, e := range diff {
+		if e.Path != expect[i].path || e.Kind != expect[i].kind {
+			t.Error("Unexpected difference: ", e.Path, " ", e.Kind, ", expected: ", expect[i])
+		}
+	}
+	if diff[0].A == nil || diff[0].B == nil || diff[1].B != nil || diff[5].A != nil {
+		t.Error("Unexpected file infos: ", diff)
+	}
+
+	if _, err := Sync(b, a, SyncOptions{Delete: true}); err != nil {
+		t.Error("Error syncing trees: ", err)
+		return
+	}
+	if diff, err := Diff(a, b, DiffOptions{}); err != nil || len(diff) != 0 {
+		t.Error("Trees differ after sync: ", diff, err)
+	}
+}
+
+func TestDiffSymlinks(t *testing.T) {
+	a := testExportTree(t)
+	b := testExportTree(t)
+	b.Remove("/run")
+	b.Symlink("b.txt", "/run")
+
+	diff, err := Diff(a, b, DiffOptions{Content: true})
+	if err != nil || len(diff) != 0 {
+		t.Error("Symlink targets were compared: ", diff, err)
+	}
+	diff, err = Diff(a, b, DiffOptions{Content: true, Symlinks: true})
+	if err != nil || len(diff) != 1 || diff[0].Path != "/run" || diff[0].Kind != DiffModified {
+		t.Error("Unexpected symlink differences: ", diff, err)
+	}
+}
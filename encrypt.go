@@ -0,0 +1,572 @@
+package afero
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// Encrypted files start with a fixed size header, followed by chunks of up
+// to encChunkSize plaintext bytes each sealed with AES-GCM under a fresh
+// nonce. The chunk index, whether it is the last one and the file id are
+// authenticated with each chunk, so chunks cannot be reordered, moved
+// between files or dropped from the end unnoticed.
+const (
+	encMagic      = "BAEC"
+	encVersion    = 1
+	encIDSize     = 16
+	encMaxKeyID   = 32
+	encHeaderSize = len(encMagic) + 1 + encIDSize + 1 + encMaxKeyID
+	encNonceSize  = 12
+	encTagSize    = 16
+	encOverhead   = encNonceSize + encTagSize
+	encChunkSize  = 64 * 1024
+)
+
+var (
+	// ErrNotEncrypted is returned opening a file of an EncryptedFs that is
+	// not empty and has no valid header.
+	ErrNotEncrypted = errors.New("File is not encrypted")
+	// ErrDecryption is returned reading a chunk that fails authentication.
+	ErrDecryption = errors.New("Encrypted data failed authentication")
+)
+
+// KeyProvider supplies the keys of an EncryptedFs, 16, 24 or 32 bytes long
+// for AES-128, AES-192 or AES-256. Files record the id of the key they were
+// created with, so keys can be rotated while older files stay readable.
+type KeyProvider interface {
+	// CurrentKey returns the key new files are encrypted with and its id, at
+	// most 32 bytes long.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given id.
+	Key(id string) ([]byte, error)
+}
+
+type staticKey []byte
+
+// StaticKey returns a KeyProvider of a single key.
+func StaticKey(key []byte) KeyProvider {
+	return staticKey(key)
+}
+
+func (k staticKey) CurrentKey() (string, []byte, error) {
+	return "", k, nil
+}
+
+func (k staticKey) Key(id string) ([]byte, error) {
+	if id != "" {
+		return nil, errors.New("Unknown key " + id)
+	}
+	return k, nil
+}
+
+// EncryptedFs is an afero.Fs encrypting the content of the files of another
+// filesystem. Sizes are reported in plaintext bytes, names, directories and
+// symlink targets are stored as they are.
+type EncryptedFs struct {
+	fs   afero.Fs
+	keys KeyProvider
+}
+
+// NewEncryptedFs returns an EncryptedFs over fs using keys.
+func NewEncryptedFs(fs afero.Fs, keys KeyProvider) *EncryptedFs {
+	return &EncryptedFs{fs: fs, keys: keys}
+}
+
+// NewEncrypted returns a billy filesystem over an EncryptedFs.
+func NewEncrypted(fs afero.Fs, keys KeyProvider, root string, debug bool) billy.Filesystem {
+	return New(NewEncryptedFs(fs, keys), root, debug)
+}
+
+// encPlainSize returns the plaintext size of an encrypted file of size
+// bytes.
+func encPlainSize(size int64) int64 {
+	if size <= int64(encHeaderSize) {
+		return 0
+	}
+	data := size - int64(encHeaderSize)
+	full := data / (encChunkSize + encOverhead)
+	size = full * encChunkSize
+	if rem := data % (encChunkSize + encOverhead); rem > encOverhead {
+		size += rem - encOverhead
+	}
+	return size
+}
+
+// encInfo reports the plaintext size of a regular file.
+type encInfo struct {
+	os.FileInfo
+}
+
+func (fi encInfo) Size() int64 {
+	if !fi.FileInfo.Mode().IsRegular() {
+		return fi.FileInfo.Size()
+	}
+	return encPlainSize(fi.FileInfo.Size())
+}
+
+// Name returns the name of this filesystem.
+func (e *EncryptedFs) Name() string {
+	return "EncryptedFs"
+}
+
+// Create creates or truncates the named file.
+func (e *EncryptedFs) Create(name string) (afero.File, error) {
+	return e.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, defaultCreateMode)
+}
+
+// Open opens the named file for reading.
+func (e *EncryptedFs) Open(name string) (afero.File, error) {
+	return e.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file, reading its header or writing one if it
+// is empty. Files opened for writing are opened for reading as well, as
+// partial chunk writes need the rest of the chunk.
+func (e *EncryptedFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	writing := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	backendFlag := flag &^ os.O_APPEND
+	if writing {
+		backendFlag = backendFlag&^os.O_WRONLY | os.O_RDWR
+	}
+	f, err := e.fs.OpenFile(name, backendFlag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &encryptedDir{File: f}, nil
+	}
+
+	ef := &encryptedFile{File: f, name: name, append: flag&os.O_APPEND != 0, writable: writing}
+	if fi.Size() == 0 {
+		if writing {
+			err = ef.writeHeader(e.keys)
+		}
+	} else {
+		err = ef.readHeader(e.keys, fi.Size())
+	}
+	if err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return ef, nil
+}
+
+// Mkdir creates a directory.
+func (e *EncryptedFs) Mkdir(name string, perm os.FileMode) error {
+	return e.fs.Mkdir(name, perm)
+}
+
+// MkdirAll creates a directory and any missing parents.
+func (e *EncryptedFs) MkdirAll(name string, perm os.FileMode) error {
+	return e.fs.MkdirAll(name, perm)
+}
+
+// Remove removes a file or empty directory.
+func (e *EncryptedFs) Remove(name string) error {
+	return e.fs.Remove(name)
+}
+
+// RemoveAll removes a path and everything below it.
+func (e *EncryptedFs) RemoveAll(name string) error {
+	return e.fs.RemoveAll(name)
+}
+
+// Rename moves oldname to newname, files keep their content and key.
+func (e *EncryptedFs) Rename(oldname, newname string) error {
+	return e.fs.Rename(oldname, newname)
+}
+
+// Stat returns the FileInfo of the named file with its plaintext size.
+func (e *EncryptedFs) Stat(name string) (os.FileInfo, error) {
+	fi, err := e.fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return encInfo{fi}, nil
+}
+
+// Chmod changes the mode of the named file.
+func (e *EncryptedFs) Chmod(name string, mode os.FileMode) error {
+	return e.fs.Chmod(name, mode)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (e *EncryptedFs) Chtimes(name string, atime, mtime time.Time) error {
+	return e.fs.Chtimes(name, atime, mtime)
+}
+
+// LstatIfPossible implements afero.Lstater.
+func (e *EncryptedFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	fi, ok, err := lstat(e.fs, name)
+	if err != nil {
+		return nil, ok, err
+	}
+	return encInfo{fi}, ok, nil
+}
+
+// SymlinkIfPossible implements afero.Linker.
+func (e *EncryptedFs) SymlinkIfPossible(oldname, newname string) error {
+	if linker, ok := e.fs.(afero.Linker); ok {
+		return linker.SymlinkIfPossible(oldname, newname)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+}
+
+// ReadlinkIfPossible implements afero.LinkReader.
+func (e *EncryptedFs) ReadlinkIfPossible(name string) (string, error) {
+	if reader, ok := e.fs.(afero.LinkReader); ok {
+		return reader.ReadlinkIfPossible(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+}
+
+// encryptedDir reports the plaintext sizes of directory entries.
+type encryptedDir struct {
+	afero.File
+}
+
+func (d *encryptedDir) Readdir(count int) ([]os.FileInfo, error) {
+	list, err := d.File.Readdir(count)
+	for i := range list {
+		list[i] = encInfo{list[i]}
+	}
+	return list, err
+}
+
+func (d *encryptedDir) Stat() (os.FileInfo, error) {
+	fi, err := d.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return encInfo{fi}, nil
+}
+
+// encryptedFile reads and writes whole chunks of the backend file, keeping
+// its own plaintext position and size.
+type encryptedFile struct {
+	afero.File
+	name     string
+	append   bool
+	writable bool
+	aead     cipher.AEAD
+	id       []byte
+	pos      int64
+	size     int64
+	m        sync.Mutex
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (f *encryptedFile) writeHeader(keys KeyProvider) error {
+	keyID, key, err := keys.CurrentKey()
+	if err != nil {
+		return err
+	}
+	if len(keyID) > encMaxKeyID {
+		return errors.New("Key id " + keyID + " is too long")
+	}
+	if f.aead, err = newAEAD(key); err != nil {
+		return err
+	}
+	f.id = make([]byte, encIDSize)
+	if _, err := io.ReadFull(rand.Reader, f.id); err != nil {
+		return err
+	}
+
+	header := make([]byte, encHeaderSize)
+	n := copy(header, encMagic)
+	header[n] = encVersion
+	n += 1 + copy(header[n+1:], f.id)
+	header[n] = byte(len(keyID))
+	copy(header[n+1:], keyID)
+	_, err = f.File.WriteAt(header, 0)
+	return err
+}
+
+func (f *encryptedFile) readHeader(keys KeyProvider, size int64) error {
+	header := make([]byte, encHeaderSize)
+	if n, err := f.File.ReadAt(header, 0); n < len(header) {
+		if err == nil || err == io.EOF {
+			err = ErrNotEncrypted
+		}
+		return err
+	}
+	n := len(encMagic)
+	if !bytes.Equal(header[:n], []byte(encMagic)) || header[n] != encVersion || int(header[n+1+encIDSize]) > encMaxKeyID {
+		return ErrNotEncrypted
+	}
+	f.id = header[n+1 : n+1+encIDSize]
+	n += 1 + encIDSize
+	key, err := keys.Key(string(header[n+1 : n+1+int(header[n])]))
+	if err != nil {
+		return err
+	}
+	if f.aead, err = newAEAD(key); err != nil {
+		return err
+	}
+	f.size = encPlainSize(size)
+	return nil
+}
+
+// chunkOffset returns the backend offset of chunk i.
+func chunkOffset(i int64) int64 {
+	return int64(encHeaderSize) + i*(encChunkSize+encOverhead)
+}
+
+// lastChunk returns the index of the last chunk of a file of size bytes,
+// -1 when it is empty.
+func lastChunk(size int64) int64 {
+	return (size+encChunkSize-1)/encChunkSize - 1
+}
+
+func (f *encryptedFile) additionalData(i int64, last bool) []byte {
+	ad := make([]byte, encIDSize+9)
+	copy(ad, f.id)
+	binary.BigEndian.PutUint64(ad[encIDSize:], uint64(i))
+	if last {
+		ad[encIDSize+8] = 1
+	}
+	return ad
+}
+
+// readChunk returns the plaintext of chunk i of the current content.
+func (f *encryptedFile) readChunk(i int64) ([]byte, error) {
+	length := f.size - i*encChunkSize
+	if length > encChunkSize {
+		length = encChunkSize
+	}
+	buf := make([]byte, encOverhead+length)
+	if n, err := f.File.ReadAt(buf, chunkOffset(i)); n < len(buf) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	plain, err := f.aead.Open(buf[encNonceSize:encNonceSize], buf[:encNonceSize], buf[encNonceSize:], f.additionalData(i, i == lastChunk(f.size)))
+	if err != nil {
+		return nil, &os.PathError{Op: "read", Path: f.name, Err: ErrDecryption}
+	}
+	return plain, nil
+}
+
+// writeChunk seals plain as chunk i under a fresh nonce.
+func (f *encryptedFile) writeChunk(i int64, plain []byte, last bool) error {
+	buf := make([]byte, encNonceSize, encOverhead+len(plain))
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return err
+	}
+	buf = f.aead.Seal(buf, buf[:encNonceSize], plain, f.additionalData(i, last))
+	_, err := f.File.WriteAt(buf, chunkOffset(i))
+	return err
+}
+
+// resize rewrites the chunks from lo to the new last chunk for a file of
+// size bytes, copying p in at off. Chunks past the old end are zero filled.
+func (f *encryptedFile) resize(lo int64, p []byte, off, size int64) error {
+	oldLast, newLast := lastChunk(f.size), lastChunk(size)
+	hi := newLast
+	if len(p) > 0 && (off+int64(len(p))-1)/encChunkSize < hi {
+		hi = (off + int64(len(p)) - 1) / encChunkSize
+	}
+	for i := lo; i <= hi; i++ {
+		var plain []byte
+		if i <= oldLast {
+			var err error
+			if plain, err = f.readChunk(i); err != nil {
+				return err
+			}
+		}
+		length := size - i*encChunkSize
+		if length > encChunkSize {
+			length = encChunkSize
+		}
+		if int64(len(plain)) < length {
+			plain = append(plain, make([]byte, length-int64(len(plain)))...)
+		}
+		plain = plain[:length]
+		if start := i * encChunkSize; off < start+length && off+int64(len(p)) > start {
+			from := off - start
+			src := p
+			if from < 0 {
+				src, from = p[-from:], 0
+			}
+			copy(plain[from:], src)
+		}
+		if err := f.writeChunk(i, plain, i == newLast); err != nil {
+			return err
+		}
+	}
+	f.size = size
+	return nil
+}
+
+func (f *encryptedFile) writeAt(p []byte, off int64) (int, error) {
+	if !f.writable {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	end := off + int64(len(p))
+	size := f.size
+	if end > size {
+		size = end
+	}
+	// growing rewrites the old last chunk and fills any gap after it
+	lo := off / encChunkSize
+	if oldLast := lastChunk(f.size); size > f.size && oldLast < lo {
+		lo = oldLast
+		if lo < 0 {
+			lo = 0
+		}
+	}
+	if err := f.resize(lo, p, off, size); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *encryptedFile) readAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && off < f.size {
+		i := off / encChunkSize
+		plain, err := f.readChunk(i)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], plain[off-i*encChunkSize:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *encryptedFile) Read(p []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	n, err := f.readAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *encryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.readAt(p, off)
+}
+
+func (f *encryptedFile) Write(p []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.append {
+		f.pos = f.size
+	}
+	n, err := f.writeAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *encryptedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.writeAt(p, off)
+}
+
+func (f *encryptedFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *encryptedFile) Seek(offset int64, whence int) (int64, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Truncate changes the plaintext size of the file, growing it with zeros.
+func (f *encryptedFile) Truncate(size int64) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if !f.writable {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EBADF}
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	if size > f.size {
+		lo := lastChunk(f.size)
+		if lo < 0 {
+			lo = 0
+		}
+		return f.resize(lo, nil, 0, size)
+	}
+	if size == f.size {
+		return nil
+	}
+
+	last := lastChunk(size)
+	if last >= 0 {
+		plain, err := f.readChunk(last)
+		if err != nil {
+			return err
+		}
+		plain = plain[:size-last*encChunkSize]
+		if err := f.writeChunk(last, plain, true); err != nil {
+			return err
+		}
+	}
+	if err := f.File.Truncate(chunkOffset(last) + encOverhead + size - last*encChunkSize); err != nil {
+		return err
+	}
+	f.size = size
+	return nil
+}
+
+func (f *encryptedFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return encInfo{fi}, nil
+}
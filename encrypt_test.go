@@ -0,0 +1,217 @@
+package afero
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, 32)
+
+// rotatingKeys is a KeyProvider whose current key can be changed.
+type rotatingKeys struct {
+	current string
+	keys    map[string][]byte
+}
+
+func (k *rotatingKeys) CurrentKey() (string, []byte, error) {
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *rotatingKeys) Key(id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, errors.New("Unknown key " + id)
+	}
+	return key, nil
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	backend := afero.NewMemMapFs()
+	fs := NewEncrypted(backend, StaticKey(testKey), "/", false)
+
+	data := make([]byte, 2*encChunkSize+1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	copy(data, "secret content")
+	f, err := fs.Create("/file")
+	if err != nil {
+		t.Error("Error creating file: ", err)
+		return
+	}
+	// small writes exercise partial chunk rewrites
+	for i := 0; i < len(data); i += 10000 {
+		end := i + 10000
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := f.Write(data[i:end]); err != nil {
+			t.Error("Error writing file: ", err)
+			return
+		}
+	}
+	f.Close()
+
+	raw, _ := afero.ReadFile(backend, "/file")
+	if bytes.Contains(raw, []byte("secret content")) {
+		t.Error("Plaintext found in the backend file")
+	}
+	if fi, err := fs.Stat("/file"); err != nil || fi.Size() != int64(len(data)) {
+		t.Error("Stat did not report the plaintext size: ", fi.Size(), err)
+	}
+	if list, err := fs.ReadDir("/"); err != nil || len(list) != 1 || list[0].Size() != int64(len(data)) {
+		t.Error("ReadDir did not report the plaintext size: ", list, err)
+	}
+
+	f, err = fs.Open("/file")
+	if err != nil {
+		t.Error("Error opening file: ", err)
+		return
+	}
+	defer f.Close()
+	read, err := ioutil.ReadAll(f)
+	if err != nil || !bytes.Equal(read, data) {
+		t.Error("Read content differs: ", err)
+	}
+	p := make([]byte, 100)
+	if _, err := f.ReadAt(p, encChunkSize-50); err != nil || !bytes.Equal(p, data[encChunkSize-50:encChunkSize+50]) {
+		t.Error("ReadAt across chunks differs: ", err)
+	}
+	if pos, err := f.Seek(-10, io.SeekEnd); err != nil || pos != int64(len(data)-10) {
+		t.Error("Unexpected seek position: ", pos, err)
+	}
+}
+
+func TestEncryptedTruncate(t *testing.T) {
+	fs := NewEncrypted(afero.NewMemMapFs(), StaticKey(testKey), "/", false)
+	f, err := fs.OpenFile("/file", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Error("Error creating file: ", err)
+		return
+	}
+	defer f.Close()
+	f.Write(bytes.Repeat([]byte("a"), encChunkSize+10))
+
+	if err := f.Truncate(5); err != nil {
+		t.Error("Error shrinking file: ", err)
+		return
+	}
+	if err := f.Truncate(encChunkSize + 5); err != nil {
+		t.Error("Error growing file: ", err)
+		return
+	}
+	f.Write([]byte("end"))
+
+	p := make([]byte, encChunkSize+8)
+	n, err := f.ReadAt(p, 0)
+	if n != len(p) || (err != nil && err != io.EOF) {
+		t.Error("Unexpected read: ", n, err)
+		return
+	}
+	expect := append(append([]byte("aaaaa"), make([]byte, encChunkSize)...), "end"...)
+	if !bytes.Equal(p, expect) {
+		t.Error("Unexpected content after truncates")
+	}
+}
+
+func TestEncryptedSparseWrite(t *testing.T) {
+	backend := afero.NewMemMapFs()
+	fs := NewEncrypted(backend, StaticKey(testKey), "/", false)
+	f, err := fs.Create("/sparse")
+	if err != nil {
+		t.Error("Error creating file: ", err)
+		return
+	}
+	off := int64(3*encChunkSize + 100)
+	if _, err := f.(io.WriterAt).WriteAt([]byte("sparse"), off); err != nil {
+		t.Error("Error writing past the end: ", err)
+		return
+	}
+	f.Close()
+
+	f, err = fs.Open("/sparse")
+	if err != nil {
+		t.Error("Error reopening file: ", err)
+		return
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Error("Error reading sparse file: ", err)
+		return
+	}
+	expect := append(make([]byte, off), "sparse"...)
+	if !bytes.Equal(data, expect) {
+		t.Error("Unexpected content of sparse file: ", len(data))
+	}
+}
+
+func TestEncryptedTampering(t *testing.T) {
+	backend := afero.NewMemMapFs()
+	fs := NewEncrypted(backend, StaticKey(testKey), "/", false)
+	f, _ := fs.Create("/file")
+	f.Write(make([]byte, 2*encChunkSize))
+	f.Close()
+
+	raw, _ := afero.ReadFile(backend, "/file")
+	flipped := append([]byte(nil), raw...)
+	flipped[len(flipped)-1] ^= 1
+	afero.WriteFile(backend, "/flipped", flipped, 0644)
+	// dropping the whole last chunk leaves a valid looking file
+	afero.WriteFile(backend, "/cut", raw[:chunkOffset(1)], 0644)
+
+	for _, name := range []string{"/flipped", "/cut"} {
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Error("Error opening file: ", err)
+			continue
+		}
+		_, err = ioutil.ReadAll(f)
+		f.Close()
+		if !errors.Is(err, ErrDecryption) {
+			t.Error("Expected ErrDecryption reading ", name, ", got: ", err)
+		}
+	}
+
+	afero.WriteFile(backend, "/plain", []byte("not encrypted"), 0644)
+	if _, err := fs.Open("/plain"); !errors.Is(err, ErrNotEncrypted) {
+		t.Error("Expected ErrNotEncrypted, got: ", err)
+	}
+}
+
+func TestEncryptedKeyRotation(t *testing.T) {
+	keys := &rotatingKeys{current: "2020", keys: map[string][]byte{"2020": testKey, "2021": bytes.Repeat([]byte{7}, 16)}}
+	backend := afero.NewMemMapFs()
+	fs := NewEncrypted(backend, keys, "/", false)
+
+	f, _ := fs.Create("/old")
+	f.Write([]byte("old"))
+	f.Close()
+	keys.current = "2021"
+	f, _ = fs.Create("/new")
+	f.Write([]byte("new"))
+	f.Close()
+
+	for name, expect := range map[string]string{"/old": "old", "/new": "new"} {
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Error("Error opening file: ", err)
+			continue
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil || string(data) != expect {
+			t.Error("Unexpected content of ", name, ": ", string(data), err)
+		}
+	}
+
+	delete(keys.keys, "2020")
+	if _, err := fs.Open("/old"); err == nil {
+		t.Error("Opened a file without its key")
+	}
+}
@@ -0,0 +1,213 @@
+package afero
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/pkg/errors"
+)
+
+// ArchiveFormat is the format of an exported archive.
+type ArchiveFormat int
+
+const (
+	// TarArchive is an uncompressed tar archive.
+	TarArchive ArchiveFormat = iota
+	// TarGzipArchive is a gzipped tar archive.
+	TarGzipArchive
+	// ZipArchive is a zip archive with deflated files.
+	ZipArchive
+)
+
+// exportModTime is the timestamp of exported entries by default, the
+// earliest one zip can store.
+var exportModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ExportOptions configures Export. Include and Exclude hold patterns matched
+// as by CompressionRule against the path below the exported directory, with
+// a leading slash. Excluded directories are skipped whole, and when Include
+// is set only the files matching it are exported, with their parents.
+type ExportOptions struct {
+	Format  ArchiveFormat
+	Include []string
+	Exclude []string
+	// ModTime is the timestamp of every entry, defaulting to 1980-01-01.
+	ModTime time.Time
+}
+
+// exportEntry is an entry to export, name is relative to the exported
+// directory.
+type exportEntry struct {
+	name string
+	fi   os.FileInfo
+	link string
+}
+
+// Export writes the tree below root to w as an archive. Archives of the same
+// tree are identical: entries are sorted, owned by root and share one
+// timestamp. Modes and symlinks are preserved, other special files skipped.
+func Export(fs billy.Filesystem, root string, w io.Writer, opts ExportOptions) error {
+	if opts.ModTime.IsZero() {
+		opts.ModTime = exportModTime
+	}
+	entries, err := exportWalk(fs, root, "", opts)
+	if err != nil {
+		return err
+	}
+
+	switch opts.Format {
+	case TarArchive:
+		return exportTar(fs, root, w, entries, opts)
+	case TarGzipArchive:
+		gz := gzip.NewWriter(w)
+		if err := exportTar(fs, root, gz, entries, opts); err != nil {
+			return err
+		}
+		return gz.Close()
+	case ZipArchive:
+		return exportZip(fs, root, w, entries, opts)
+	}
+	return errors.Errorf("Unknown archive format %d", opts.Format)
+}
+
+// exportWalk lists the entries below dir in order.
+func exportWalk(fs billy.Filesystem, root, dir string, opts ExportOptions) ([]exportEntry, error) {
+	list, err := fs.ReadDir(path.Join(root, dir))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+
+	var entries []exportEntry
+	for _, fi := range list {
+		name := path.Join(dir, fi.Name())
+		if exportMatch(opts.Exclude, name) {
+			continue
+		}
+		// ReadDir follows symlinks on some backends
+		if fi, err = fs.Lstat(path.Join(root, name)); err != nil {
+			return nil, err
+		}
+		switch {
+		case fi.IsDir():
+			children, err := exportWalk(fs, root, name, opts)
+			if err != nil {
+				return nil, err
+			}
+			if len(children) > 0 || len(opts.Include) == 0 || exportMatch(opts.Include, name) {
+				entries = append(entries, exportEntry{name: name, fi: fi})
+				entries = append(entries, children...)
+			}
+		case len(opts.Include) > 0 && !exportMatch(opts.Include, name):
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := fs.Readlink(path.Join(root, name))
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, exportEntry{name: name, fi: fi, link: link})
+		case fi.Mode().IsRegular():
+			entries = append(entries, exportEntry{name: name, fi: fi})
+		}
+	}
+	return entries, nil
+}
+
+func exportMatch(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, "/"+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// exportMode returns the permission bits of fi kept in archives.
+func exportMode(fi os.FileMode) os.FileMode {
+	return fi & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+func exportTar(fs billy.Filesystem, root string, w io.Writer, entries []exportEntry, opts ExportOptions) error {
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, ModTime: opts.ModTime}
+		mode := exportMode(e.fi.Mode())
+		hdr.Mode = int64(mode.Perm())
+		if mode&os.ModeSetuid != 0 {
+			hdr.Mode |= 04000
+		}
+		if mode&os.ModeSetgid != 0 {
+			hdr.Mode |= 02000
+		}
+		if mode&os.ModeSticky != 0 {
+			hdr.Mode |= 01000
+		}
+		switch {
+		case e.fi.IsDir():
+			hdr.Typeflag, hdr.Name = tar.TypeDir, e.name+"/"
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.link
+		default:
+			hdr.Typeflag, hdr.Size = tar.TypeReg, e.fi.Size()
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if err := exportCopy(fs, path.Join(root, e.name), tw); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+func exportZip(fs billy.Filesystem, root string, w io.Writer, entries []exportEntry, opts ExportOptions) error {
+	zw := zip.NewWriter(w)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Modified: opts.ModTime, Method: zip.Store}
+		mode := exportMode(e.fi.Mode())
+		switch {
+		case e.fi.IsDir():
+			hdr.Name += "/"
+			mode |= os.ModeDir
+		case e.link != "":
+			mode |= os.ModeSymlink
+		default:
+			hdr.Method = zip.Deflate
+		}
+		hdr.SetMode(mode)
+		out, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		switch {
+		case e.link != "":
+			if _, err := io.WriteString(out, e.link); err != nil {
+				return err
+			}
+		case !e.fi.IsDir():
+			if err := exportCopy(fs, path.Join(root, e.name), out); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+// exportCopy writes the content of the named file to w.
+func exportCopy(fs billy.Filesystem, name string, w io.Writer) error {
+	f, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,98 @@
+package afero
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/spf13/afero"
+)
+
+func testExportTree(t *testing.T) billy.Filesystem {
+	// MemMapFs has no symlinks
+	dir, err := afero.TempDir(afero.NewOsFs(), tempDir, "export.")
+	if err != nil {
+		t.Fatal("Error creating temp directory: ", err)
+	}
+	fs := New(afero.NewBasePathFs(afero.NewOsFs(), dir), dir, false)
+	util.WriteFile(fs, "/b.txt", []byte("b"), 0644)
+	util.WriteFile(fs, "/a/script", []byte("#!/bin/sh\n"), 0755)
+	util.WriteFile(fs, "/a/notes.txt", []byte("notes"), 0600)
+	util.WriteFile(fs, "/build/out.o", []byte("object"), 0644)
+	fs.Symlink("a/script", "/run")
+	return fs
+}
+
+func TestExportReproducible(t *testing.T) {
+	for _, format := range []ArchiveFormat{TarArchive, TarGzipArchive, ZipArchive} {
+		fs := testExportTree(t)
+		var first, second bytes.Buffer
+		if err := Export(fs, "/", &first, ExportOptions{Format: format}); err != nil {
+			t.Error("Error exporting tree: ", err)
+			return
+		}
+		// timestamps and creation order do not matter
+		fs.Remove("/b.txt")
+		util.WriteFile(fs, "/b.txt", []byte("b"), 0644)
+		if err := Export(fs, "/", &second, ExportOptions{Format: format}); err != nil {
+			t.Error("Error exporting tree: ", err)
+			return
+		}
+		if !bytes.Equal(first.Bytes(), second.Bytes()) {
+			t.Error("Archives of the same tree differ: ", format)
+		}
+
+		var archive billy.Filesystem
+		var err error
+		if format == ZipArchive {
+			archive, err = NewZip(bytes.NewReader(first.Bytes()), int64(first.Len()), "/", false)
+		} else {
+			archive, err = NewTar(bytes.NewReader(first.Bytes()), int64(first.Len()), "/", false)
+		}
+		if err != nil {
+			t.Error("Error reading archive: ", err)
+			return
+		}
+		if fi, err := archive.Stat("/a/script"); err != nil || fi.Mode() != 0755 || !fi.ModTime().Equal(exportModTime) {
+			t.Error("Unexpected file info: ", fi, err)
+		}
+		if dest, err := archive.Readlink("/run"); err != nil || dest != "a/script" {
+			t.Error("Symlink was not preserved: ", dest, err)
+		}
+		f, err := archive.Open("/a/notes.txt")
+		if err != nil {
+			t.Error("Error opening file: ", err)
+			return
+		}
+		if data, err := ioutil.ReadAll(f); err != nil || string(data) != "notes" {
+			t.Error("Unexpected content: ", string(data), err)
+		}
+		f.Close()
+	}
+}
+
+func TestExportFilters(t *testing.T) {
+	fs := testExportTree(t)
+	var buf bytes.Buffer
+	err := Export(fs, "/", &buf, ExportOptions{Include: []string{"*.txt", "*.o"}, Exclude: []string{"/build"}})
+	if err != nil {
+		t.Error("Error exporting tree: ", err)
+		return
+	}
+	archive, err := NewTar(bytes.NewReader(buf.Bytes()), int64(buf.Len()), "/", false)
+	if err != nil {
+		t.Error("Error reading archive: ", err)
+		return
+	}
+	for name, expect := range map[string]bool{"/b.txt": true, "/a/notes.txt": true, "/a/script": false, "/run": false, "/build": false} {
+		if _, err := archive.Lstat(name); (err == nil) != expect {
+			t.Error("Unexpected presence of ", name, ": ", err)
+		}
+	}
+	if _, err := fs.Stat("/b.txt"); os.IsNotExist(err) {
+		t.Error("Export changed the tree")
+	}
+}
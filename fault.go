@@ -0,0 +1,381 @@
+package afero
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/spf13/afero"
+)
+
+// FaultRule selects calls of a FaultFs to inject a fault into. Filesystem
+// methods are named as on afero.Fs, such as "Stat" or "Rename", and file
+// methods with a "File." prefix, such as "File.Write".
+type FaultRule struct {
+	// Op is a path.Match pattern of the method names to match, all when
+	// empty.
+	Op string
+	// Path is a path.Match pattern of the absolute paths to match, all when
+	// empty. Rename matches the old path and Symlink the new one.
+	Path string
+	// Nth injects the fault into the nth matching call only, counting from
+	// one. Zero injects into every matching call.
+	Nth int
+	// Probability injects the fault into matching calls at random, drawn
+	// from the seed of the FaultFs. Zero always injects.
+	Probability float64
+
+	// Latency delays the call.
+	Latency time.Duration
+	// Short limits reads and writes to at most Short bytes, writes cut short
+	// fail with io.ErrShortWrite.
+	Short int
+	// Err fails the call, after the short transfer if Short is set. Rules
+	// without Latency or Short fail with EIO when it is nil.
+	Err error
+}
+
+func (r *FaultRule) err() error {
+	if r.Err == nil && r.Latency == 0 && r.Short == 0 {
+		return syscall.EIO
+	}
+	return r.Err
+}
+
+// FaultFs is an afero.Fs injecting errors, short reads and writes and
+// latency into the calls of another filesystem, and of its files, matching
+// its rules. It is meant for testing error handling.
+type FaultFs struct {
+	fs    afero.Fs
+	rules []FaultRule
+	calls []int
+	rand  *rand.Rand
+	clock clock
+	m     sync.Mutex
+}
+
+// NewFaultFs returns a FaultFs over fs, drawing probabilistic faults from
+// seed so runs are repeatable.
+func NewFaultFs(fs afero.Fs, seed int64, rules ...FaultRule) *FaultFs {
+	return &FaultFs{fs: fs, rules: rules, calls: make([]int, len(rules)), rand: rand.New(rand.NewSource(seed)), clock: realClock{}}
+}
+
+// NewFault returns a billy filesystem over a FaultFs.
+func NewFault(fs afero.Fs, root string, debug bool, seed int64, rules ...FaultRule) billy.Filesystem {
+	return New(NewFaultFs(fs, seed, rules...), root, debug)
+}
+
+// SetRules replaces the rules, restarting the call counts.
+func (f *FaultFs) SetRules(rules ...FaultRule) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.rules = rules
+	f.calls = make([]int, len(rules))
+}
+
+// match returns the first rule firing for a call of op on name, after
+// waiting out its latency. Every matching rule counts the call.
+func (f *FaultFs) match(op, name string) *FaultRule {
+	name = mountPath(name)
+	f.m.Lock()
+	var fired *FaultRule
+	for i := range f.rules {
+		rule := &f.rules[i]
+		if rule.Op != "" {
+			if ok, _ := path.Match(rule.Op, op); !ok {
+				continue
+			}
+		}
+		if rule.Path != "" {
+			if ok, _ := path.Match(rule.Path, name); !ok {
+				continue
+			}
+		}
+		f.calls[i]++
+		if rule.Nth > 0 && f.calls[i] != rule.Nth {
+			continue
+		}
+		if rule.Probability > 0 && f.rand.Float64() >= rule.Probability {
+			continue
+		}
+		if fired == nil {
+			fired = rule
+		}
+	}
+	f.m.Unlock()
+
+	if fired != nil && fired.Latency > 0 {
+		f.clock.Sleep(fired.Latency)
+	}
+	return fired
+}
+
+// fault returns the error to inject into a call of op on name, if any.
+func (f *FaultFs) fault(op, name string) error {
+	if rule := f.match(op, name); rule != nil {
+		if err := rule.err(); err != nil {
+			return &os.PathError{Op: faultOp(op), Path: name, Err: err}
+		}
+	}
+	return nil
+}
+
+// faultOp is the error operation of a method name.
+func faultOp(op string) string {
+	return strings.ToLower(strings.TrimPrefix(op, "File."))
+}
+
+// Name returns the name of this filesystem.
+func (f *FaultFs) Name() string {
+	return "FaultFs"
+}
+
+// Create creates or truncates the named file.
+func (f *FaultFs) Create(name string) (afero.File, error) {
+	if err := f.fault("Create", name); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f, name: name}, nil
+}
+
+// Mkdir creates a directory.
+func (f *FaultFs) Mkdir(name string, perm os.FileMode) error {
+	if err := f.fault("Mkdir", name); err != nil {
+		return err
+	}
+	return f.fs.Mkdir(name, perm)
+}
+
+// MkdirAll creates a directory and any missing parents.
+func (f *FaultFs) MkdirAll(name string, perm os.FileMode) error {
+	if err := f.fault("MkdirAll", name); err != nil {
+		return err
+	}
+	return f.fs.MkdirAll(name, perm)
+}
+
+// Open opens the named file for reading.
+func (f *FaultFs) Open(name string) (afero.File, error) {
+	if err := f.fault("Open", name); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f, name: name}, nil
+}
+
+// OpenFile opens the named file with flag and perm.
+func (f *FaultFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if err := f.fault("OpenFile", name); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f, name: name}, nil
+}
+
+// Remove removes a file or empty directory.
+func (f *FaultFs) Remove(name string) error {
+	if err := f.fault("Remove", name); err != nil {
+		return err
+	}
+	return f.fs.Remove(name)
+}
+
+// RemoveAll removes a path and everything below it.
+func (f *FaultFs) RemoveAll(name string) error {
+	if err := f.fault("RemoveAll", name); err != nil {
+		return err
+	}
+	return f.fs.RemoveAll(name)
+}
+
+// Rename moves oldname to newname.
+func (f *FaultFs) Rename(oldname, newname string) error {
+	if rule := f.match("Rename", oldname); rule != nil {
+		if err := rule.err(); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+	}
+	return f.fs.Rename(oldname, newname)
+}
+
+// Stat returns the FileInfo of the named file.
+func (f *FaultFs) Stat(name string) (os.FileInfo, error) {
+	if err := f.fault("Stat", name); err != nil {
+		return nil, err
+	}
+	return f.fs.Stat(name)
+}
+
+// Chmod changes the mode of the named file.
+func (f *FaultFs) Chmod(name string, mode os.FileMode) error {
+	if err := f.fault("Chmod", name); err != nil {
+		return err
+	}
+	return f.fs.Chmod(name, mode)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (f *FaultFs) Chtimes(name string, atime, mtime time.Time) error {
+	if err := f.fault("Chtimes", name); err != nil {
+		return err
+	}
+	return f.fs.Chtimes(name, atime, mtime)
+}
+
+// LstatIfPossible implements afero.Lstater.
+func (f *FaultFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	if err := f.fault("Lstat", name); err != nil {
+		return nil, false, err
+	}
+	return lstat(f.fs, name)
+}
+
+// SymlinkIfPossible implements afero.Linker.
+func (f *FaultFs) SymlinkIfPossible(oldname, newname string) error {
+	if rule := f.match("Symlink", newname); rule != nil {
+		if err := rule.err(); err != nil {
+			return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+		}
+	}
+	if linker, ok := f.fs.(afero.Linker); ok {
+		return linker.SymlinkIfPossible(oldname, newname)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+}
+
+// ReadlinkIfPossible implements afero.LinkReader.
+func (f *FaultFs) ReadlinkIfPossible(name string) (string, error) {
+	if err := f.fault("Readlink", name); err != nil {
+		return "", err
+	}
+	if reader, ok := f.fs.(afero.LinkReader); ok {
+		return reader.ReadlinkIfPossible(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+}
+
+// faultFile injects the faults of its FaultFs into file methods.
+type faultFile struct {
+	afero.File
+	fs   *FaultFs
+	name string
+}
+
+// transfer runs a read or write of p under the rules for op.
+func (f *faultFile) transfer(op string, p []byte, write bool, do func([]byte) (int, error)) (int, error) {
+	rule := f.fs.match(op, f.name)
+	if rule == nil {
+		return do(p)
+	}
+	injected := rule.err()
+	if injected != nil {
+		injected = &os.PathError{Op: faultOp(op), Path: f.name, Err: injected}
+		if rule.Short == 0 {
+			return 0, injected
+		}
+	}
+	full := len(p)
+	if rule.Short > 0 && full > rule.Short {
+		p = p[:rule.Short]
+	}
+	n, err := do(p)
+	if err == nil {
+		err = injected
+	}
+	if err == nil && write && n < full {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+func (f *faultFile) fault(op string) error {
+	return f.fs.fault(op, f.name)
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	return f.transfer("File.Read", p, false, f.File.Read)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.transfer("File.ReadAt", p, false, func(p []byte) (int, error) { return f.File.ReadAt(p, off) })
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	return f.transfer("File.Write", p, true, f.File.Write)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.transfer("File.WriteAt", p, true, func(p []byte) (int, error) { return f.File.WriteAt(p, off) })
+}
+
+func (f *faultFile) WriteString(s string) (int, error) {
+	return f.transfer("File.WriteString", []byte(s), true, func(p []byte) (int, error) { return f.File.WriteString(string(p)) })
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.fault("File.Seek"); err != nil {
+		return 0, err
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.fault("File.Truncate"); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fault("File.Sync"); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	if err := f.fault("File.Stat"); err != nil {
+		return nil, err
+	}
+	return f.File.Stat()
+}
+
+func (f *faultFile) Readdir(count int) ([]os.FileInfo, error) {
+	if err := f.fault("File.Readdir"); err != nil {
+		return nil, err
+	}
+	return f.File.Readdir(count)
+}
+
+func (f *faultFile) Readdirnames(n int) ([]string, error) {
+	if err := f.fault("File.Readdirnames"); err != nil {
+		return nil, err
+	}
+	return f.File.Readdirnames(n)
+}
+
+// Close closes the file even when a fault is injected, as a failed close
+// still releases the file on most systems.
+func (f *faultFile) Close() error {
+	err := f.fault("File.Close")
+	if cerr := f.File.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
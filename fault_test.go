@@ -0,0 +1,121 @@
+package afero
+
+import (
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+func TestFaultFsErrors(t *testing.T) {
+	backend := afero.NewMemMapFs()
+	afero.WriteFile(backend, "/dir/file", []byte("data"), 0644)
+	afero.WriteFile(backend, "/other", []byte("data"), 0644)
+	fs := NewFault(backend, "/", false, 0, FaultRule{Op: "Stat", Path: "/dir/*"})
+
+	if _, err := fs.Stat("/dir/file"); !errors.Is(err, syscall.EIO) {
+		t.Error("Expected EIO, got: ", err)
+	}
+	if _, err := fs.Stat("/other"); err != nil {
+		t.Error("Fault injected into a path not matching: ", err)
+	}
+	if _, err := fs.Lstat("/dir/file"); err != nil {
+		t.Error("Fault injected into an op not matching: ", err)
+	}
+}
+
+func TestFaultFsNth(t *testing.T) {
+	fault := NewFaultFs(afero.NewMemMapFs(), 0, FaultRule{Op: "File.Write", Nth: 2, Err: syscall.ENOSPC})
+	fs := New(fault, "/", false)
+
+	f, err := fs.Create("/file")
+	if err != nil {
+		t.Error("Error creating file: ", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("one")); err != nil {
+		t.Error("Fault injected into the first call: ", err)
+	}
+	if _, err := f.Write([]byte("two")); !errors.Is(err, syscall.ENOSPC) {
+		t.Error("Expected ENOSPC, got: ", err)
+	}
+	if _, err := f.Write([]byte("three")); err != nil {
+		t.Error("Fault injected into the third call: ", err)
+	}
+
+	fault.SetRules(FaultRule{Op: "Rename"})
+	if err := fs.Rename("/file", "/renamed"); !errors.Is(err, syscall.EIO) {
+		t.Error("Expected EIO, got: ", err)
+	}
+}
+
+func TestFaultFsShortTransfers(t *testing.T) {
+	backend := afero.NewMemMapFs()
+	fs := NewFault(backend, "/", false, 0, FaultRule{Op: "File.*", Short: 2})
+
+	f, err := fs.Create("/file")
+	if err != nil {
+		t.Error("Error creating file: ", err)
+		return
+	}
+	if n, err := f.Write([]byte("data")); n != 2 || err != io.ErrShortWrite {
+		t.Error("Expected a short write, got: ", n, err)
+	}
+	f.Close()
+
+	f, err = fs.Open("/file")
+	if err != nil {
+		t.Error("Error opening file: ", err)
+		return
+	}
+	defer f.Close()
+	p := make([]byte, 4)
+	if n, err := f.Read(p); n != 2 || err != nil || string(p[:n]) != "da" {
+		t.Error("Expected a short read, got: ", n, err)
+	}
+}
+
+func TestFaultFsLatency(t *testing.T) {
+	c := &fakeClock{}
+	fault := NewFaultFs(afero.NewMemMapFs(), 0, FaultRule{Op: "MkdirAll", Latency: time.Second})
+	fault.clock = c
+	fs := New(fault, "/", false)
+
+	if err := fs.MkdirAll("/dir", 0755); err != nil {
+		t.Error("Latency failed the call: ", err)
+	}
+	if c.slept != time.Second {
+		t.Error("Call was not delayed: ", c.slept)
+	}
+}
+
+func TestFaultFsProbability(t *testing.T) {
+	pattern := func(seed int64) []bool {
+		fs := NewFaultFs(afero.NewMemMapFs(), seed, FaultRule{Op: "Stat", Probability: 0.5, Err: syscall.EAGAIN})
+		var failed []bool
+		for i := 0; i < 100; i++ {
+			_, err := fs.Stat("/file")
+			failed = append(failed, errors.Is(err, syscall.EAGAIN))
+		}
+		return failed
+	}
+
+	first, second := pattern(42), pattern(42)
+	count := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Error("Faults differ for the same seed at call ", i)
+			return
+		}
+		if first[i] {
+			count++
+		}
+	}
+	if count < 30 || count > 70 {
+		t.Error("Unexpected fault count: ", count)
+	}
+}
@@ -4,6 +4,7 @@ go 1.15
 
 require (
 	github.com/go-git/go-billy/v5 v5.0.0
+	github.com/klauspost/compress v1.11.13
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/afero v1.3.4
 )
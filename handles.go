@@ -0,0 +1,126 @@
+package afero
+
+import (
+	"os"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrTooManyOpenFiles is returned when opening a file would exceed the limit
+// set with WithHandleTracking.
+var ErrTooManyOpenFiles = errors.New("Too many open files")
+
+// OpenHandle describes a file opened through the filesystem and not yet
+// closed.
+type OpenHandle struct {
+	// Name is the path of the file, relative to the root passed to New.
+	Name   string
+	Flag   int
+	Opened time.Time
+	// Stack is the stack of the goroutine that opened the file, recorded in
+	// debug mode only.
+	Stack string
+
+	seq uint64
+}
+
+// handles tracks the open files of a filesystem, it is shared by every
+// Chroot. Reserved slots count towards the limit while the backend opens
+// the file.
+type handles struct {
+	max      int
+	open     map[*file]OpenHandle
+	reserved int
+	seq      uint64
+	now      func() time.Time
+	m        sync.Mutex
+}
+
+func newHandles(max int, now func() time.Time) *handles {
+	return &handles{max: max, open: map[*file]OpenHandle{}, now: now}
+}
+
+// reserve takes a slot for a file about to be opened.
+func (h *handles) reserve(name string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.max > 0 && len(h.open)+h.reserved >= h.max {
+		return &os.PathError{Op: "open", Path: name, Err: ErrTooManyOpenFiles}
+	}
+	h.reserved++
+	return nil
+}
+
+// unreserve gives back the slot of a file that failed to open.
+func (h *handles) unreserve() {
+	h.m.Lock()
+	h.reserved--
+	h.m.Unlock()
+}
+
+// add tracks f in a slot taken with reserve.
+func (h *handles) add(f *file, name string, flag int, stack bool) {
+	handle := OpenHandle{Name: name, Flag: flag}
+	if stack {
+		handle.Stack = string(debug.Stack())
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.reserved--
+	h.seq++
+	handle.seq = h.seq
+	handle.Opened = h.now()
+	h.open[f] = handle
+	f.handles = h
+}
+
+func (h *handles) remove(f *file) {
+	h.m.Lock()
+	delete(h.open, f)
+	h.m.Unlock()
+}
+
+// OpenHandles returns the files opened through the filesystem or any of its
+// Chroots that have not been closed, oldest first. It returns nil without
+// WithHandleTracking.
+func (fs *Afero) OpenHandles() []OpenHandle {
+	if fs.handles == nil {
+		return nil
+	}
+	h := fs.handles
+	h.m.Lock()
+	defer h.m.Unlock()
+	list := make([]OpenHandle, 0, len(h.open))
+	for _, handle := range h.open {
+		list = append(list, handle)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].seq < list[j].seq })
+	return list
+}
+
+// CloseAll closes every open file tracked for the filesystem and its
+// Chroots, returning the first error.
+func (fs *Afero) CloseAll() error {
+	if fs.handles == nil {
+		return nil
+	}
+	h := fs.handles
+	h.m.Lock()
+	files := make([]*file, 0, len(h.open))
+	for f := range h.open {
+		files = append(files, f)
+	}
+	h.m.Unlock()
+
+	var first error
+	for _, f := range files {
+		if err := f.Close(); err != nil && first == nil {
+			first = errors.Wrap(err, "Error closing "+f.name)
+		}
+	}
+	return first
+}
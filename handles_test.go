@@ -0,0 +1,85 @@
+package afero
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+func TestOpenHandles(t *testing.T) {
+	fs := New(afero.NewMemMapFs(), "/", true, WithHandleTracking(0)).(*Afero)
+
+	leaked, err := fs.Create("/repo/leaked")
+	if err != nil {
+		t.Error("Error creating file: ", err)
+		return
+	}
+	f, err := fs.Create("/repo/closed")
+	if err != nil {
+		t.Error("Error creating file: ", err)
+		return
+	}
+	f.Close()
+
+	chroot, _ := fs.Chroot("/repo")
+	if _, err := chroot.TempFile("/tmp", "temp"); err != nil {
+		t.Error("Error creating temp file: ", err)
+		return
+	}
+
+	open := fs.OpenHandles()
+	if len(open) != 2 {
+		t.Error("Expected 2 open handles, got: ", open)
+		return
+	}
+	if open[0].Name != "/repo/leaked" || open[0].Flag&os.O_CREATE == 0 {
+		t.Error("Unexpected leak report: ", open[0])
+	}
+	if !strings.Contains(open[0].Stack, "TestOpenHandles") {
+		t.Error("Leak report is missing the open stack: ", open[0].Stack)
+	}
+	if !strings.HasPrefix(open[1].Name, "/repo/tmp/temp") {
+		t.Error("Unexpected leak report: ", open[1])
+	}
+
+	if err := fs.CloseAll(); err != nil {
+		t.Error("Error closing files: ", err)
+	}
+	if open := fs.OpenHandles(); len(open) != 0 {
+		t.Error("CloseAll left open handles: ", open)
+	}
+	if _, err := leaked.Write([]byte("data")); err == nil {
+		t.Error("File was not closed")
+	}
+}
+
+func TestMaxOpenHandles(t *testing.T) {
+	fs := New(afero.NewMemMapFs(), "/", false, WithHandleTracking(1)).(*Afero)
+
+	f, err := fs.Create("/first")
+	if err != nil {
+		t.Error("Error creating file: ", err)
+		return
+	}
+	if _, err := fs.Create("/second"); !errors.Is(err, ErrTooManyOpenFiles) {
+		t.Error("Expected ErrTooManyOpenFiles, got: ", err)
+	}
+	f.Close()
+
+	// failed opens do not hold on to their slot
+	if _, err := fs.Open("/missing"); !os.IsNotExist(err) {
+		t.Error("Expected a not exist error, got: ", err)
+	}
+	f, err = fs.Create("/second")
+	if err != nil {
+		t.Error("Error creating file after close: ", err)
+		return
+	}
+	f.Close()
+	if fs.handles.reserved != 0 {
+		t.Error("Slots were not given back: ", fs.handles.reserved)
+	}
+}
@@ -0,0 +1,413 @@
+package afero
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrUnsafePath is returned importing an entry that would be written
+	// outside the import directory or through a symlink.
+	ErrUnsafePath = errors.New("Archive entry escapes the import directory")
+	// ErrSymlinkEscape is returned importing a symlink pointing outside the
+	// import directory.
+	ErrSymlinkEscape = errors.New("Archive symlink points outside the import directory")
+	// ErrImportLimit is returned when an archive exceeds the entry count or
+	// size limits of an import.
+	ErrImportLimit = errors.New("Archive exceeds the import limits")
+)
+
+// ImportOptions configures Import.
+type ImportOptions struct {
+	Format ArchiveFormat
+	// MaxEntries and MaxBytes limit the number of entries and the total size
+	// of the files imported, zero meaning no limit.
+	MaxEntries int
+	MaxBytes   int64
+	// DryRun reports the entries that would be written without writing.
+	DryRun bool
+}
+
+// ImportAction is an entry written, or to be written, by Import.
+type ImportAction struct {
+	Name    string
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+	// Link is the destination of symlinks, or the file hard links copy.
+	Link string
+}
+
+// importEntry is an archive entry, read by open.
+type importEntry struct {
+	ImportAction
+	hardlink bool
+	open     func() (io.ReadCloser, error)
+}
+
+// Import writes the entries of the archive read from r below root, which
+// must exist. Entries escaping root, by name or by writing through a
+// symlink, fail with ErrUnsafePath and symlinks pointing outside of root
+// with ErrSymlinkEscape. Modes and times are set when fs implements
+// billy.Change. Devices and other special files are skipped. Zip archives
+// need random access, r is read in memory unless it has ReadAt and Size.
+func Import(fs billy.Filesystem, root string, r io.Reader, opts ImportOptions) ([]ImportAction, error) {
+	var next func() (*importEntry, error)
+	switch opts.Format {
+	case TarArchive, TarGzipArchive:
+		if opts.Format == TarGzipArchive {
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			defer gz.Close()
+			r = gz
+		}
+		next = importTar(tar.NewReader(r))
+	case ZipArchive:
+		ra, ok := r.(interface {
+			io.ReaderAt
+			Size() int64
+		})
+		if !ok {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			ra = bytes.NewReader(data)
+		}
+		zr, err := zip.NewReader(ra, ra.Size())
+		if err != nil {
+			return nil, err
+		}
+		next = importZip(zr)
+	default:
+		return nil, errors.Errorf("Unknown archive format %d", opts.Format)
+	}
+
+	im := &importer{fs: fs, root: mountPath(root), opts: opts, links: map[string]bool{}, dirs: map[string]bool{}}
+	for {
+		e, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return im.actions, err
+		}
+		if err := im.add(e); err != nil {
+			return im.actions, err
+		}
+	}
+	return im.actions, im.finish()
+}
+
+func importTar(tr *tar.Reader) func() (*importEntry, error) {
+	return func() (*importEntry, error) {
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				return nil, err
+			}
+			e := &importEntry{ImportAction: ImportAction{
+				Name:    hdr.Name,
+				Mode:    hdr.FileInfo().Mode(),
+				ModTime: hdr.ModTime,
+			}}
+			switch hdr.Typeflag {
+			case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+				e.Size = hdr.Size
+				e.open = func() (io.ReadCloser, error) { return ioutil.NopCloser(tr), nil }
+			case tar.TypeDir:
+			case tar.TypeSymlink:
+				e.Link = hdr.Linkname
+			case tar.TypeLink:
+				e.Link, e.hardlink = hdr.Linkname, true
+			default:
+				continue
+			}
+			return e, nil
+		}
+	}
+}
+
+func importZip(zr *zip.Reader) func() (*importEntry, error) {
+	i := 0
+	return func() (*importEntry, error) {
+		for ; i < len(zr.File); i++ {
+			f := zr.File[i]
+			e := &importEntry{ImportAction: ImportAction{
+				Name:    f.Name,
+				Mode:    f.Mode(),
+				ModTime: f.Modified,
+			}}
+			switch {
+			case e.Mode.IsDir():
+			case e.Mode&os.ModeSymlink != 0:
+				rc, err := f.Open()
+				if err != nil {
+					return nil, err
+				}
+				link, err := ioutil.ReadAll(io.LimitReader(rc, 4096))
+				rc.Close()
+				if err != nil {
+					return nil, err
+				}
+				e.Link = string(link)
+			case e.Mode.IsRegular():
+				e.Size = int64(f.UncompressedSize64)
+				e.open = f.Open
+			default:
+				continue
+			}
+			i++
+			return e, nil
+		}
+		return nil, io.EOF
+	}
+}
+
+// importer writes the entries of an archive.
+type importer struct {
+	fs      billy.Filesystem
+	root    string
+	opts    ImportOptions
+	actions []ImportAction
+	bytes   int64
+	// links holds the symlinks imported, dirs the directories known not to
+	// be symlinks.
+	links map[string]bool
+	dirs  map[string]bool
+}
+
+// target returns the path an entry name is imported at, failing for names
+// leaving root.
+func (im *importer) target(name string) (string, error) {
+	name = strings.TrimLeft(strings.Replace(name, "\\", "/", -1), "/")
+	clean := path.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", errors.Wrap(ErrUnsafePath, name)
+	}
+	return path.Join(im.root, clean), nil
+}
+
+// checkParents fails if a parent of target below root is a symlink.
+func (im *importer) checkParents(target string) error {
+	var parents []string
+	for dir := path.Dir(target); isBelow(dir, im.root); dir = path.Dir(dir) {
+		parents = append(parents, dir)
+	}
+	for i := len(parents) - 1; i >= 0; i-- {
+		dir := parents[i]
+		if im.dirs[dir] {
+			continue
+		}
+		if im.links[dir] {
+			return errors.Wrap(ErrUnsafePath, dir)
+		}
+		fi, err := im.fs.Lstat(dir)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return err
+		case fi.Mode()&os.ModeSymlink != 0:
+			return errors.Wrap(ErrUnsafePath, dir)
+		}
+		im.dirs[dir] = true
+	}
+	return nil
+}
+
+// checkLink fails if the symlink destination dest, absolute but not
+// cleaned, leaves root. Symlinks are resolved by the filesystem rather than
+// lexically, so destinations going through one below root are refused.
+func (im *importer) checkLink(dest string) error {
+	var parts []string
+	for _, part := range strings.Split(dest, "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	cur := "/"
+	for i, part := range parts {
+		if part == ".." {
+			cur = path.Dir(cur)
+		} else {
+			cur = path.Join(cur, part)
+		}
+		if i == len(parts)-1 || !isBelow(cur, im.root) || im.dirs[cur] {
+			continue
+		}
+		if im.links[cur] {
+			return ErrSymlinkEscape
+		}
+		if fi, err := im.fs.Lstat(cur); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return ErrSymlinkEscape
+		}
+	}
+	if cur != im.root && !isBelow(cur, im.root) {
+		return ErrSymlinkEscape
+	}
+	return nil
+}
+
+func (im *importer) add(e *importEntry) error {
+	if im.opts.MaxEntries > 0 && len(im.actions) >= im.opts.MaxEntries {
+		return errors.Wrap(ErrImportLimit, "too many entries")
+	}
+	if im.bytes += e.Size; im.opts.MaxBytes > 0 && im.bytes > im.opts.MaxBytes {
+		return errors.Wrap(ErrImportLimit, "too many bytes")
+	}
+	target, err := im.target(e.Name)
+	if err != nil {
+		return err
+	}
+	if target == im.root {
+		return nil
+	}
+	if err := im.checkParents(target); err != nil {
+		return err
+	}
+
+	action := e.ImportAction
+	action.Name = target
+	switch {
+	case e.hardlink:
+		if action.Link, err = im.target(e.Link); err != nil {
+			return err
+		}
+		// only files imported before are copied
+		if link, ok := im.links[action.Link]; !ok || link {
+			return errors.Wrap(ErrUnsafePath, e.Name)
+		}
+	case e.Link != "":
+		dest := e.Link
+		if !path.IsAbs(dest) {
+			dest = path.Dir(target) + "/" + dest
+		}
+		if err := im.checkLink(dest); err != nil {
+			return errors.Wrap(err, e.Name)
+		}
+	}
+	im.actions = append(im.actions, action)
+	if e.Mode.IsDir() {
+		im.dirs[target] = true
+	} else {
+		delete(im.dirs, target)
+		im.links[target] = e.Link != "" && !e.hardlink
+	}
+	if im.opts.DryRun {
+		return nil
+	}
+	return im.write(e, action)
+}
+
+// write creates an entry, replacing what was there.
+func (im *importer) write(e *importEntry, action ImportAction) error {
+	fs, name := im.fs, action.Name
+	if e.Mode.IsDir() {
+		// never create the directory through an existing symlink
+		if fi, err := fs.Lstat(name); err == nil && !fi.IsDir() {
+			if err := fs.Remove(name); err != nil {
+				return err
+			}
+		}
+		return fs.MkdirAll(name, defaultDirectoryMode)
+	}
+	if fi, err := fs.Lstat(name); err == nil && (!fi.Mode().IsRegular() || e.Link != "" && !e.hardlink) {
+		// never write through an existing symlink
+		if err := fs.Remove(name); err != nil {
+			return err
+		}
+	}
+	if e.Link != "" && !e.hardlink {
+		if err := fs.MkdirAll(path.Dir(name), defaultDirectoryMode); err != nil {
+			return err
+		}
+		return fs.Symlink(e.Link, name)
+	}
+
+	var in io.Reader
+	if e.hardlink {
+		f, err := fs.Open(action.Link)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+		if im.opts.MaxBytes > 0 {
+			in = io.LimitReader(f, im.opts.MaxBytes-im.bytes+1)
+		}
+	} else {
+		rc, err := e.open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		in = rc
+	}
+	out, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, defaultCreateMode)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if e.hardlink {
+		// the size of hard links is only known once copied
+		if im.bytes += n; im.opts.MaxBytes > 0 && im.bytes > im.opts.MaxBytes {
+			return errors.Wrap(ErrImportLimit, "too many bytes")
+		}
+	}
+	return im.change(name, e.Mode, e.ModTime)
+}
+
+// change sets the mode and times of name when the filesystem allows it.
+func (im *importer) change(name string, mode os.FileMode, modTime time.Time) error {
+	change, ok := im.fs.(billy.Change)
+	if !ok {
+		return nil
+	}
+	if err := change.Chmod(name, mode.Perm()); err != nil {
+		return err
+	}
+	if modTime.IsZero() {
+		return nil
+	}
+	return change.Chtimes(name, modTime, modTime)
+}
+
+// finish sets the modes and times of the directories once their content is
+// written, deepest first.
+func (im *importer) finish() error {
+	if im.opts.DryRun {
+		return nil
+	}
+	for i := len(im.actions) - 1; i >= 0; i-- {
+		if a := im.actions[i]; a.Mode.IsDir() {
+			// the directory may have been replaced by a later entry
+			if fi, err := im.fs.Lstat(a.Name); err != nil || !fi.IsDir() {
+				continue
+			}
+			if err := im.change(a.Name, a.Mode, a.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
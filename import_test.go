@@ -0,0 +1,177 @@
+package afero
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+func testImportTar(entries ...*tar.Header) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range entries {
+		tw.WriteHeader(hdr)
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write(bytes.Repeat([]byte("x"), int(hdr.Size)))
+		}
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func TestImportRoundTrip(t *testing.T) {
+	for _, format := range []ArchiveFormat{TarGzipArchive, ZipArchive} {
+		var buf bytes.Buffer
+		// MemMapFs has no symlinks
+		if err := Export(testExportTree(t), "/", &buf, ExportOptions{Format: format, Exclude: []string{"run"}}); err != nil {
+			t.Error("Error exporting tree: ", err)
+			return
+		}
+		fs := New(afero.NewMemMapFs(), "/", false)
+		actions, err := Import(fs, "/", &buf, ImportOptions{Format: format})
+		if err != nil {
+			t.Error("Error importing archive: ", err)
+			return
+		}
+		if len(actions) != 6 {
+			t.Error("Unexpected actions: ", actions)
+		}
+
+		f, err := fs.Open("/a/notes.txt")
+		if err != nil {
+			t.Error("Error opening imported file: ", err)
+			return
+		}
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+		if string(data) != "notes" {
+			t.Error("Unexpected content: ", string(data))
+		}
+		for name, mode := range map[string]os.FileMode{"/a/script": 0755, "/a/notes.txt": 0600, "/a": os.ModeDir | 0755} {
+			if fi, err := fs.Stat(name); err != nil || fi.Mode() != mode || !fi.ModTime().Equal(exportModTime) {
+				t.Error("Mode or time of ", name, " was not set: ", fi, err)
+			}
+		}
+	}
+}
+
+func TestImportUnsafe(t *testing.T) {
+	tests := map[string]struct {
+		entries []*tar.Header
+		err     error
+	}{
+		"slip": {[]*tar.Header{
+			{Typeflag: tar.TypeReg, Name: "dir/../../evil", Size: 1},
+		}, ErrUnsafePath},
+		"symlink escape": {[]*tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "dir/link", Linkname: "../../etc"},
+		}, ErrSymlinkEscape},
+		"absolute symlink escape": {[]*tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "/etc/passwd"},
+		}, ErrSymlinkEscape},
+		"through symlink": {[]*tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "."},
+			{Typeflag: tar.TypeSymlink, Name: "link/up", Linkname: ".."},
+		}, ErrUnsafePath},
+		"chained symlinks": {[]*tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "a/s", Linkname: "/import"},
+			{Typeflag: tar.TypeSymlink, Name: "a/t", Linkname: "s/../secret"},
+		}, ErrSymlinkEscape},
+		"hard link outside": {[]*tar.Header{
+			{Typeflag: tar.TypeLink, Name: "copy", Linkname: "../secret"},
+		}, ErrUnsafePath},
+		"entries": {[]*tar.Header{
+			{Typeflag: tar.TypeDir, Name: "a/"},
+			{Typeflag: tar.TypeDir, Name: "b/"},
+			{Typeflag: tar.TypeDir, Name: "c/"},
+		}, ErrImportLimit},
+		"bytes": {[]*tar.Header{
+			{Typeflag: tar.TypeReg, Name: "big", Size: 200},
+		}, ErrImportLimit},
+	}
+	for name, test := range tests {
+		dir, err := afero.TempDir(afero.NewOsFs(), tempDir, "import.")
+		if err != nil {
+			t.Fatal("Error creating temp directory: ", err)
+		}
+		base := afero.NewBasePathFs(afero.NewOsFs(), dir)
+		fs := New(base, dir, false)
+		fs.MkdirAll("/import", 0755)
+		data := testImportTar(test.entries...)
+		_, err = Import(fs, "/import", bytes.NewReader(data), ImportOptions{MaxEntries: 2, MaxBytes: 100})
+		if !errors.Is(err, test.err) {
+			t.Error("Unexpected error importing ", name, ": ", err)
+		}
+		if exists(base, "/evil") || exists(base, "/secret") || exists(base, "/import/up") {
+			t.Error("File written outside the import directory: ", name)
+		}
+	}
+}
+
+func TestImportOverExistingSymlink(t *testing.T) {
+	dir, err := afero.TempDir(afero.NewOsFs(), tempDir, "import.")
+	if err != nil {
+		t.Error("Error creating temp directory: ", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	fs := New(afero.NewBasePathFs(afero.NewOsFs(), dir), dir, false)
+	fs.MkdirAll("/outside", 0755)
+	fs.MkdirAll("/import", 0755)
+	if err := fs.Symlink("/outside", "/import/d"); err != nil {
+		t.Error("Error creating symlink: ", err)
+		return
+	}
+
+	data := testImportTar(
+		&tar.Header{Typeflag: tar.TypeDir, Name: "d/", Mode: 0700},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "d/file", Size: 1, Mode: 0644},
+	)
+	if _, err := Import(fs, "/import", bytes.NewReader(data), ImportOptions{}); err != nil {
+		t.Error("Error importing archive: ", err)
+		return
+	}
+	if fi, err := fs.Lstat("/import/d"); err != nil || !fi.IsDir() || fi.Mode().Perm() != 0700 {
+		t.Error("Symlink was not replaced by the directory: ", fi, err)
+	}
+	if fi, err := fs.Stat("/outside"); err != nil || fi.Mode().Perm() != 0755 {
+		t.Error("Mode was set through the symlink: ", fi, err)
+	}
+	if _, err := fs.Stat("/outside/file"); err == nil {
+		t.Error("File was written through the symlink")
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	mem := afero.NewMemMapFs()
+	fs := New(mem, "/", false)
+	data := testImportTar(
+		&tar.Header{Typeflag: tar.TypeDir, Name: "./dir/", Mode: 0700},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "dir/file", Mode: 0644, Size: 10},
+		&tar.Header{Typeflag: tar.TypeLink, Name: "dir/copy", Linkname: "dir/file"},
+	)
+	actions, err := Import(fs, "/", bytes.NewReader(data), ImportOptions{DryRun: true})
+	if err != nil {
+		t.Error("Error importing archive: ", err)
+		return
+	}
+	if len(actions) != 3 || actions[1].Name != "/dir/file" || actions[1].Size != 10 || actions[2].Link != "/dir/file" {
+		t.Error("Unexpected actions: ", actions)
+	}
+	if list, _ := afero.ReadDir(mem, "/"); len(list) != 0 {
+		t.Error("Dry run wrote entries: ", list)
+	}
+
+	if _, err := Import(fs, "/", bytes.NewReader(data), ImportOptions{}); err != nil {
+		t.Error("Error importing archive: ", err)
+		return
+	}
+	if data, err := afero.ReadFile(mem, "/dir/copy"); err != nil || string(data) != "xxxxxxxxxx" {
+		t.Error("Unexpected hard link content: ", string(data), err)
+	}
+}
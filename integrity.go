@@ -0,0 +1,454 @@
+package afero
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+const checksumExt = ".sum"
+
+// ErrIntegrityDisabled is returned by Verify and VerifyAll on a filesystem
+// created without WithIntegrity.
+var ErrIntegrityDisabled = errors.New("Integrity checking is not enabled")
+
+// ErrCorrupted is the error, wrapped in an os.PathError, of reads, closes
+// and verifications of a file whose content no longer matches the checksum
+// recorded when it was written.
+var ErrCorrupted = errors.New("File content does not match its checksum")
+
+// ErrNoChecksum is returned by Verify for files without a recorded checksum,
+// such as those written to the backend directly.
+var ErrNoChecksum = errors.New("No checksum recorded")
+
+// checksum is the manifest record of a file.
+type checksum struct {
+	// Path is the path of the file, relative to the root passed to New.
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// integrity keeps a checksum record per file in a tree mirroring the
+// virtual paths, so directories are moved and removed along with their
+// records. It is shared by every Chroot.
+type integrity struct {
+	fs afero.Fs
+	m  sync.Mutex
+}
+
+func newIntegrity(fs afero.Fs) *integrity {
+	return &integrity{fs: fs}
+}
+
+func (i *integrity) get(virtual string) (*checksum, error) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	data, err := afero.ReadFile(i.fs, virtual+checksumExt)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var sum checksum
+	if err := json.Unmarshal(data, &sum); err != nil {
+		return nil, errors.Wrap(err, "Error reading checksum of "+virtual)
+	}
+	return &sum, nil
+}
+
+func (i *integrity) put(sum checksum) error {
+	data, err := json.Marshal(sum)
+	if err != nil {
+		return err
+	}
+	i.m.Lock()
+	defer i.m.Unlock()
+	if err := i.fs.MkdirAll(path.Dir(sum.Path), defaultDirectoryMode); err != nil {
+		return err
+	}
+	return afero.WriteFile(i.fs, sum.Path+checksumExt, data, defaultCreateMode)
+}
+
+// drop removes the record of virtual, and with tree those below it.
+func (i *integrity) drop(virtual string, tree bool) error {
+	i.m.Lock()
+	defer i.m.Unlock()
+	if err := i.fs.Remove(virtual + checksumExt); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if tree && virtual != "/" {
+		return i.fs.RemoveAll(virtual)
+	}
+	if tree {
+		return removeContent(i.fs, "/")
+	}
+	return nil
+}
+
+// move renames the records of from and those below it to to. They are
+// renamed one by one, as not every backend renames directory contents.
+func (i *integrity) move(from, to string) error {
+	i.m.Lock()
+	defer i.m.Unlock()
+	i.fs.Remove(to + checksumExt)
+	if err := i.fs.RemoveAll(to); err != nil {
+		return err
+	}
+	var records []string
+	err := afero.Walk(i.fs, from, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		records = append(records, p)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := i.fs.Stat(from + checksumExt); err == nil {
+		records = append(records, from+checksumExt)
+	}
+	for _, p := range records {
+		dest := to + strings.TrimPrefix(p, from)
+		if err := i.fs.MkdirAll(path.Dir(dest), defaultDirectoryMode); err != nil {
+			return err
+		}
+		if err := i.fs.Rename(p, dest); err != nil {
+			return err
+		}
+	}
+	return i.fs.RemoveAll(from)
+}
+
+// removeContent removes the entries of the directory name.
+func removeContent(fs afero.Fs, name string) error {
+	entries, err := afero.ReadDir(fs, name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if err := fs.RemoveAll(path.Join(name, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sumFile computes the checksum of the file name of fs.
+func sumFile(fs afero.Fs, name string) (checksum, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return checksum{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return checksum{}, err
+	}
+	return checksum{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// record stores the checksum of the file name, as it is in the backend.
+func (fs *Afero) record(name string) error {
+	sum, err := sumFile(fs.fs, name)
+	if err != nil {
+		return err
+	}
+	sum.Path = fs.virtual(name)
+	return fs.integrity.put(sum)
+}
+
+// recordTree records the checksums of name and every regular file below it,
+// once the operation that wrote them through the backend succeeded.
+func (fs *Afero) recordTree(name string, err *error) {
+	if fs.integrity == nil || *err != nil {
+		return
+	}
+	*err = afero.Walk(fs.fs, name, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		return fs.record(p)
+	})
+}
+
+// dropChecksums removes the records of name once it was removed.
+func (fs *Afero) dropChecksums(name string, tree bool, err *error) {
+	if fs.integrity == nil || *err != nil {
+		return
+	}
+	*err = fs.integrity.drop(fs.virtual(name), tree)
+}
+
+// moveChecksums moves the records of from to to once it was renamed.
+func (fs *Afero) moveChecksums(from, to string, err *error) {
+	if fs.integrity == nil || *err != nil {
+		return
+	}
+	*err = fs.integrity.move(fs.virtual(from), fs.virtual(to))
+}
+
+// corrupted reports whether the file name, with the content summarized by
+// sum, was corrupted. The record is read again, as a write through the
+// filesystem replaces it.
+func (fs *Afero) corrupted(name string, expect *checksum, sum checksum) bool {
+	if sum.Size == expect.Size && sum.SHA256 == expect.SHA256 {
+		return false
+	}
+	current, err := fs.integrity.get(fs.virtual(name))
+	if err != nil || current == nil || *current != *expect {
+		return false
+	}
+	if fs.Debug {
+		log.Println("Corrupted ", name, ": ", sum.SHA256, ", expected: ", expect.SHA256)
+	}
+	return true
+}
+
+// Verify compares the content of the named file with the checksum recorded
+// when it was last written through the filesystem, returning ErrCorrupted
+// wrapped in an os.PathError if it differs.
+func (fs *Afero) Verify(name string) error {
+	if fs.Debug {
+		log.Println("Verify ", name)
+	}
+	if fs.integrity == nil {
+		return ErrIntegrityDisabled
+	}
+	expect, err := fs.integrity.get(fs.virtual(name))
+	if err != nil {
+		return err
+	}
+	if expect == nil {
+		return &os.PathError{Op: "verify", Path: name, Err: ErrNoChecksum}
+	}
+	sum, err := sumFile(fs.fs, name)
+	if err != nil {
+		return err
+	}
+	if fs.corrupted(name, expect, sum) {
+		return &os.PathError{Op: "verify", Path: name, Err: ErrCorrupted}
+	}
+	return nil
+}
+
+// VerifyAll verifies every file of the filesystem with a recorded checksum
+// and returns the paths of those corrupted, including recorded files that
+// no longer exist.
+func (fs *Afero) VerifyAll() ([]string, error) {
+	if fs.Debug {
+		log.Println("VerifyAll")
+	}
+	if fs.integrity == nil {
+		return nil, ErrIntegrityDisabled
+	}
+	fs.integrity.m.Lock()
+	var records []string
+	err := afero.Walk(fs.integrity.fs, fs.virtual("/"), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() && strings.HasSuffix(p, checksumExt) {
+			records = append(records, strings.TrimSuffix(p, checksumExt))
+		}
+		return nil
+	})
+	fs.integrity.m.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var corrupted []string
+	for _, virtual := range records {
+		name, ok := fs.local(virtual)
+		if !ok {
+			continue
+		}
+		err := fs.Verify(name)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrCorrupted), os.IsNotExist(err):
+			corrupted = append(corrupted, name)
+		case errors.Is(err, ErrNoChecksum):
+			// removed while verifying
+		default:
+			return corrupted, err
+		}
+	}
+	return corrupted, nil
+}
+
+// checkedFile hashes what is written to a file to record its checksum on
+// Close, or what is read from it in order to verify it at the end of the
+// file. Writes not in order are hashed again from the backend.
+type checkedFile struct {
+	afero.File
+	fs      *Afero
+	name    string
+	expect  *checksum // nil when writing
+	h       hash.Hash
+	n       int64
+	inOrder bool
+	checked bool
+	// changed is set once the content no longer matches the old record,
+	// failed once a write or truncate failed and the content is unknown.
+	changed bool
+	failed  bool
+}
+
+// newCheckedFile wraps f, opened with flag, closing it on error. Files only
+// read are checked when they have a checksum. The record of a file opened
+// for writing is kept until its content changes.
+func (fs *Afero) newCheckedFile(f afero.File, name string, flag int) (afero.File, error) {
+	expect, err := fs.integrity.get(fs.virtual(name))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		if expect == nil {
+			return f, nil
+		}
+		return &checkedFile{File: f, fs: fs, name: name, expect: expect, h: sha256.New(), inOrder: true}, nil
+	}
+	// a file truncated at open has already changed
+	if expect != nil && flag&os.O_TRUNC != 0 {
+		err = fs.integrity.drop(fs.virtual(name), false)
+		expect = nil
+	}
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = f.Stat()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &checkedFile{File: f, fs: fs, name: name, h: sha256.New(), inOrder: fi.Size() == 0, changed: expect == nil}, nil
+}
+
+func (f *checkedFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	if f.expect == nil {
+		f.inOrder = false
+		return n, err
+	}
+	if f.inOrder {
+		f.h.Write(p[:n])
+		f.n += int64(n)
+	}
+	if err == io.EOF && f.inOrder && !f.checked {
+		f.checked = true
+		if f.fs.corrupted(f.name, f.expect, f.sum()) {
+			return n, &os.PathError{Op: "read", Path: f.name, Err: ErrCorrupted}
+		}
+	}
+	return n, err
+}
+
+func (f *checkedFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.expect == nil {
+		f.inOrder = false
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *checkedFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.File.Seek(offset, whence)
+	if err != nil || pos != f.n {
+		f.inOrder = false
+	}
+	return pos, err
+}
+
+func (f *checkedFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if f.inOrder {
+		f.h.Write(p[:n])
+		f.n += int64(n)
+	}
+	return n, f.modified(n > 0, err)
+}
+
+func (f *checkedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.inOrder = false
+	n, err := f.File.WriteAt(p, off)
+	return n, f.modified(n > 0, err)
+}
+
+func (f *checkedFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *checkedFile) Truncate(size int64) error {
+	f.inOrder = false
+	err := f.File.Truncate(size)
+	return f.modified(err == nil, err)
+}
+
+// modified drops the old record the first time the content changed, and
+// notes a failed write so that the file is left unrecorded.
+func (f *checkedFile) modified(changed bool, err error) error {
+	if err != nil {
+		f.failed = true
+	}
+	if !changed || f.changed {
+		return err
+	}
+	f.changed = true
+	if derr := f.fs.integrity.drop(f.fs.virtual(f.name), false); derr != nil && err == nil {
+		f.failed = true
+		return derr
+	}
+	return err
+}
+
+func (f *checkedFile) sum() checksum {
+	return checksum{Size: f.n, SHA256: hex.EncodeToString(f.h.Sum(nil))}
+}
+
+// Close records the checksum of a written file, or verifies a file read to
+// its end without reaching EOF. Nothing is recorded if a write or the Close
+// of the backend failed.
+func (f *checkedFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	if f.expect != nil {
+		if f.inOrder && !f.checked && f.n == f.expect.Size {
+			f.checked = true
+			if f.fs.corrupted(f.name, f.expect, f.sum()) {
+				return &os.PathError{Op: "close", Path: f.name, Err: ErrCorrupted}
+			}
+		}
+		return nil
+	}
+	if f.failed || !f.changed {
+		return nil
+	}
+	if !f.inOrder {
+		return f.fs.record(f.name)
+	}
+	sum := f.sum()
+	sum.Path = f.fs.virtual(f.name)
+	return f.fs.integrity.put(sum)
+}
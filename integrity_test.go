@@ -0,0 +1,178 @@
+package afero
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+func TestIntegrity(t *testing.T) {
+	backend := afero.NewMemMapFs()
+	fs := New(backend, "/", false, WithIntegrity(afero.NewMemMapFs())).(*Afero)
+	util.WriteFile(fs, "/a/one", []byte("one"), 0644)
+	util.WriteFile(fs, "/a/two", []byte("two"), 0644)
+	util.WriteFile(fs, "/b", []byte("b"), 0644)
+
+	f, _ := fs.Open("/a/one")
+	if data, err := ioutil.ReadAll(f); err != nil || string(data) != "one" {
+		t.Error("Error reading an intact file: ", string(data), err)
+	}
+	f.Close()
+	if corrupted, err := fs.VerifyAll(); err != nil || len(corrupted) != 0 {
+		t.Error("Intact files reported corrupted: ", corrupted, err)
+	}
+
+	// corrupt the backend behind the filesystem's back
+	afero.WriteFile(backend, "/a/one", []byte("One"), 0644)
+	f, _ = fs.Open("/a/one")
+	if _, err := ioutil.ReadAll(f); !errors.Is(err, ErrCorrupted) {
+		t.Error("Corruption was not detected at EOF: ", err)
+	}
+	f.Close()
+	f, _ = fs.Open("/a/one")
+	io.ReadFull(f, make([]byte, 3))
+	if err := f.Close(); !errors.Is(err, ErrCorrupted) {
+		t.Error("Corruption was not detected on Close: ", err)
+	}
+	if err := fs.Verify("/a/one"); !errors.Is(err, ErrCorrupted) {
+		t.Error("Corruption was not detected by Verify: ", err)
+	}
+	backend.Remove("/b")
+	corrupted, err := fs.VerifyAll()
+	if err != nil || len(corrupted) != 2 || corrupted[0] != "/a/one" || corrupted[1] != "/b" {
+		t.Error("Unexpected corrupted files: ", corrupted, err)
+	}
+
+	// a partial read is not verified
+	f, _ = fs.Open("/a/one")
+	f.Read(make([]byte, 1))
+	if err := f.Close(); err != nil {
+		t.Error("Partial read was verified: ", err)
+	}
+
+	// writing through the filesystem records the new content
+	util.WriteFile(fs, "/a/one", []byte("fixed"), 0644)
+	if err := fs.Verify("/a/one"); err != nil {
+		t.Error("Rewritten file failed verification: ", err)
+	}
+	afero.WriteFile(backend, "/unknown", nil, 0644)
+	if err := fs.Verify("/unknown"); !errors.Is(err, ErrNoChecksum) {
+		t.Error("Unexpected error verifying an unrecorded file: ", err)
+	}
+}
+
+func TestIntegrityChanges(t *testing.T) {
+	fs := New(afero.NewMemMapFs(), "/", false, WithIntegrity(afero.NewMemMapFs())).(*Afero)
+	util.WriteFile(fs, "/a/one", []byte("one"), 0644)
+
+	// writes out of order are hashed again on Close
+	f, _ := fs.OpenFile("/a/one", os.O_RDWR, 0)
+	f.Seek(1, io.SeekStart)
+	f.Write([]byte("NE"))
+	f.Close()
+	if err := fs.Verify("/a/one"); err != nil {
+		t.Error("Overwritten file failed verification: ", err)
+	}
+
+	chroot, _ := fs.Chroot("/a")
+	if err := chroot.Rename("/one", "/moved"); err != nil {
+		t.Error("Error renaming: ", err)
+		return
+	}
+	if err := chroot.(*Afero).Verify("/moved"); err != nil {
+		t.Error("Checksum did not follow the rename: ", err)
+	}
+	fs.Rename("/a", "/c")
+	if err := fs.Verify("/c/moved"); err != nil {
+		t.Error("Checksum did not follow the directory rename: ", err)
+	}
+	fs.RemoveAll("/c")
+	util.WriteFile(New(fs.fs, "/", false), "/c/moved", []byte("other"), 0644)
+	if corrupted, err := fs.VerifyAll(); err != nil || len(corrupted) != 0 {
+		t.Error("Checksums of removed files were kept: ", corrupted, err)
+	}
+
+	if err := New(afero.NewMemMapFs(), "/", false).(*Afero).Verify("/"); err != ErrIntegrityDisabled {
+		t.Error("Unexpected error without integrity: ", err)
+	}
+}
+
+func TestIntegrityWriteOpen(t *testing.T) {
+	fs := New(afero.NewMemMapFs(), "/", false, WithIntegrity(afero.NewMemMapFs())).(*Afero)
+	util.WriteFile(fs, "/file", []byte("content"), 0644)
+
+	// the record is kept until the first write
+	w, err := fs.OpenFile("/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Error("Error opening file for writing: ", err)
+		return
+	}
+	if err := fs.Verify("/file"); err != nil {
+		t.Error("Record was dropped at open: ", err)
+	}
+	w.Write([]byte("C"))
+	if err := fs.Verify("/file"); !errors.Is(err, ErrNoChecksum) {
+		t.Error("Record was kept after a write: ", err)
+	}
+	w.Close()
+	if err := fs.Verify("/file"); err != nil {
+		t.Error("Written file failed verification: ", err)
+	}
+
+	// a file opened for writing but left unchanged keeps its record
+	w, _ = fs.OpenFile("/file", os.O_WRONLY|os.O_APPEND, 0)
+	w.Close()
+	if err := fs.Verify("/file"); err != nil {
+		t.Error("Unchanged file failed verification: ", err)
+	}
+	w, _ = fs.OpenFile("/file", os.O_WRONLY|os.O_TRUNC, 0)
+	w.Close()
+	if err := fs.Verify("/file"); err != nil {
+		t.Error("Truncated file failed verification: ", err)
+	}
+}
+
+func TestIntegrityWriteErrors(t *testing.T) {
+	backend := &countingFs{Fs: afero.NewMemMapFs()}
+	fs := New(backend, "/", false, WithIntegrity(afero.NewMemMapFs())).(*Afero)
+	util.WriteFile(fs, "/file", []byte("content"), 0644)
+
+	// a write failing before changing anything leaves the record in place
+	backend.writeErr = errors.New("write failed")
+	w, _ := fs.OpenFile("/file", os.O_RDWR, 0)
+	if _, err := w.Write([]byte("other")); err == nil {
+		t.Error("Write did not fail")
+	}
+	w.Close()
+	if err := fs.Verify("/file"); err != nil {
+		t.Error("Record of an unchanged file was lost: ", err)
+	}
+
+	// nor is a file recorded after a failed write
+	backend.writeErr = nil
+	w, _ = fs.OpenFile("/file", os.O_RDWR, 0)
+	w.Write([]byte("C"))
+	backend.writeErr = errors.New("write failed")
+	w.Write([]byte("O"))
+	w.Close()
+	if err := fs.Verify("/file"); !errors.Is(err, ErrNoChecksum) {
+		t.Error("File was recorded after a failed write: ", err)
+	}
+
+	// or after the Close of the backend failed
+	backend.writeErr = nil
+	backend.closeErr = errors.New("close failed")
+	w, _ = fs.Create("/other")
+	w.Write([]byte("other"))
+	if err := w.Close(); err != backend.closeErr {
+		t.Error("Unexpected error closing: ", err)
+	}
+	if err := fs.Verify("/other"); !errors.Is(err, ErrNoChecksum) {
+		t.Error("File was recorded after a failed Close: ", err)
+	}
+}
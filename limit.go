@@ -0,0 +1,120 @@
+package afero
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// clock is the time source of rate limits, replaced in tests.
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// tokenBucket refills at rate tokens per second up to burst. Takes larger
+// than the available tokens are allowed and put the bucket into debt, which
+// the caller waits out, so requests of any size make progress.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	clock  clock
+	m      sync.Mutex
+}
+
+// newTokenBucket returns nil, which never waits, when rate is not positive.
+func newTokenBucket(rate, burst float64, c clock) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: c.Now(), clock: c}
+}
+
+// wait takes n tokens, sleeping until the bucket is out of debt.
+func (b *tokenBucket) wait(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.m.Lock()
+	now := b.clock.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.m.Unlock()
+
+	if delay > 0 {
+		b.clock.Sleep(delay)
+	}
+}
+
+// limits are the rate limits of a filesystem, shared by every Chroot.
+type limits struct {
+	bytes *tokenBucket
+	ops   *tokenBucket
+}
+
+// limitsFor returns the limits of fs, creating them if needed.
+func (fs *Afero) limitsFor() *limits {
+	if fs.limits == nil {
+		fs.limits = &limits{}
+	}
+	return fs.limits
+}
+
+// limitOp waits for the operation rate limit, if any.
+func (fs *Afero) limitOp() {
+	if fs.limits != nil {
+		fs.limits.ops.wait(1)
+	}
+}
+
+// limitedFile applies a bandwidth limit to reads and writes.
+type limitedFile struct {
+	afero.File
+	bytes *tokenBucket
+}
+
+func (f *limitedFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.bytes.wait(n)
+	return n, err
+}
+
+func (f *limitedFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	f.bytes.wait(n)
+	return n, err
+}
+
+func (f *limitedFile) Write(p []byte) (int, error) {
+	f.bytes.wait(len(p))
+	return f.File.Write(p)
+}
+
+func (f *limitedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.bytes.wait(len(p))
+	return f.File.WriteAt(p, off)
+}
+
+func (f *limitedFile) WriteString(s string) (int, error) {
+	f.bytes.wait(len(s))
+	return f.File.WriteString(s)
+}
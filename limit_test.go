@@ -0,0 +1,131 @@
+package afero
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// fakeClock advances only when slept on.
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.slept += d
+}
+
+func useFakeClock(b *tokenBucket, c *fakeClock) {
+	b.clock = c
+	b.last = c.Now()
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	c := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	fs := New(afero.NewMemMapFs(), "/", false, WithBandwidthLimit(100, 100)).(*Afero)
+	useFakeClock(fs.limits.bytes, c)
+
+	f, err := fs.Create("/file")
+	if err != nil {
+		t.Error("Error creating file: ", err)
+		return
+	}
+	_, err = f.Write(bytes.Repeat([]byte("x"), 300))
+	f.Close()
+	if err != nil {
+		t.Error("Error writing file: ", err)
+		return
+	}
+	// 100 bytes of burst, then 200 bytes at 100 per second
+	if c.slept != 2*time.Second {
+		t.Error("Write was not limited to the expected rate, slept: ", c.slept)
+	}
+
+	f, err = fs.Open("/file")
+	if err != nil {
+		t.Error("Error opening file: ", err)
+		return
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil || len(data) != 300 {
+		t.Error("Error reading file: ", err)
+		return
+	}
+	if c.slept != 5*time.Second {
+		t.Error("Read was not limited to the expected rate, slept: ", c.slept)
+	}
+}
+
+func TestOpRateLimit(t *testing.T) {
+	c := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	mem := afero.NewMemMapFs()
+	if err := mem.MkdirAll("/dir", defaultDirectoryMode); err != nil {
+		t.Error("Error creating directory: ", err)
+		return
+	}
+	fs := New(mem, "/", false, WithOpRateLimit(10, 2)).(*Afero)
+	useFakeClock(fs.limits.ops, c)
+
+	for i := 0; i < 2; i++ {
+		fs.Stat("/dir")
+	}
+	if c.slept != 0 {
+		t.Error("Calls within the burst were delayed: ", c.slept)
+	}
+
+	chroot, err := fs.Chroot("/dir")
+	if err != nil {
+		t.Error("Error getting chroot: ", err)
+		return
+	}
+	if c.slept != 100*time.Millisecond {
+		t.Error("Call past the burst was not delayed, slept: ", c.slept)
+	}
+
+	// the chroot shares the limit
+	chroot.ReadDir("/")
+	if c.slept != 200*time.Millisecond {
+		t.Error("Chroot does not share the rate limit, slept: ", c.slept)
+	}
+}
+
+func TestNoLimit(t *testing.T) {
+	fs := New(afero.NewMemMapFs(), "/", false, WithBandwidthLimit(0, 0), WithOpRateLimit(-1, 0)).(*Afero)
+	if fs.limits.bytes != nil || fs.limits.ops != nil {
+		t.Error("Rates of 0 or less were not taken as no limit")
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		f, err := fs.Create("/file")
+		if err != nil {
+			done <- err
+			return
+		}
+		_, err = f.Write(bytes.Repeat([]byte("x"), 300))
+		f.Close()
+		if err == nil {
+			_, err = fs.Stat("/file")
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Error writing file: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Calls without a limit blocked")
+	}
+}
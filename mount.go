@@ -0,0 +1,537 @@
+package afero
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/spf13/afero/mem"
+)
+
+// MountFs is an afero.Fs composed of other filesystems mounted at virtual
+// path prefixes. Each path is served by the mount with the longest matching
+// prefix, and directories leading up to mount points are synthesized. Mounted
+// filesystems are always given absolute paths, so OS directories should be
+// mounted through an afero.BasePathFs.
+type MountFs struct {
+	mounts map[string]afero.Fs
+	m      sync.RWMutex
+}
+
+// NewMountFs returns a MountFs with the given filesystems mounted at their
+// map keys.
+func NewMountFs(mounts map[string]afero.Fs) *MountFs {
+	fs := &MountFs{mounts: map[string]afero.Fs{}}
+	for prefix, mounted := range mounts {
+		fs.mounts[mountPath(prefix)] = mounted
+	}
+	return fs
+}
+
+// NewMount returns a billy filesystem over a MountFs of the given mounts.
+func NewMount(mounts map[string]afero.Fs, root string, debug bool) billy.Filesystem {
+	return New(NewMountFs(mounts), root, debug)
+}
+
+// Mount mounts fs at prefix, failing if something is already mounted there.
+func (m *MountFs) Mount(prefix string, fs afero.Fs) error {
+	prefix = mountPath(prefix)
+	m.m.Lock()
+	defer m.m.Unlock()
+	if _, ok := m.mounts[prefix]; ok {
+		return errors.New("Cannot mount, " + prefix + " is already a mount point")
+	}
+	m.mounts[prefix] = fs
+	return nil
+}
+
+// Unmount removes the mount at prefix.
+func (m *MountFs) Unmount(prefix string) error {
+	prefix = mountPath(prefix)
+	m.m.Lock()
+	defer m.m.Unlock()
+	if _, ok := m.mounts[prefix]; !ok {
+		return errors.New("Cannot unmount, " + prefix + " is not a mount point")
+	}
+	delete(m.mounts, prefix)
+	return nil
+}
+
+// Mounts returns the mount points, sorted.
+func (m *MountFs) Mounts() []string {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	list := make([]string, 0, len(m.mounts))
+	for prefix := range m.mounts {
+		list = append(list, prefix)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Name returns the name of this filesystem.
+func (m *MountFs) Name() string {
+	return "MountFs"
+}
+
+// Create creates or truncates the named file on its mount.
+func (m *MountFs) Create(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, defaultCreateMode)
+}
+
+// Mkdir creates a directory on its mount.
+func (m *MountFs) Mkdir(name string, perm os.FileMode) error {
+	name = mountPath(name)
+	if m.isMountDir(name) {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	fs, rel, _, err := m.route("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return fs.Mkdir(rel, perm)
+}
+
+// MkdirAll creates a directory path and all parents that do not exist yet.
+// Synthesized directories are treated as existing.
+func (m *MountFs) MkdirAll(p string, perm os.FileMode) error {
+	p = mountPath(p)
+	if m.isMountDir(p) {
+		return nil
+	}
+	fs, rel, _, err := m.route("mkdir", p)
+	if err != nil {
+		return err
+	}
+	return fs.MkdirAll(rel, perm)
+}
+
+// Open opens the named file for reading.
+func (m *MountFs) Open(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file on its mount. Directory handles list the
+// mount points below them alongside the mounted entries.
+func (m *MountFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	name = mountPath(name)
+	fs, rel, _, err := m.route("open", name)
+	if err != nil {
+		if !m.isMountDir(name) {
+			return nil, err
+		}
+		return &mountDir{File: mem.NewReadOnlyFileHandle(mem.CreateDir(name)), fs: m, name: name}, nil
+	}
+
+	f, err := fs.OpenFile(rel, flag, perm)
+	if err != nil {
+		if os.IsNotExist(err) && m.isMountDir(name) {
+			return &mountDir{File: mem.NewReadOnlyFileHandle(mem.CreateDir(name)), fs: m, name: name}, nil
+		}
+		return nil, err
+	}
+	if st, err := f.Stat(); err == nil && st.IsDir() {
+		return &mountDir{File: f, fs: m, name: name}, nil
+	}
+	return &mountFile{File: f, name: name}, nil
+}
+
+// Remove removes the named file or empty directory. Mount points and the
+// directories leading to them cannot be removed.
+func (m *MountFs) Remove(name string) error {
+	name = mountPath(name)
+	if m.isMountDir(name) || m.isMountPoint(name) {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+	fs, rel, _, err := m.route("remove", name)
+	if err != nil {
+		return err
+	}
+	return fs.Remove(rel)
+}
+
+// RemoveAll removes path and any children it contains, including the
+// contents of mounts below it. The mount points themselves remain, and no
+// mount is added or removed until it is done.
+func (m *MountFs) RemoveAll(p string) error {
+	p = mountPath(p)
+	m.m.RLock()
+	defer m.m.RUnlock()
+	for prefix, fs := range m.mounts {
+		if prefix == p || isBelow(prefix, p) {
+			if err := removeContent(fs, "/"); err != nil {
+				return err
+			}
+		}
+	}
+	if _, ok := m.mounts[p]; ok {
+		return nil
+	}
+	// synthesized directories may have content on the mount below them too
+	fs, rel, _, err := m.routeLocked("remove", p)
+	if err != nil {
+		return nil
+	}
+	return fs.RemoveAll(rel)
+}
+
+// Rename moves oldname to newname. Moves between mounts copy the tree aside
+// on the new mount, move it into place and then remove the source, undoing
+// the move if any step fails.
+func (m *MountFs) Rename(oldname, newname string) error {
+	oldname = mountPath(oldname)
+	newname = mountPath(newname)
+	if oldname == newname {
+		return nil
+	}
+	if m.isMountDir(oldname) || m.isMountPoint(oldname) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EBUSY}
+	}
+	fromFs, from, fromMount, err := m.route("rename", oldname)
+	if err != nil {
+		return err
+	}
+	toFs, to, toMount, err := m.route("rename", newname)
+	if err != nil {
+		return err
+	}
+	if fromMount == toMount {
+		return renameVerified(fromFs, from, to)
+	}
+
+	fi, _, err := lstat(fromFs, from)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if fi.IsDir() && isBelow(newname, oldname) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EINVAL}
+	}
+	tfi, _, terr := lstat(toFs, to)
+	if terr == nil {
+		if err := checkReplace(toFs, to, fi, tfi); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+	}
+
+	if err := toFs.MkdirAll(stagingDir, defaultDirectoryMode); err != nil {
+		return err
+	}
+	defer toFs.Remove(stagingDir)
+	id := newID(time.Now())
+	tmp, backup := path.Join(stagingDir, id), path.Join(stagingDir, id+".old")
+	if err := copyTree(fromFs, from, toFs, tmp); err != nil {
+		toFs.RemoveAll(tmp)
+		return err
+	}
+	if terr == nil {
+		if err := toFs.Rename(to, backup); err != nil {
+			toFs.RemoveAll(tmp)
+			return err
+		}
+	}
+	if err = renameVerified(toFs, tmp, to); err == nil {
+		err = fromFs.RemoveAll(from)
+		// put back what was removed of a source that could not be removed
+		if _, _, lerr := lstat(fromFs, from); lerr == nil {
+			if err == nil {
+				err = &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EPERM}
+			}
+			if rerr := restoreTree(toFs, to, fromFs, from); rerr != nil {
+				return errors.Wrap(err, "Error restoring "+oldname+": "+rerr.Error())
+			}
+		} else {
+			err = nil
+		}
+	}
+	if err != nil {
+		toFs.RemoveAll(tmp)
+		toFs.RemoveAll(to)
+		if terr == nil {
+			toFs.Rename(backup, to)
+		}
+		return err
+	}
+	if terr == nil {
+		return toFs.RemoveAll(backup)
+	}
+	return nil
+}
+
+// checkReplace returns the error of rename(2) replacing to, described by
+// tfi, with an entry described by fi: directories only replace empty
+// directories, and other entries anything but a directory.
+func checkReplace(fs afero.Fs, to string, fi, tfi os.FileInfo) error {
+	switch {
+	case fi.IsDir() && !tfi.IsDir():
+		return syscall.ENOTDIR
+	case !fi.IsDir() && tfi.IsDir():
+		return syscall.EISDIR
+	case tfi.IsDir():
+		entries, err := afero.ReadDir(fs, to)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+	return nil
+}
+
+// Stat returns a FileInfo describing the named file.
+func (m *MountFs) Stat(name string) (os.FileInfo, error) {
+	name = mountPath(name)
+	fs, rel, _, err := m.route("stat", name)
+	if err == nil {
+		var fi os.FileInfo
+		fi, err = fs.Stat(rel)
+		if err == nil {
+			return mountInfo(fi, name), nil
+		}
+	}
+	if m.isMountDir(name) {
+		return mem.GetFileInfo(mem.CreateDir(name)), nil
+	}
+	return nil, err
+}
+
+// LstatIfPossible implements afero.Lstater.
+func (m *MountFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	name = mountPath(name)
+	fs, rel, _, err := m.route("lstat", name)
+	if err == nil {
+		var fi os.FileInfo
+		var ok bool
+		fi, ok, err = lstat(fs, rel)
+		if err == nil {
+			return mountInfo(fi, name), ok, nil
+		}
+	}
+	if m.isMountDir(name) {
+		return mem.GetFileInfo(mem.CreateDir(name)), false, nil
+	}
+	return nil, false, err
+}
+
+// SymlinkIfPossible implements afero.Linker, creating the link on the mount
+// of newname.
+func (m *MountFs) SymlinkIfPossible(oldname, newname string) error {
+	newname = mountPath(newname)
+	fs, rel, _, err := m.route("symlink", newname)
+	if err != nil {
+		return err
+	}
+	if linker, ok := fs.(afero.Linker); ok {
+		return linker.SymlinkIfPossible(oldname, rel)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+}
+
+// ReadlinkIfPossible implements afero.LinkReader.
+func (m *MountFs) ReadlinkIfPossible(name string) (string, error) {
+	name = mountPath(name)
+	fs, rel, _, err := m.route("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if reader, ok := fs.(afero.LinkReader); ok {
+		return reader.ReadlinkIfPossible(rel)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+}
+
+// Chmod changes the mode of the named file on its mount.
+func (m *MountFs) Chmod(name string, mode os.FileMode) error {
+	name = mountPath(name)
+	fs, rel, _, err := m.route("chmod", name)
+	if err != nil {
+		return err
+	}
+	return fs.Chmod(rel, mode)
+}
+
+// Chtimes changes the access and modification times of the named file on its
+// mount.
+func (m *MountFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	name = mountPath(name)
+	fs, rel, _, err := m.route("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return fs.Chtimes(rel, atime, mtime)
+}
+
+// route finds the mount with the longest prefix of name, returning it with
+// the path relative to that mount and the mount point.
+func (m *MountFs) route(op, name string) (afero.Fs, string, string, error) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	return m.routeLocked(op, name)
+}
+
+// routeLocked is route for callers holding the lock.
+func (m *MountFs) routeLocked(op, name string) (afero.Fs, string, string, error) {
+	for prefix := name; ; prefix = path.Dir(prefix) {
+		if fs, ok := m.mounts[prefix]; ok {
+			return fs, mountPath(strings.TrimPrefix(name, prefix)), prefix, nil
+		}
+		if prefix == "/" {
+			return nil, "", "", &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+	}
+}
+
+// isMountPoint reports whether something is mounted exactly at name.
+func (m *MountFs) isMountPoint(name string) bool {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	_, ok := m.mounts[name]
+	return ok
+}
+
+// isMountDir reports whether name is a synthesized directory, i.e. a proper
+// parent of a mount point.
+func (m *MountFs) isMountDir(name string) bool {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	for prefix := range m.mounts {
+		if isBelow(prefix, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// mountChildren returns the names of the entries directly below dir that lead
+// to mount points.
+func (m *MountFs) mountChildren(dir string) []string {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	seen := map[string]bool{}
+	var names []string
+	for prefix := range m.mounts {
+		if !isBelow(prefix, dir) {
+			continue
+		}
+		child := strings.TrimPrefix(strings.TrimPrefix(prefix, dir), "/")
+		if i := strings.Index(child, "/"); i >= 0 {
+			child = child[:i]
+		}
+		if !seen[child] {
+			seen[child] = true
+			names = append(names, child)
+		}
+	}
+	return names
+}
+
+// mountDir is a directory handle that adds synthesized entries for the mount
+// points below it.
+type mountDir struct {
+	afero.File
+	fs      *MountFs
+	name    string
+	entries []os.FileInfo
+	read    bool
+}
+
+func (d *mountDir) Name() string {
+	return d.name
+}
+
+func (d *mountDir) Stat() (os.FileInfo, error) {
+	fi, err := d.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return mountInfo(fi, d.name), nil
+}
+
+func (d *mountDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.read {
+		entries := map[string]os.FileInfo{}
+		list, err := d.File.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range list {
+			entries[fi.Name()] = fi
+		}
+		// mount points shadow whatever the parent mount holds at that name
+		for _, child := range d.fs.mountChildren(d.name) {
+			fi, err := d.fs.Stat(path.Join(d.name, child))
+			if err != nil {
+				return nil, err
+			}
+			entries[child] = fi
+		}
+
+		d.entries = make([]os.FileInfo, 0, len(entries))
+		for _, fi := range entries {
+			d.entries = append(d.entries, fi)
+		}
+		sort.Slice(d.entries, func(i, j int) bool { return d.entries[i].Name() < d.entries[j].Name() })
+		d.read = true
+	}
+
+	return nextEntries(&d.entries, count)
+}
+
+func (d *mountDir) Readdirnames(n int) ([]string, error) {
+	list, err := d.Readdir(n)
+	names := make([]string, len(list))
+	for i, fi := range list {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+// mountFile reports its virtual path as its name.
+type mountFile struct {
+	afero.File
+	name string
+}
+
+func (f *mountFile) Name() string {
+	return f.name
+}
+
+// namedInfo overrides the name of a FileInfo, mounted roots report the name
+// of their mount point.
+type namedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi namedInfo) Name() string {
+	return fi.name
+}
+
+func mountInfo(fi os.FileInfo, name string) os.FileInfo {
+	base := path.Base(name)
+	if fi.Name() == base {
+		return fi
+	}
+	return namedInfo{FileInfo: fi, name: base}
+}
+
+// mountPath cleans name into an absolute, slash separated virtual path.
+func mountPath(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+// isBelow reports whether name is strictly inside dir.
+func isBelow(name, dir string) bool {
+	if dir == "/" {
+		return name != "/"
+	}
+	return strings.HasPrefix(name, dir+"/")
+}
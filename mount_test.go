@@ -0,0 +1,311 @@
+package afero
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func newTestMount(t *testing.T) (afero.Fs, afero.Fs, *Afero) {
+	rootFs := afero.NewMemMapFs()
+	if err := afero.WriteFile(rootFs, "/root.file", []byte(rootFileCont), defaultCreateMode); err != nil {
+		t.Fatal("Error creating root mount file: ", err)
+	}
+	vendorFs := afero.NewMemMapFs()
+	if err := afero.WriteFile(vendorFs, "/dir/file1", []byte(dirFileCont1), defaultCreateMode); err != nil {
+		t.Fatal("Error creating vendor mount file: ", err)
+	}
+	fs := NewMount(map[string]afero.Fs{
+		"/":               rootFs,
+		"/deep/vendor/fs": vendorFs,
+	}, "/", false)
+	return rootFs, vendorFs, fs.(*Afero)
+}
+
+func TestMountRouting(t *testing.T) {
+	rootFs, vendorFs, fs := newTestMount(t)
+
+	f, err := fs.Create("deep/vendor/fs/new.file")
+	if err != nil {
+		t.Error("Error creating file in mount: ", err)
+		return
+	}
+	if f.Name() != "deep/vendor/fs/new.file" {
+		t.Error("File name is not the virtual path: ", f.Name())
+	}
+	f.Close()
+
+	if _, err := vendorFs.Stat("/new.file"); err != nil {
+		t.Error("File was not created on the longest prefix mount: ", err)
+	}
+	if _, err := rootFs.Stat("/deep/vendor/fs/new.file"); err == nil {
+		t.Error("File was created on the root mount")
+	}
+
+	st, err := fs.Stat("deep/vendor/fs/dir/file1")
+	if err != nil {
+		t.Error("Error stating mounted file: ", err)
+		return
+	}
+	if st.Size() != int64(len(dirFileCont1)) {
+		t.Error("Mounted file size does not match content")
+	}
+}
+
+func TestMountReadDir(t *testing.T) {
+	_, _, fs := newTestMount(t)
+
+	sts, err := fs.ReadDir("/")
+	if err != nil {
+		t.Error("Error reading root directory: ", err)
+		return
+	}
+	if len(sts) != 2 {
+		t.Error("Not the expected number of files found: ", len(sts))
+		return
+	}
+	if sts[0].Name() != "deep" || !sts[0].IsDir() {
+		t.Error("Synthesized parent directory not listed: ", sts[0].Name())
+	}
+	if sts[1].Name() != "root.file" {
+		t.Error("Root mount file not listed: ", sts[1].Name())
+	}
+
+	sts, err = fs.ReadDir("deep/vendor")
+	if err != nil {
+		t.Error("Error reading synthesized directory: ", err)
+		return
+	}
+	if len(sts) != 1 || sts[0].Name() != "fs" || !sts[0].IsDir() {
+		t.Error("Mount point not listed in synthesized directory")
+	}
+
+	st, err := fs.Stat("deep")
+	if err != nil {
+		t.Error("Error stating synthesized directory: ", err)
+		return
+	}
+	if !st.IsDir() {
+		t.Error("Synthesized directory is not a directory")
+	}
+}
+
+func TestMountRename(t *testing.T) {
+	rootFs, vendorFs, fs := newTestMount(t)
+
+	err := fs.Rename("deep/vendor/fs/dir", "moved")
+	if err != nil {
+		t.Error("Error renaming across mounts: ", err)
+		return
+	}
+
+	data, err := afero.ReadFile(rootFs, "/moved/file1")
+	if err != nil {
+		t.Error("Error reading moved file: ", err)
+		return
+	}
+	if string(data) != dirFileCont1 {
+		t.Error("Moved file content is not that of original file")
+	}
+
+	if _, err := vendorFs.Stat("/dir"); !os.IsNotExist(err) {
+		t.Error("Source of cross mount rename still exists: ", err)
+	}
+}
+
+func TestMountRemove(t *testing.T) {
+	_, _, fs := newTestMount(t)
+
+	if err := fs.Remove("deep/vendor/fs"); err == nil {
+		t.Error("Removed a mount point")
+	}
+	if err := fs.Remove("deep"); err == nil {
+		t.Error("Removed a synthesized directory")
+	}
+}
+
+func TestMountUnmount(t *testing.T) {
+	_, _, fs := newTestMount(t)
+	mount := fs.fs.(*MountFs)
+	extra := afero.NewMemMapFs()
+	afero.WriteFile(extra, "/file", []byte(dirFileCont3), defaultCreateMode)
+
+	if err := mount.Mount("/deep/vendor/fs", extra); err == nil {
+		t.Error("Mounted over an existing mount point")
+	}
+	if err := mount.Mount("extra/", extra); err != nil {
+		t.Error("Error mounting: ", err)
+		return
+	}
+	if list := mount.Mounts(); len(list) != 3 || list[1] != "/deep/vendor/fs" || list[2] != "/extra" {
+		t.Error("Unexpected mount points: ", list)
+	}
+	if st, err := fs.Stat("/extra/file"); err != nil || st.Size() != int64(len(dirFileCont3)) {
+		t.Error("File of the new mount not found: ", err)
+	}
+
+	if err := mount.Unmount("/extra"); err != nil {
+		t.Error("Error unmounting: ", err)
+	}
+	if err := mount.Unmount("/extra"); err == nil {
+		t.Error("Unmounted a path that is not a mount point")
+	}
+	if _, err := fs.Stat("/extra/file"); !os.IsNotExist(err) {
+		t.Error("File of an unmounted filesystem still found: ", err)
+	}
+	if _, err := extra.Stat("/file"); err != nil {
+		t.Error("Unmounting changed the filesystem: ", err)
+	}
+}
+
+func TestMountRemoveAll(t *testing.T) {
+	rootFs, vendorFs, fs := newTestMount(t)
+	afero.WriteFile(rootFs, "/deep/other", []byte(dirFileCont3), defaultCreateMode)
+
+	if err := fs.RemoveAll("deep"); err != nil {
+		t.Error("Error removing across a mount point: ", err)
+		return
+	}
+	if _, err := rootFs.Stat("/deep/other"); !os.IsNotExist(err) {
+		t.Error("File of the parent mount was not removed: ", err)
+	}
+	if list, err := afero.ReadDir(vendorFs, "/"); err != nil || len(list) != 0 {
+		t.Error("Content of the mount below was not removed: ", list, err)
+	}
+	if st, err := fs.Stat("deep/vendor/fs"); err != nil || !st.IsDir() {
+		t.Error("Mount point was removed: ", err)
+	}
+	if _, err := rootFs.Stat("/root.file"); err != nil {
+		t.Error("File outside the removed tree was removed: ", err)
+	}
+}
+
+func TestMountRemoveAllUnmount(t *testing.T) {
+	_, _, fs := newTestMount(t)
+	mount := fs.fs.(*MountFs)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 200; i++ {
+			mount.Mount("/deep/extra", afero.NewMemMapFs())
+			mount.Unmount("/deep/extra")
+		}
+		close(done)
+	}()
+	for i := 0; i < 200; i++ {
+		if err := fs.RemoveAll("deep"); err != nil {
+			t.Error("Error removing while unmounting: ", err)
+			break
+		}
+	}
+	<-done
+}
+
+func TestMountAttributes(t *testing.T) {
+	_, vendorFs, fs := newTestMount(t)
+
+	if err := fs.Chmod("deep/vendor/fs/dir/file1", 0600); err != nil {
+		t.Error("Error changing mode on a mount: ", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := fs.Chtimes("deep/vendor/fs/dir/file1", mtime, mtime); err != nil {
+		t.Error("Error changing times on a mount: ", err)
+	}
+	if st, err := vendorFs.Stat("/dir/file1"); err != nil || st.Mode().Perm() != 0600 || !st.ModTime().Equal(mtime) {
+		t.Error("Mode and times were not changed on the mount: ", st, err)
+	}
+	if err := fs.Chmod("missing/file", 0600); !os.IsNotExist(err) {
+		t.Error("Unexpected error changing the mode of a missing file: ", err)
+	}
+}
+
+func TestMountSymlink(t *testing.T) {
+	dir, err := afero.TempDir(afero.NewOsFs(), tempDir, "mount.")
+	if err != nil {
+		t.Error("Error creating temp directory: ", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	osFs := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	afero.WriteFile(osFs, "/target", []byte(rootFileCont), defaultCreateMode)
+	fs := NewMount(map[string]afero.Fs{"/": afero.NewMemMapFs(), "/os": osFs}, "/", false)
+
+	if err := fs.Symlink("/target", "/os/link"); err != nil {
+		t.Error("Error creating symlink on a mount: ", err)
+		return
+	}
+	if st, err := fs.Lstat("/os/link"); err != nil || st.Mode()&os.ModeSymlink == 0 {
+		t.Error("Symlink was not created: ", st, err)
+	}
+	// BasePathFs returns the real path, less the leading slash Afero trims
+	if target, err := fs.Readlink("/os/link"); err != nil || "/"+target != filepath.Join(dir, "target") {
+		t.Error("Unexpected symlink target: ", target, err)
+	}
+	if err := fs.Symlink("/target", "/link"); err == nil {
+		t.Error("Created a symlink on a mount without symlinks")
+	}
+}
+
+func TestMountRenameAcross(t *testing.T) {
+	rootFs := afero.NewMemMapFs()
+	afero.WriteFile(rootFs, "/target", []byte(rootFileCont), defaultCreateMode)
+	rootFs.MkdirAll("/empty", defaultDirectoryMode)
+	afero.WriteFile(rootFs, "/full/file", []byte(rootFileCont), defaultCreateMode)
+	vendorFs := afero.NewMemMapFs()
+	afero.WriteFile(vendorFs, "/dir/a", []byte(dirFileCont1), defaultCreateMode)
+	afero.WriteFile(vendorFs, "/dir/b", []byte(dirFileCont3), defaultCreateMode)
+	afero.WriteFile(vendorFs, "/file", []byte(nestedFileCont), defaultCreateMode)
+	faulty := NewFaultFs(vendorFs, 1, FaultRule{Op: "Open*", Path: "/dir/b"})
+	fs := New(NewMountFs(map[string]afero.Fs{"/": rootFs, "/vendor": faulty}), "/", false)
+
+	for _, test := range []struct {
+		from, to string
+		err      error
+	}{
+		{"/vendor/dir", "/target", syscall.ENOTDIR},
+		{"/vendor/file", "/empty", syscall.EISDIR},
+		{"/vendor/dir", "/full", syscall.ENOTEMPTY},
+	} {
+		err := fs.Rename(test.from, test.to)
+		if lerr, ok := err.(*os.LinkError); !ok || lerr.Err != test.err {
+			t.Error("Unexpected error renaming ", test.from, " to ", test.to, ": ", err)
+		}
+	}
+
+	// a failed copy leaves both sides as they were
+	if err := fs.Rename("/vendor/dir", "/empty"); err == nil {
+		t.Error("Rename with a failing copy reported success")
+	}
+	if list, err := afero.ReadDir(rootFs, "/empty"); err != nil || len(list) != 0 {
+		t.Error("Target of a failed rename was changed: ", list, err)
+	}
+	if list, err := afero.ReadDir(vendorFs, "/dir"); err != nil || len(list) != 2 {
+		t.Error("Source of a failed rename was changed: ", list, err)
+	}
+	if list, _ := afero.ReadDir(rootFs, "/"); len(list) != 3 {
+		t.Error("Unexpected entries left by a failed rename: ", list)
+	}
+
+	faulty.SetRules()
+	if err := fs.Rename("/vendor/dir", "/empty"); err != nil {
+		t.Error("Error renaming a directory across mounts: ", err)
+	}
+	if err := fs.Rename("/vendor/file", "/target"); err != nil {
+		t.Error("Error renaming a file over a file across mounts: ", err)
+	}
+	for name, content := range map[string]string{"/empty/a": dirFileCont1, "/empty/b": dirFileCont3, "/target": nestedFileCont} {
+		if data, err := afero.ReadFile(rootFs, name); err != nil || string(data) != content {
+			t.Error("Unexpected content of ", name, ": ", string(data), err)
+		}
+	}
+	if list, _ := afero.ReadDir(vendorFs, "/"); len(list) != 0 {
+		t.Error("Sources of the renames were left behind: ", list)
+	}
+	if list, _ := afero.ReadDir(rootFs, "/"); len(list) != 3 {
+		t.Error("Unexpected entries left by the renames: ", list)
+	}
+}
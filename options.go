@@ -0,0 +1,149 @@
+package afero
+
+import (
+	"io"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Option configures optional behaviour of an Afero filesystem.
+type Option func(*Afero)
+
+// WithoutRenameFallback disables the copy and delete fallback Rename uses
+// when the backend cannot rename across devices or layers, returning the
+// backend error instead.
+func WithoutRenameFallback() Option {
+	return func(fs *Afero) {
+		fs.noRenameFallback = true
+	}
+}
+
+// WithRootRemoval allows RemoveAll of the filesystem root, which is refused
+// with ErrProtectedPath by default.
+func WithRootRemoval() Option {
+	return func(fs *Afero) {
+		fs.allowRootRemoval = true
+	}
+}
+
+// WithProtectedPaths refuses RemoveAll of any of paths, or of a directory
+// containing them, with ErrProtectedPath. Paths are relative to the root
+// passed to New and stay protected in every Chroot.
+func WithProtectedPaths(paths ...string) Option {
+	return func(fs *Afero) {
+		for _, p := range paths {
+			fs.protected = append(fs.protected, mountPath(p))
+		}
+	}
+}
+
+// WithTrash makes Remove and RemoveAll move entries into trash instead of
+// deleting them, see ListTrash, Restore and EmptyTrash. trash should not be
+// reachable through the wrapped filesystem, and is addressed with absolute
+// paths so an OS directory should be given as an afero.BasePathFs.
+func WithTrash(trash afero.Fs) Option {
+	return func(fs *Afero) {
+		fs.trash = newTrash(trash, time.Now)
+	}
+}
+
+// WithVersions saves the previous content of files into store before they
+// are truncated, overwritten or replaced by a Rename, see Versions and
+// RestoreVersion. Up to keep versions are retained per file and at most
+// budget bytes in total, the oldest are dropped first; zero or less means no
+// limit. store is addressed with absolute paths.
+func WithVersions(store afero.Fs, keep int, budget int64) Option {
+	return func(fs *Afero) {
+		fs.versions = newVersions(store, keep, budget, time.Now)
+	}
+}
+
+// WithAudit writes an AuditRecord line to w for every mutating operation,
+// including the bytes written to a file once it is closed. With chain set
+// each record carries the hash of the one before it, see VerifyAuditLog.
+// Records carry the actor of the context given to WithContext.
+func WithAudit(w io.Writer, chain bool) Option {
+	return func(fs *Afero) {
+		fs.auditor = newAuditor(w, chain, time.Now)
+	}
+}
+
+// WithBandwidthLimit limits the bytes read and written through files of the
+// filesystem to bytesPerSec, allowing bursts of up to burst bytes. The limit
+// is shared with every Chroot. A bytesPerSec of 0 or less means no limit.
+func WithBandwidthLimit(bytesPerSec, burst int64) Option {
+	return func(fs *Afero) {
+		fs.limitsFor().bytes = newTokenBucket(float64(bytesPerSec), float64(burst), realClock{})
+	}
+}
+
+// WithOpRateLimit limits Stat, Lstat, ReadDir and OpenFile calls on the
+// filesystem to opsPerSec, allowing bursts of up to burst calls. The limit
+// is shared with every Chroot. An opsPerSec of 0 or less means no limit.
+func WithOpRateLimit(opsPerSec float64, burst int) Option {
+	return func(fs *Afero) {
+		fs.limitsFor().ops = newTokenBucket(opsPerSec, float64(burst), realClock{})
+	}
+}
+
+// WithRetry retries backend calls failing with errors the policy considers
+// retryable, backing off between attempts. Stat, Lstat, ReadDir, Readlink
+// and read-only opens are retried, other operations only when listed in the
+// policy's Ops.
+func WithRetry(policy RetryPolicy) Option {
+	return func(fs *Afero) {
+		fs.retrier = newRetrier(policy, realClock{})
+	}
+}
+
+// WithMetadataCache caches the results of Stat, Lstat, ReadDir and Readlink
+// for ttl, keeping at most maxEntries results; zero or less means no limit
+// for either.
+// Mutations made through the filesystem or any of its Chroots invalidate the
+// affected results, changes made to the backend directly are only seen once
+// the cached results expire. See CacheStats.
+func WithMetadataCache(ttl time.Duration, maxEntries int) Option {
+	return func(fs *Afero) {
+		fs.cache = newMetaCache(ttl, maxEntries, realClock{})
+	}
+}
+
+// WithBuffering buffers file reads and writes, reading up to readAhead
+// bytes at a time and holding back writes until writeBehind bytes are
+// pending; zero disables either. Errors of held back writes are returned by
+// the next call on the file, at the latest by Close.
+func WithBuffering(readAhead, writeBehind int) Option {
+	return func(fs *Afero) {
+		fs.readAhead = readAhead
+		fs.writeBehind = writeBehind
+	}
+}
+
+// WithHandleTracking tracks the files opened through the filesystem and its
+// Chroots until they are closed, see OpenHandles and CloseAll. Opening more
+// than maxOpen files at once fails with ErrTooManyOpenFiles, zero or less
+// means no limit. In debug mode the stack that opened each file is kept.
+func WithHandleTracking(maxOpen int) Option {
+	return func(fs *Afero) {
+		fs.handles = newHandles(maxOpen, time.Now)
+	}
+}
+
+// WithTreeHashes keeps the hashes TreeHash computes, in the given format,
+// until changes made through the filesystem or its Chroots invalidate them.
+func WithTreeHashes(format TreeHashFormat) Option {
+	return func(fs *Afero) {
+		fs.hashes = newTreeHashes(format)
+	}
+}
+
+// WithIntegrity records in manifest the sha256 of every file written through
+// the filesystem and its Chroots, and checks files read in order to their
+// end against it, see Verify and VerifyAll. Changes made to the backend
+// directly show as corruption. manifest is addressed with absolute paths.
+func WithIntegrity(manifest afero.Fs) Option {
+	return func(fs *Afero) {
+		fs.integrity = newIntegrity(manifest)
+	}
+}
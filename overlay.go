@@ -0,0 +1,705 @@
+package afero
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+const (
+	// whiteoutPrefix marks an entry in the writable layer that hides the
+	// base entry of the same name (without the prefix).
+	whiteoutPrefix = ".wh."
+	// opaqueMarker inside a layer directory hides every base entry below it.
+	opaqueMarker = whiteoutPrefix + whiteoutPrefix + ".opq"
+	// overlayMaxLinks is the number of symlinks Stat follows.
+	overlayMaxLinks = 40
+)
+
+// ErrReservedName is returned creating an entry of an OverlayFs whose name
+// starts with ".wh.", which is reserved for whiteouts.
+var ErrReservedName = errors.New("Names starting with " + whiteoutPrefix + " are reserved by OverlayFs")
+
+// OverlayFs is an afero.Fs that layers a writable filesystem over a read-only
+// base. Unlike afero.CopyOnWriteFs, deleting an entry that only exists in the
+// base is recorded as a whiteout in the layer, so Remove, RemoveAll and Rename
+// work across the whole merged tree. The base is never modified. Entries
+// named with the ".wh." prefix of whiteouts are hidden and cannot be
+// created, failing with ErrReservedName.
+type OverlayFs struct {
+	base  afero.Fs
+	layer afero.Fs
+}
+
+// NewOverlayFs returns an OverlayFs writing to layer on top of base.
+func NewOverlayFs(base, layer afero.Fs) *OverlayFs {
+	return &OverlayFs{base: base, layer: layer}
+}
+
+// NewOverlay returns a billy filesystem over an OverlayFs of base and layer.
+func NewOverlay(base, layer afero.Fs, root string, debug bool) billy.Filesystem {
+	return New(NewOverlayFs(base, layer), root, debug)
+}
+
+// Name returns the name of this filesystem.
+func (o *OverlayFs) Name() string {
+	return "OverlayFs"
+}
+
+// Create creates or truncates the named file in the writable layer.
+func (o *OverlayFs) Create(name string) (afero.File, error) {
+	return o.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, defaultCreateMode)
+}
+
+// Mkdir creates a directory in the writable layer. Recreating a directory
+// that was deleted from the base makes it opaque, so the old base contents
+// stay hidden.
+func (o *OverlayFs) Mkdir(name string, perm os.FileMode) error {
+	name = filepath.Clean(name)
+	if isOverlayMarker(name) {
+		return &os.PathError{Op: "mkdir", Path: name, Err: ErrReservedName}
+	}
+	if _, _, err := o.resolve(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if err := o.requireDir("mkdir", filepath.Dir(name)); err != nil {
+		return err
+	}
+	if err := o.copyUpDirs(filepath.Dir(name)); err != nil {
+		return err
+	}
+
+	whiteout := whiteoutPath(name)
+	wasDeleted := exists(o.layer, whiteout)
+	if wasDeleted {
+		if err := o.layer.Remove(whiteout); err != nil {
+			return err
+		}
+	}
+	if err := o.layer.Mkdir(name, perm); err != nil {
+		return err
+	}
+	if wasDeleted {
+		return o.touch(filepath.Join(name, opaqueMarker))
+	}
+	return nil
+}
+
+// MkdirAll creates a directory path and all parents that do not exist yet.
+func (o *OverlayFs) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+	for _, dir := range append(ancestors(path), path) {
+		_, fi, err := o.resolve(dir)
+		if err == nil {
+			if !fi.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+			}
+			continue
+		}
+		if err := o.Mkdir(dir, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open opens the named file for reading.
+func (o *OverlayFs) Open(name string) (afero.File, error) {
+	return o.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file. Files opened for writing that only exist in
+// the base are copied up into the layer first.
+func (o *OverlayFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	name = filepath.Clean(name)
+	if isOverlayMarker(name) {
+		if flag&os.O_CREATE != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: ErrReservedName}
+		}
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	writing := flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0
+
+	fs, fi, err := o.resolve(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		if err := o.requireDir("open", filepath.Dir(name)); err != nil {
+			return nil, err
+		}
+		if err := o.copyUpDirs(filepath.Dir(name)); err != nil {
+			return nil, err
+		}
+		if err := o.removeWhiteout(name); err != nil {
+			return nil, err
+		}
+		return o.layer.OpenFile(name, flag, perm)
+	}
+
+	if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	if fi.IsDir() {
+		if writing {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		f, err := fs.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return &overlayDir{File: f, fs: o, name: name}, nil
+	}
+	if writing && fs == o.base {
+		if flag&os.O_TRUNC != 0 && fi.Mode()&os.ModeSymlink == 0 {
+			// the content is dropped, only the mode is copied up
+			err = o.copyUpDirs(filepath.Dir(name))
+			if err == nil {
+				var f afero.File
+				if f, err = o.layer.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm()); err == nil {
+					err = f.Close()
+				}
+			}
+		} else {
+			err = o.copyUp(name, fi)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fs = o.layer
+	}
+	return fs.OpenFile(name, flag, perm)
+}
+
+// Remove removes the named file or empty directory. Entries present in the
+// base are hidden with a whiteout.
+func (o *OverlayFs) Remove(name string) error {
+	name = filepath.Clean(name)
+	fs, fi, err := o.resolve(name)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if fi.IsDir() {
+		entries, err := o.readDir(name)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	if fs == o.layer {
+		// an empty merged directory may still hold whiteouts in the layer
+		if err := o.layer.RemoveAll(name); err != nil {
+			return err
+		}
+	}
+	if o.inBase(name) {
+		return o.whiteout(name)
+	}
+	return nil
+}
+
+// RemoveAll removes path and any children it contains. It does not fail if
+// the path does not exist.
+func (o *OverlayFs) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	if _, _, err := o.resolve(path); err != nil {
+		return nil
+	}
+	if isRoot(path) {
+		entries, err := o.readDir(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := o.RemoveAll(filepath.Join(path, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := o.layer.RemoveAll(path); err != nil {
+		return err
+	}
+	if o.inBase(path) {
+		return o.whiteout(path)
+	}
+	return nil
+}
+
+// Rename moves oldname to newname. Entries that only exist in the base are
+// copied up into the layer, moved there, and whited out at the old path.
+func (o *OverlayFs) Rename(oldname, newname string) error {
+	oldname = filepath.Clean(oldname)
+	newname = filepath.Clean(newname)
+	if oldname == newname {
+		return nil
+	}
+	if isOverlayMarker(newname) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: ErrReservedName}
+	}
+	_, fi, err := o.resolve(oldname)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if err := o.requireDir("rename", filepath.Dir(newname)); err != nil {
+		return err
+	}
+	if err := o.checkRenameTarget(oldname, newname, fi); err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		err = o.copyUpTree(oldname)
+	} else {
+		err = o.copyUp(oldname, fi)
+	}
+	if err != nil {
+		return err
+	}
+	if err := o.copyUpDirs(filepath.Dir(newname)); err != nil {
+		return err
+	}
+	if err := o.removeWhiteout(newname); err != nil {
+		return err
+	}
+	if err := renameVerified(o.layer, oldname, newname); err != nil {
+		return err
+	}
+
+	if o.inBase(oldname) {
+		return o.whiteout(oldname)
+	}
+	return nil
+}
+
+// checkRenameTarget applies the rules of rename(2) to moving oldname, described
+// by fi, onto newname: a directory may only replace an empty directory, and
+// a file only a file. The empty directory replaced is removed.
+func (o *OverlayFs) checkRenameTarget(oldname, newname string, fi os.FileInfo) error {
+	if fi.IsDir() && strings.HasPrefix(newname, oldname+string(filepath.Separator)) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EINVAL}
+	}
+	_, nfi, err := o.resolve(newname)
+	if err != nil {
+		return nil
+	}
+	switch {
+	case !nfi.IsDir() && fi.IsDir():
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.ENOTDIR}
+	case nfi.IsDir() && !fi.IsDir():
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EISDIR}
+	case !nfi.IsDir():
+		return nil
+	}
+	entries, err := o.readDir(newname)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.ENOTEMPTY}
+	}
+	return o.Remove(newname)
+}
+
+// Stat returns a FileInfo describing the named file in the merged view.
+// Symlinks are followed through the merged view, so a link in one layer
+// may point to a file in the other.
+func (o *OverlayFs) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	p := name
+	for links := 0; ; links++ {
+		fs, fi, err := o.resolve(p)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return mountInfo(fi, filepath.ToSlash(name)), nil
+		}
+		if links == overlayMaxLinks {
+			return nil, &os.PathError{Op: "stat", Path: name, Err: syscall.ELOOP}
+		}
+		target, err := readlink(fs, p)
+		if err != nil {
+			return nil, err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(p), target)
+		}
+		p = filepath.Clean(target)
+	}
+}
+
+// LstatIfPossible implements afero.Lstater.
+func (o *OverlayFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	name = filepath.Clean(name)
+	fs, _, err := o.resolve(name)
+	if err != nil {
+		return nil, false, err
+	}
+	return lstat(fs, name)
+}
+
+// SymlinkIfPossible implements afero.Linker, creating the link in the layer.
+func (o *OverlayFs) SymlinkIfPossible(oldname, newname string) error {
+	newname = filepath.Clean(newname)
+	if isOverlayMarker(newname) {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: ErrReservedName}
+	}
+	linker, ok := o.layer.(afero.Linker)
+	if !ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+	}
+	if _, _, err := o.resolve(newname); err == nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	if err := o.requireDir("symlink", filepath.Dir(newname)); err != nil {
+		return err
+	}
+	if err := o.copyUpDirs(filepath.Dir(newname)); err != nil {
+		return err
+	}
+	if err := o.removeWhiteout(newname); err != nil {
+		return err
+	}
+	return linker.SymlinkIfPossible(oldname, newname)
+}
+
+// ReadlinkIfPossible implements afero.LinkReader.
+func (o *OverlayFs) ReadlinkIfPossible(name string) (string, error) {
+	name = filepath.Clean(name)
+	fs, _, err := o.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	if reader, ok := fs.(afero.LinkReader); ok {
+		return reader.ReadlinkIfPossible(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+}
+
+// Chmod changes the mode of the named file, copying it up if needed.
+func (o *OverlayFs) Chmod(name string, mode os.FileMode) error {
+	name = filepath.Clean(name)
+	if err := o.copyUpExisting("chmod", name); err != nil {
+		return err
+	}
+	return o.layer.Chmod(name, mode)
+}
+
+// Chtimes changes the access and modification times of the named file,
+// copying it up if needed.
+func (o *OverlayFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	name = filepath.Clean(name)
+	if err := o.copyUpExisting("chtimes", name); err != nil {
+		return err
+	}
+	return o.layer.Chtimes(name, atime, mtime)
+}
+
+// resolve finds the layer holding name in the merged view, returning its
+// Lstat result.
+func (o *OverlayFs) resolve(name string) (afero.Fs, os.FileInfo, error) {
+	if isOverlayMarker(name) || o.deleted(name) {
+		return nil, nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	fi, _, err := lstat(o.layer, name)
+	if err == nil {
+		return o.layer, fi, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if o.baseVisible(name) {
+		fi, _, err = lstat(o.base, name)
+		if err == nil {
+			return o.base, fi, nil
+		}
+	}
+	return nil, nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+// deleted reports whether name or one of its parents has been whited out.
+func (o *OverlayFs) deleted(name string) bool {
+	for _, p := range append(ancestors(name), name) {
+		if !isRoot(p) && exists(o.layer, whiteoutPath(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// baseVisible reports whether the base entry for name can show through the
+// layer, i.e. no parent in the layer is opaque or a non-directory.
+func (o *OverlayFs) baseVisible(name string) bool {
+	for _, dir := range ancestors(name) {
+		fi, _, err := lstat(o.layer, dir)
+		if err != nil {
+			continue
+		}
+		if !fi.IsDir() || exists(o.layer, filepath.Join(dir, opaqueMarker)) {
+			return false
+		}
+	}
+	return true
+}
+
+// inBase reports whether name currently has a visible entry in the base.
+func (o *OverlayFs) inBase(name string) bool {
+	return o.baseVisible(name) && exists(o.base, name)
+}
+
+func (o *OverlayFs) requireDir(op, dir string) error {
+	_, fi, err := o.resolve(dir)
+	if err != nil {
+		return &os.PathError{Op: op, Path: dir, Err: os.ErrNotExist}
+	}
+	if !fi.IsDir() {
+		return &os.PathError{Op: op, Path: dir, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// copyUpDirs makes sure dir and its parents exist in the layer, using the
+// base permissions where available.
+func (o *OverlayFs) copyUpDirs(dir string) error {
+	for _, d := range append(ancestors(dir), dir) {
+		if isRoot(d) || exists(o.layer, d) {
+			continue
+		}
+		perm := os.FileMode(defaultDirectoryMode)
+		if fi, err := o.base.Stat(d); err == nil {
+			perm = fi.Mode().Perm()
+		}
+		if err := o.layer.Mkdir(d, perm); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *OverlayFs) copyUpExisting(op, name string) error {
+	fs, fi, err := o.resolve(name)
+	if err != nil {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	if fs == o.base {
+		return o.copyUp(name, fi)
+	}
+	return nil
+}
+
+// copyUp copies a single base entry (not its children) into the layer.
+func (o *OverlayFs) copyUp(name string, fi os.FileInfo) error {
+	if exists(o.layer, name) {
+		return nil
+	}
+	if err := o.copyUpDirs(filepath.Dir(name)); err != nil {
+		return err
+	}
+
+	switch {
+	case fi.IsDir():
+		return o.layer.Mkdir(name, fi.Mode().Perm())
+	case fi.Mode()&os.ModeSymlink != 0:
+		return copySymlink(o.base, name, o.layer, name)
+	}
+	return copyFile(o.base, name, o.layer, name, fi)
+}
+
+// copyUpTree copies name and every entry below it in the merged view into
+// the layer.
+func (o *OverlayFs) copyUpTree(name string) error {
+	_, fi, err := o.resolve(name)
+	if err != nil {
+		return err
+	}
+	if err := o.copyUp(name, fi); err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+	entries, err := o.readDir(name)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := o.copyUpTree(filepath.Join(name, entry.Name())); err != nil {
+			return err
+		}
+	}
+	// everything below is now in the layer, the base must not show through
+	// once the directory moves
+	return o.touch(filepath.Join(name, opaqueMarker))
+}
+
+func (o *OverlayFs) whiteout(name string) error {
+	if err := o.copyUpDirs(filepath.Dir(name)); err != nil {
+		return err
+	}
+	return o.touch(whiteoutPath(name))
+}
+
+func (o *OverlayFs) removeWhiteout(name string) error {
+	whiteout := whiteoutPath(name)
+	if !exists(o.layer, whiteout) {
+		return nil
+	}
+	return o.layer.Remove(whiteout)
+}
+
+func (o *OverlayFs) touch(name string) error {
+	f, err := o.layer.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, defaultCreateMode)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// readDir returns the merged, sorted listing of the directory name, with
+// whiteouts applied and markers hidden.
+func (o *OverlayFs) readDir(name string) ([]os.FileInfo, error) {
+	entries := map[string]os.FileInfo{}
+	hidden := map[string]bool{}
+	opaque := false
+
+	inLayer := false
+	if fi, _, err := lstat(o.layer, name); err == nil && fi.IsDir() {
+		inLayer = true
+		list, err := afero.ReadDir(o.layer, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range list {
+			switch n := fi.Name(); {
+			case n == opaqueMarker:
+				opaque = true
+			case strings.HasPrefix(n, whiteoutPrefix):
+				hidden[strings.TrimPrefix(n, whiteoutPrefix)] = true
+			default:
+				entries[n] = fi
+			}
+		}
+	}
+
+	if !opaque && o.baseVisible(name) {
+		if fi, _, err := lstat(o.base, name); err == nil && fi.IsDir() {
+			list, err := afero.ReadDir(o.base, name)
+			if err != nil {
+				return nil, err
+			}
+			for _, fi := range list {
+				if _, ok := entries[fi.Name()]; !ok && !hidden[fi.Name()] {
+					entries[fi.Name()] = fi
+				}
+			}
+		} else if !inLayer {
+			return nil, &os.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+		}
+	}
+
+	list := make([]os.FileInfo, 0, len(entries))
+	for _, fi := range entries {
+		list = append(list, fi)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+// overlayDir is a directory handle whose listing is the merged view.
+type overlayDir struct {
+	afero.File
+	fs      *OverlayFs
+	name    string
+	entries []os.FileInfo
+	read    bool
+}
+
+func (d *overlayDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.read {
+		entries, err := d.fs.readDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		d.read = true
+	}
+	return nextEntries(&d.entries, count)
+}
+
+func (d *overlayDir) Readdirnames(n int) ([]string, error) {
+	list, err := d.Readdir(n)
+	names := make([]string, len(list))
+	for i, fi := range list {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+// nextEntries pops the next count entries off a directory listing, following
+// the paging rules of os.File.Readdir.
+func nextEntries(entries *[]os.FileInfo, count int) ([]os.FileInfo, error) {
+	if count <= 0 {
+		list := *entries
+		*entries = nil
+		return list, nil
+	}
+	if len(*entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(*entries) {
+		count = len(*entries)
+	}
+	list := (*entries)[:count]
+	*entries = (*entries)[count:]
+	return list, nil
+}
+
+func lstat(fs afero.Fs, name string) (os.FileInfo, bool, error) {
+	if lstater, ok := fs.(afero.Lstater); ok {
+		return lstater.LstatIfPossible(name)
+	}
+	fi, err := fs.Stat(name)
+	return fi, false, err
+}
+
+func exists(fs afero.Fs, name string) bool {
+	_, _, err := lstat(fs, name)
+	return err == nil
+}
+
+func whiteoutPath(name string) string {
+	return filepath.Join(filepath.Dir(name), whiteoutPrefix+filepath.Base(name))
+}
+
+func isOverlayMarker(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), whiteoutPrefix)
+}
+
+func isRoot(name string) bool {
+	return filepath.Dir(name) == name
+}
+
+// ancestors returns the parent directories of name, outermost first.
+func ancestors(name string) []string {
+	var list []string
+	for dir := filepath.Dir(name); ; dir = filepath.Dir(dir) {
+		list = append([]string{dir}, list...)
+		if isRoot(dir) {
+			return list
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package afero
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+func newTestOverlay(t *testing.T) (afero.Fs, afero.Fs, *Afero) {
+	base := afero.NewMemMapFs()
+	if err := createOverlayBase(base); err != nil {
+		t.Fatal("Error creating overlay base: ", err)
+	}
+	layer := afero.NewMemMapFs()
+	return base, layer, NewOverlay(base, layer, "/", false).(*Afero)
+}
+
+func createOverlayBase(fs afero.Fs) error {
+	if err := fs.MkdirAll("dir/sub", defaultDirectoryMode); err != nil {
+		return err
+	}
+	if err := afero.WriteFile(fs, "root.file", []byte(rootFileCont), defaultCreateMode); err != nil {
+		return err
+	}
+	if err := afero.WriteFile(fs, "dir/file1", []byte(dirFileCont1), defaultCreateMode); err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, "dir/sub/file", []byte(nestedFileCont), defaultCreateMode)
+}
+
+func TestOverlayRemove(t *testing.T) {
+	base, _, fs := newTestOverlay(t)
+
+	err := fs.Remove("root.file")
+	if err != nil {
+		t.Error("Error removing base file: ", err)
+		return
+	}
+
+	_, err = fs.Stat("root.file")
+	if !os.IsNotExist(err) {
+		t.Error("Removed base file is still visible: ", err)
+	}
+	_, err = fs.Lstat("root.file")
+	if !os.IsNotExist(err) {
+		t.Error("Removed base file is still visible to lstat: ", err)
+	}
+
+	sts, err := fs.ReadDir("/")
+	if err != nil {
+		t.Error("Error reading root directory: ", err)
+		return
+	}
+	for _, st := range sts {
+		if st.Name() != "dir" {
+			t.Error("Unexpected entry in root directory: ", st.Name())
+		}
+	}
+
+	if _, err := base.Stat("root.file"); err != nil {
+		t.Error("Base layer was modified: ", err)
+	}
+}
+
+func TestOverlayRemoveAll(t *testing.T) {
+	base, _, fs := newTestOverlay(t)
+
+	err := fs.RemoveAll("dir")
+	if err != nil {
+		t.Error("Error removing base directory: ", err)
+		return
+	}
+
+	_, err = fs.Stat("dir/sub/file")
+	if !os.IsNotExist(err) {
+		t.Error("Child of removed directory is still visible: ", err)
+	}
+
+	err = fs.MkdirAll("dir", defaultDirectoryMode)
+	if err != nil {
+		t.Error("Error recreating removed directory: ", err)
+		return
+	}
+
+	sts, err := fs.ReadDir("dir")
+	if err != nil {
+		t.Error("Error reading recreated directory: ", err)
+		return
+	}
+	if len(sts) != 0 {
+		t.Error("Recreated directory should be opaque, found ", len(sts), " entries")
+	}
+
+	if _, err := base.Stat("dir/sub/file"); err != nil {
+		t.Error("Base layer was modified: ", err)
+	}
+}
+
+func TestOverlayRemove2(t *testing.T) {
+	_, _, fs := newTestOverlay(t)
+
+	err := fs.Remove("dir")
+	if err == nil {
+		t.Error("Removed a non-empty directory")
+	}
+}
+
+func TestOverlayRename(t *testing.T) {
+	base, _, fs := newTestOverlay(t)
+
+	err := fs.Rename("dir/file1", "dir/sub/moved")
+	if err != nil {
+		t.Error("Error renaming base file: ", err)
+		return
+	}
+
+	if _, err := fs.Stat("dir/file1"); !os.IsNotExist(err) {
+		t.Error("Renamed file still visible at old path: ", err)
+	}
+
+	f, err := fs.Open("dir/sub/moved")
+	if err != nil {
+		t.Error("Error opening renamed file: ", err)
+		return
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Error("Error reading renamed file: ", err)
+		return
+	}
+	if string(data) != dirFileCont1 {
+		t.Error("Renamed file content is not that of original file")
+	}
+
+	sts, err := fs.ReadDir("dir/sub")
+	if err != nil {
+		t.Error("Error reading destination directory: ", err)
+		return
+	}
+	if len(sts) != 2 {
+		t.Error("Not the expected number of files found: ", len(sts))
+	}
+
+	if _, err := base.Stat("dir/file1"); err != nil {
+		t.Error("Base layer was modified: ", err)
+	}
+}
+
+func TestOverlayCopyUp(t *testing.T) {
+	base, layer, fs := newTestOverlay(t)
+
+	f, err := fs.OpenFile("dir/file1", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Error("Error opening base file for writing: ", err)
+		return
+	}
+	_, err = f.Write([]byte(dirFileCont3))
+	f.Close()
+	if err != nil {
+		t.Error("Error appending to base file: ", err)
+		return
+	}
+
+	data, err := afero.ReadFile(layer, "dir/file1")
+	if err != nil {
+		t.Error("File was not copied up into the layer: ", err)
+		return
+	}
+	if string(data) != dirFileCont1+dirFileCont3 {
+		t.Error("Copied up file does not have the expected content: ", string(data))
+	}
+
+	data, err = afero.ReadFile(base, "dir/file1")
+	if err != nil || string(data) != dirFileCont1 {
+		t.Error("Base layer was modified: ", err)
+	}
+}
+
+func TestOverlayWhiteoutHidden(t *testing.T) {
+	_, _, fs := newTestOverlay(t)
+
+	if err := fs.Remove("dir/file1"); err != nil {
+		t.Error("Error removing base file: ", err)
+		return
+	}
+
+	if _, err := fs.Stat("dir/" + whiteoutPrefix + "file1"); !os.IsNotExist(err) {
+		t.Error("Whiteout entry is visible through stat: ", err)
+	}
+
+	f, err := fs.Create("dir/file1")
+	if err != nil {
+		t.Error("Error recreating removed file: ", err)
+		return
+	}
+	f.Close()
+
+	sts, err := fs.ReadDir("dir")
+	if err != nil {
+		t.Error("Error reading directory: ", err)
+		return
+	}
+	if len(sts) != 2 {
+		t.Error("Not the expected number of files found: ", len(sts))
+	}
+	for _, st := range sts {
+		if st.Name() != "file1" && st.Name() != "sub" {
+			t.Error("Unexpected entry in directory: ", st.Name())
+		}
+	}
+}
+
+func TestOverlayRenameOntoDirectory(t *testing.T) {
+	base, _, fs := newTestOverlay(t)
+	fs.MkdirAll("other/empty", defaultDirectoryMode)
+	fs.MkdirAll("moving", defaultDirectoryMode)
+
+	for _, test := range []struct {
+		from, to string
+		err      error
+	}{
+		{"moving", "dir", syscall.ENOTEMPTY},
+		{"moving", "root.file", syscall.ENOTDIR},
+		{"root.file", "other", syscall.EISDIR},
+		{"dir", "dir/sub/inside", syscall.EINVAL},
+	} {
+		err := fs.Rename(test.from, test.to)
+		if lerr, ok := err.(*os.LinkError); !ok || lerr.Err != test.err {
+			t.Error("Unexpected error renaming ", test.from, " to ", test.to, ": ", err)
+		}
+	}
+	if _, err := fs.Stat("dir/sub/file"); err != nil {
+		t.Error("Content of the rename target was lost: ", err)
+	}
+
+	// an empty directory is replaced, and the base content of a removed one
+	// does not show through
+	if err := fs.Remove("dir/sub/file"); err != nil {
+		t.Error("Error removing base file: ", err)
+		return
+	}
+	if err := fs.Rename("other", "dir/sub"); err != nil {
+		t.Error("Error renaming onto an empty directory: ", err)
+		return
+	}
+	sts, err := fs.ReadDir("dir/sub")
+	if err != nil || len(sts) != 1 || sts[0].Name() != "empty" {
+		t.Error("Unexpected content of the replaced directory: ", sts, err)
+	}
+	if _, err := base.Stat("dir/sub/file"); err != nil {
+		t.Error("Base layer was modified: ", err)
+	}
+}
+
+func TestOverlayReservedNames(t *testing.T) {
+	_, layer, fs := newTestOverlay(t)
+	name := "dir/" + whiteoutPrefix + "file"
+
+	if _, err := fs.Create(name); !errors.Is(err, ErrReservedName) {
+		t.Error("Unexpected error creating a reserved name: ", err)
+	}
+	if err := fs.MkdirAll(name, defaultDirectoryMode); !errors.Is(err, ErrReservedName) {
+		t.Error("Unexpected error creating a reserved directory: ", err)
+	}
+	if err := fs.Rename("root.file", name); !errors.Is(err, ErrReservedName) {
+		t.Error("Unexpected error renaming to a reserved name: ", err)
+	}
+	if _, err := fs.Open(name); !os.IsNotExist(err) {
+		t.Error("Unexpected error opening a reserved name: ", err)
+	}
+	if _, err := layer.Stat(name); !os.IsNotExist(err) {
+		t.Error("Reserved name was created in the layer: ", err)
+	}
+}
+
+func TestOverlayAttributes(t *testing.T) {
+	base, layer, fs := newTestOverlay(t)
+	change := fs.fs.(*OverlayFs)
+
+	if err := change.Chmod("dir/file1", 0600); err != nil {
+		t.Error("Error changing the mode of a base file: ", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := change.Chtimes("dir/file1", mtime, mtime); err != nil {
+		t.Error("Error changing the times of a base file: ", err)
+	}
+	if st, err := layer.Stat("dir/file1"); err != nil || st.Mode().Perm() != 0600 || !st.ModTime().Equal(mtime) {
+		t.Error("Base file was not copied up with the new attributes: ", st, err)
+	}
+	if data, err := afero.ReadFile(layer, "dir/file1"); err != nil || string(data) != dirFileCont1 {
+		t.Error("Copied up file does not have the base content: ", string(data), err)
+	}
+	if st, err := base.Stat("dir/file1"); err != nil || st.Mode().Perm() == 0600 {
+		t.Error("Base layer was modified: ", st, err)
+	}
+	if err := change.Chmod("missing", 0600); !os.IsNotExist(err) {
+		t.Error("Unexpected error changing the mode of a missing file: ", err)
+	}
+	if err := change.Chtimes("missing", mtime, mtime); !os.IsNotExist(err) {
+		t.Error("Unexpected error changing the times of a missing file: ", err)
+	}
+}
+
+func TestOverlaySymlink(t *testing.T) {
+	dir, err := afero.TempDir(afero.NewOsFs(), tempDir, "overlay.")
+	if err != nil {
+		t.Error("Error creating temp directory: ", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	osFs := afero.NewOsFs()
+	base := afero.NewBasePathFs(osFs, filepath.Join(dir, "base"))
+	layer := afero.NewBasePathFs(osFs, filepath.Join(dir, "layer"))
+	osFs.MkdirAll(filepath.Join(dir, "base"), defaultDirectoryMode)
+	osFs.MkdirAll(filepath.Join(dir, "layer"), defaultDirectoryMode)
+	if err := createOverlayBase(base); err != nil {
+		t.Error("Error creating overlay base: ", err)
+		return
+	}
+	base.(afero.Linker).SymlinkIfPossible("/root.file", "/dir/baselink")
+	overlay := NewOverlayFs(base, layer)
+
+	if err := overlay.SymlinkIfPossible("/root.file", "/dir/link"); err != nil {
+		t.Error("Error creating symlink: ", err)
+		return
+	}
+	if err := overlay.SymlinkIfPossible("/root.file", "/dir/file1"); !os.IsExist(errors.Cause(err.(*os.LinkError).Err)) {
+		t.Error("Unexpected error creating a symlink over a base file: ", err)
+	}
+	// BasePathFs returns the real path of the layer holding the link
+	for link, target := range map[string]string{
+		"/dir/link":     filepath.Join(dir, "layer", "root.file"),
+		"/dir/baselink": filepath.Join(dir, "base", "root.file"),
+	} {
+		if got, err := overlay.ReadlinkIfPossible(link); err != nil || got != target {
+			t.Error("Unexpected target of ", link, ": ", got, err)
+		}
+	}
+	if _, err := overlay.ReadlinkIfPossible("/missing"); !os.IsNotExist(err) {
+		t.Error("Unexpected error reading a missing symlink: ", err)
+	}
+
+	// links are followed through the merged view
+	afero.WriteFile(overlay, "/dir/new", []byte(dirFileCont3), defaultCreateMode)
+	base.(afero.Linker).SymlinkIfPossible("/dir/new", "/dir/tonew")
+	for link, size := range map[string]int{"/dir/link": len(rootFileCont), "/dir/tonew": len(dirFileCont3)} {
+		if fi, err := overlay.Stat(link); err != nil || fi.Size() != int64(size) || fi.Name() != filepath.Base(link) {
+			t.Error("Unexpected info through ", link, ": ", fi, err)
+		}
+	}
+	overlay.SymlinkIfPossible("/loop2", "/loop1")
+	overlay.SymlinkIfPossible("/loop1", "/loop2")
+	if _, err := overlay.Stat("/loop1"); err == nil || err.(*os.PathError).Err != syscall.ELOOP {
+		t.Error("Unexpected error following a symlink loop: ", err)
+	}
+}
+
+func TestOverlayTruncateBase(t *testing.T) {
+	base, layer, fs := newTestOverlay(t)
+	base.Chmod("dir/file1", 0640)
+
+	f, err := fs.OpenFile("dir/file1", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Error("Error truncating a base file: ", err)
+		return
+	}
+	f.Write([]byte("new"))
+	f.Close()
+	if fi, err := layer.Stat("dir/file1"); err != nil || fi.Mode().Perm() != 0640 || fi.Size() != 3 {
+		t.Error("Truncated file was not created in the layer with the base mode: ", fi, err)
+	}
+	if data, err := afero.ReadFile(base, "dir/file1"); err != nil || string(data) != dirFileCont1 {
+		t.Error("Base layer was modified: ", string(data), err)
+	}
+}
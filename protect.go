@@ -0,0 +1,32 @@
+package afero
+
+import (
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// ErrProtectedPath is returned when RemoveAll would delete the filesystem
+// root or a protected path.
+var ErrProtectedPath = errors.New("Refusing to remove protected path")
+
+// virtual returns name as an absolute path within the filesystem returned
+// by New.
+func (fs *Afero) virtual(name string) string {
+	return mountPath(path.Join(fs.base, mountPath(name)))
+}
+
+// checkRemoveAll applies the removal policy to a RemoveAll of name.
+func (fs *Afero) checkRemoveAll(name string) error {
+	if mountPath(name) == "/" && !fs.allowRootRemoval {
+		return &os.PathError{Op: "removeall", Path: name, Err: ErrProtectedPath}
+	}
+	target := fs.virtual(name)
+	for _, p := range fs.protected {
+		if p == target || isBelow(p, target) {
+			return &os.PathError{Op: "removeall", Path: name, Err: ErrProtectedPath}
+		}
+	}
+	return nil
+}
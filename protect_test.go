@@ -0,0 +1,82 @@
+package afero
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+func newTestProtectFs(t *testing.T, opts ...Option) (afero.Fs, *Afero) {
+	mem := afero.NewMemMapFs()
+	if err := mem.MkdirAll("/repo/.git/objects", defaultDirectoryMode); err != nil {
+		t.Fatal("Error creating test directory: ", err)
+	}
+	if err := afero.WriteFile(mem, "/repo/file", []byte(rootFileCont), defaultCreateMode); err != nil {
+		t.Fatal("Error creating test file: ", err)
+	}
+	return mem, New(mem, "/", false, opts...).(*Afero)
+}
+
+func TestRemoveAllRoot(t *testing.T) {
+	mem, fs := newTestProtectFs(t)
+
+	for _, p := range []string{"", "/", ".", "repo/..", "//"} {
+		err := fs.RemoveAll(p)
+		if !errors.Is(err, ErrProtectedPath) {
+			t.Error("RemoveAll of root '", p, "' was not refused: ", err)
+		}
+	}
+
+	chroot, err := fs.Chroot("/repo")
+	if err != nil {
+		t.Error("Error getting chroot: ", err)
+		return
+	}
+	if err := chroot.(*Afero).RemoveAll(""); !errors.Is(err, ErrProtectedPath) {
+		t.Error("RemoveAll of chroot root was not refused: ", err)
+	}
+
+	if _, err := mem.Stat("/repo/file"); err != nil {
+		t.Error("Refused RemoveAll deleted files: ", err)
+	}
+}
+
+func TestRemoveAllRoot2(t *testing.T) {
+	mem, fs := newTestProtectFs(t, WithRootRemoval())
+
+	if err := fs.RemoveAll("/"); err != nil {
+		t.Error("RemoveAll of root refused despite being allowed: ", err)
+		return
+	}
+	if _, err := mem.Stat("/repo"); err == nil {
+		t.Error("RemoveAll of root did not delete its contents")
+	}
+}
+
+func TestRemoveAllProtected(t *testing.T) {
+	mem, fs := newTestProtectFs(t, WithRootRemoval(), WithProtectedPaths("repo/.git"))
+
+	for _, p := range []string{"repo/.git", "/repo", "/"} {
+		err := fs.RemoveAll(p)
+		if !errors.Is(err, ErrProtectedPath) {
+			t.Error("RemoveAll of '", p, "' containing a protected path was not refused: ", err)
+		}
+	}
+
+	chroot, err := fs.Chroot("/repo")
+	if err != nil {
+		t.Error("Error getting chroot: ", err)
+		return
+	}
+	if err := chroot.(*Afero).RemoveAll(".git"); !errors.Is(err, ErrProtectedPath) {
+		t.Error("RemoveAll of protected path in chroot was not refused: ", err)
+	}
+
+	if err := fs.RemoveAll("repo/file"); err != nil {
+		t.Error("RemoveAll of unprotected path refused: ", err)
+	}
+	if _, err := mem.Stat("/repo/.git/objects"); err != nil {
+		t.Error("Protected path was deleted: ", err)
+	}
+}
@@ -0,0 +1,560 @@
+package afero
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/pkg/errors"
+)
+
+var errUnknownOp = errors.New("Unknown recorded operation")
+
+// RecordedCall is a single line of a recording, one call made on a
+// filesystem or one of its files with its arguments and results.
+type RecordedCall struct {
+	Seq int `json:"seq"`
+	// FS is the filesystem the call was made on, zero for the one passed to
+	// NewRecorder and the Handle of the Chroot call for the others.
+	FS int `json:"fs,omitempty"`
+	// Handle is the file a File call was made on, or the file or filesystem
+	// an open or Chroot created.
+	Handle int    `json:"handle,omitempty"`
+	Op     string `json:"op"`
+
+	Path    string      `json:"path,omitempty"`
+	NewPath string      `json:"newPath,omitempty"`
+	Target  string      `json:"target,omitempty"`
+	Prefix  string      `json:"prefix,omitempty"`
+	Flag    int         `json:"flag,omitempty"`
+	Perm    os.FileMode `json:"perm,omitempty"`
+	Offset  int64       `json:"offset,omitempty"`
+	Whence  int         `json:"whence,omitempty"`
+	// Atime and Mtime are the times of Chtimes, in Unix nanoseconds.
+	Atime int64 `json:"atime,omitempty"`
+	Mtime int64 `json:"mtime,omitempty"`
+	// Size is the buffer size of reads and the size of truncates.
+	Size int64 `json:"size,omitempty"`
+	// Data is the content of writes, kept in full so they can be replayed.
+	Data []byte `json:"data,omitempty"`
+
+	// N is the byte count of reads and writes and the position of seeks.
+	N int64 `json:"n,omitempty"`
+	// Digest is the sha256 of the bytes read.
+	Digest  string         `json:"digest,omitempty"`
+	Info    *RecordedInfo  `json:"info,omitempty"`
+	Entries []RecordedInfo `json:"entries,omitempty"`
+	// Name is the path returned by TempFile and Readlink.
+	Name string `json:"name,omitempty"`
+	// Err is the error returned, ErrKind its class compared on replay as
+	// messages differ between backends.
+	Err     string `json:"err,omitempty"`
+	ErrKind string `json:"errKind,omitempty"`
+}
+
+// RecordedInfo is the part of a FileInfo that is compared on replay.
+// Modification times are left out, they cannot be reproduced.
+type RecordedInfo struct {
+	Name string      `json:"name"`
+	Size int64       `json:"size,omitempty"`
+	Mode os.FileMode `json:"mode"`
+}
+
+func recordInfo(fi os.FileInfo) RecordedInfo {
+	info := RecordedInfo{Name: fi.Name(), Mode: fi.Mode()}
+	// directory sizes depend on the backend
+	if fi.Mode().IsRegular() {
+		info.Size = fi.Size()
+	}
+	return info
+}
+
+func errKind(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case err == io.EOF:
+		return "eof"
+	case os.IsNotExist(err):
+		return "notexist"
+	case os.IsExist(err):
+		return "exist"
+	case os.IsPermission(err):
+		return "permission"
+	}
+	return "other"
+}
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// apply makes the call on fs or f, filling in its results. Reads go into p,
+// a buffer of Size when nil. It returns the file or filesystem the call
+// created, if any.
+func (c *RecordedCall) apply(fs billy.Filesystem, f billy.File, p []byte) (billy.File, billy.Filesystem, error) {
+	if p == nil && (c.Op == "File.Read" || c.Op == "File.ReadAt") {
+		p = make([]byte, c.Size)
+	}
+	var (
+		file   billy.File
+		chroot billy.Filesystem
+		fi     os.FileInfo
+		n      int
+		err    error
+	)
+	switch c.Op {
+	case "Create":
+		file, err = fs.Create(c.Path)
+	case "Open":
+		file, err = fs.Open(c.Path)
+	case "OpenFile":
+		file, err = fs.OpenFile(c.Path, c.Flag, c.Perm)
+	case "TempFile":
+		file, err = fs.TempFile(c.Path, c.Prefix)
+		if err == nil {
+			c.Name = file.Name()
+		}
+	case "Stat", "Lstat":
+		if c.Op == "Stat" {
+			fi, err = fs.Stat(c.Path)
+		} else {
+			fi, err = fs.Lstat(c.Path)
+		}
+		if err == nil {
+			info := recordInfo(fi)
+			c.Info = &info
+		}
+	case "ReadDir":
+		var entries []os.FileInfo
+		entries, err = fs.ReadDir(c.Path)
+		for _, entry := range entries {
+			c.Entries = append(c.Entries, recordInfo(entry))
+		}
+	case "Rename":
+		err = fs.Rename(c.Path, c.NewPath)
+	case "Remove":
+		err = fs.Remove(c.Path)
+	case "RemoveAll":
+		err = util.RemoveAll(fs, c.Path)
+	case "Chmod", "Chtimes":
+		change, ok := fs.(billy.Change)
+		switch {
+		case !ok:
+			err = &os.PathError{Op: strings.ToLower(c.Op), Path: c.Path, Err: billy.ErrNotSupported}
+		case c.Op == "Chmod":
+			err = change.Chmod(c.Path, c.Perm)
+		default:
+			err = change.Chtimes(c.Path, time.Unix(0, c.Atime), time.Unix(0, c.Mtime))
+		}
+	case "MkdirAll":
+		err = fs.MkdirAll(c.Path, c.Perm)
+	case "Symlink":
+		err = fs.Symlink(c.Target, c.Path)
+	case "Readlink":
+		c.Name, err = fs.Readlink(c.Path)
+	case "Chroot":
+		chroot, err = fs.Chroot(c.Path)
+	case "File.Read":
+		n, err = f.Read(p)
+		c.N, c.Digest = int64(n), digest(p[:n])
+	case "File.ReadAt":
+		n, err = f.ReadAt(p, c.Offset)
+		c.N, c.Digest = int64(n), digest(p[:n])
+	case "File.Write":
+		n, err = f.Write(c.Data)
+		c.N = int64(n)
+	case "File.Seek":
+		c.N, err = f.Seek(c.Offset, c.Whence)
+	case "File.Truncate":
+		err = f.Truncate(c.Size)
+	case "File.Lock":
+		err = f.Lock()
+	case "File.Unlock":
+		err = f.Unlock()
+	case "File.Close":
+		err = f.Close()
+	default:
+		return nil, nil, errUnknownOp
+	}
+	if err != nil {
+		c.Err, c.ErrKind = err.Error(), errKind(err)
+	}
+	return file, chroot, err
+}
+
+// recorder writes the calls of a filesystem, its Chroots and files.
+type recorder struct {
+	enc     *json.Encoder
+	seq     int
+	handles int
+	err     error
+	m       sync.Mutex
+}
+
+func (r *recorder) write(c *RecordedCall) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.seq++
+	c.Seq = r.seq
+	if err := r.enc.Encode(c); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *recorder) handle() int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.handles++
+	return r.handles
+}
+
+// Recorder is a billy filesystem writing every call made on it, and on its
+// files and Chroots, to a recording that Replay can run again.
+type Recorder struct {
+	billy.Filesystem
+	rec *recorder
+	id  int
+}
+
+// NewRecorder returns a Recorder of the calls made on fs, writing a
+// RecordedCall per line to w.
+func NewRecorder(fs billy.Filesystem, w io.Writer) *Recorder {
+	return &Recorder{Filesystem: fs, rec: &recorder{enc: json.NewEncoder(w)}}
+}
+
+// Err returns the first error writing the recording.
+func (r *Recorder) Err() error {
+	r.rec.m.Lock()
+	defer r.rec.m.Unlock()
+	return r.rec.err
+}
+
+func (r *Recorder) call(c *RecordedCall) (billy.File, billy.Filesystem, error) {
+	c.FS = r.id
+	file, chroot, err := c.apply(r.Filesystem, nil, nil)
+	if file != nil || chroot != nil {
+		c.Handle = r.rec.handle()
+	}
+	r.rec.write(c)
+	if file != nil {
+		file = &recordedFile{File: file, rec: r.rec, handle: c.Handle}
+	}
+	if chroot != nil {
+		chroot = &Recorder{Filesystem: chroot, rec: r.rec, id: c.Handle}
+	}
+	return file, chroot, err
+}
+
+// Create records a Create call.
+func (r *Recorder) Create(filename string) (billy.File, error) {
+	f, _, err := r.call(&RecordedCall{Op: "Create", Path: filename})
+	return f, err
+}
+
+// Open records an Open call.
+func (r *Recorder) Open(filename string) (billy.File, error) {
+	f, _, err := r.call(&RecordedCall{Op: "Open", Path: filename})
+	return f, err
+}
+
+// OpenFile records an OpenFile call.
+func (r *Recorder) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	f, _, err := r.call(&RecordedCall{Op: "OpenFile", Path: filename, Flag: flag, Perm: perm})
+	return f, err
+}
+
+// TempFile records a TempFile call.
+func (r *Recorder) TempFile(dir, prefix string) (billy.File, error) {
+	f, _, err := r.call(&RecordedCall{Op: "TempFile", Path: dir, Prefix: prefix})
+	return f, err
+}
+
+// Stat records a Stat call.
+func (r *Recorder) Stat(filename string) (os.FileInfo, error) {
+	c := &RecordedCall{Op: "Stat", Path: filename, FS: r.id}
+	fi, err := r.Filesystem.Stat(filename)
+	r.info(c, fi, err)
+	return fi, err
+}
+
+// Lstat records an Lstat call.
+func (r *Recorder) Lstat(filename string) (os.FileInfo, error) {
+	c := &RecordedCall{Op: "Lstat", Path: filename, FS: r.id}
+	fi, err := r.Filesystem.Lstat(filename)
+	r.info(c, fi, err)
+	return fi, err
+}
+
+// info records a stat call, returning the FileInfo of the backend as is.
+func (r *Recorder) info(c *RecordedCall, fi os.FileInfo, err error) {
+	if err != nil {
+		c.Err, c.ErrKind = err.Error(), errKind(err)
+	} else {
+		info := recordInfo(fi)
+		c.Info = &info
+	}
+	r.rec.write(c)
+}
+
+// ReadDir records a ReadDir call.
+func (r *Recorder) ReadDir(path string) ([]os.FileInfo, error) {
+	c := &RecordedCall{Op: "ReadDir", Path: path, FS: r.id}
+	entries, err := r.Filesystem.ReadDir(path)
+	for _, entry := range entries {
+		c.Entries = append(c.Entries, recordInfo(entry))
+	}
+	if err != nil {
+		c.Err, c.ErrKind = err.Error(), errKind(err)
+	}
+	r.rec.write(c)
+	return entries, err
+}
+
+// Rename records a Rename call.
+func (r *Recorder) Rename(from, to string) error {
+	_, _, err := r.call(&RecordedCall{Op: "Rename", Path: from, NewPath: to})
+	return err
+}
+
+// Remove records a Remove call.
+func (r *Recorder) Remove(filename string) error {
+	_, _, err := r.call(&RecordedCall{Op: "Remove", Path: filename})
+	return err
+}
+
+// RemoveAll records a RemoveAll call, removing the children one by one if
+// the recorded filesystem can't remove a tree.
+func (r *Recorder) RemoveAll(path string) error {
+	_, _, err := r.call(&RecordedCall{Op: "RemoveAll", Path: path})
+	return err
+}
+
+// Chmod records a Chmod call, failing with billy.ErrNotSupported if the
+// recorded filesystem does not implement billy.Change.
+func (r *Recorder) Chmod(name string, mode os.FileMode) error {
+	_, _, err := r.call(&RecordedCall{Op: "Chmod", Path: name, Perm: mode})
+	return err
+}
+
+// Chtimes records a Chtimes call, failing with billy.ErrNotSupported if the
+// recorded filesystem does not implement billy.Change.
+func (r *Recorder) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	_, _, err := r.call(&RecordedCall{Op: "Chtimes", Path: name, Atime: atime.UnixNano(), Mtime: mtime.UnixNano()})
+	return err
+}
+
+// MkdirAll records a MkdirAll call.
+func (r *Recorder) MkdirAll(filename string, perm os.FileMode) error {
+	_, _, err := r.call(&RecordedCall{Op: "MkdirAll", Path: filename, Perm: perm})
+	return err
+}
+
+// Symlink records a Symlink call.
+func (r *Recorder) Symlink(target, link string) error {
+	_, _, err := r.call(&RecordedCall{Op: "Symlink", Path: link, Target: target})
+	return err
+}
+
+// Readlink records a Readlink call.
+func (r *Recorder) Readlink(link string) (string, error) {
+	c := &RecordedCall{Op: "Readlink", Path: link}
+	_, _, err := r.call(c)
+	return c.Name, err
+}
+
+// Chroot records a Chroot call.
+func (r *Recorder) Chroot(path string) (billy.Filesystem, error) {
+	_, chroot, err := r.call(&RecordedCall{Op: "Chroot", Path: path})
+	if err != nil {
+		return nil, err
+	}
+	return chroot, nil
+}
+
+// Capabilities returns the capabilities of the recorded filesystem.
+func (r *Recorder) Capabilities() billy.Capability {
+	return billy.Capabilities(r.Filesystem)
+}
+
+// recordedFile records the calls made on a file.
+type recordedFile struct {
+	billy.File
+	rec    *recorder
+	handle int
+}
+
+func (f *recordedFile) call(c *RecordedCall, p []byte) error {
+	c.Handle = f.handle
+	_, _, err := c.apply(nil, f.File, p)
+	f.rec.write(c)
+	return err
+}
+
+func (f *recordedFile) Read(p []byte) (int, error) {
+	c := &RecordedCall{Op: "File.Read", Size: int64(len(p))}
+	err := f.call(c, p)
+	return int(c.N), err
+}
+
+func (f *recordedFile) ReadAt(p []byte, off int64) (int, error) {
+	c := &RecordedCall{Op: "File.ReadAt", Offset: off, Size: int64(len(p))}
+	err := f.call(c, p)
+	return int(c.N), err
+}
+
+func (f *recordedFile) Write(p []byte) (int, error) {
+	c := &RecordedCall{Op: "File.Write", Data: p}
+	err := f.call(c, nil)
+	return int(c.N), err
+}
+
+func (f *recordedFile) Seek(offset int64, whence int) (int64, error) {
+	c := &RecordedCall{Op: "File.Seek", Offset: offset, Whence: whence}
+	err := f.call(c, nil)
+	return c.N, err
+}
+
+func (f *recordedFile) Truncate(size int64) error {
+	return f.call(&RecordedCall{Op: "File.Truncate", Size: size}, nil)
+}
+
+func (f *recordedFile) Lock() error {
+	return f.call(&RecordedCall{Op: "File.Lock"}, nil)
+}
+
+func (f *recordedFile) Unlock() error {
+	return f.call(&RecordedCall{Op: "File.Unlock"}, nil)
+}
+
+func (f *recordedFile) Close() error {
+	return f.call(&RecordedCall{Op: "File.Close"}, nil)
+}
+
+// Divergence is a call of a replay whose results differ from the recording.
+type Divergence struct {
+	Seq  int
+	Op   string
+	Path string
+	// Field names the differing result, Recorded and Replayed its values.
+	Field    string
+	Recorded string
+	Replayed string
+}
+
+func (d Divergence) String() string {
+	return fmt.Sprintf("#%d %s %s: %s recorded %s, replayed %s", d.Seq, d.Op, d.Path, d.Field, d.Recorded, d.Replayed)
+}
+
+// Replay makes the calls of a recording written by a Recorder on fs, such as
+// a fresh filesystem over an afero.MemMapFs, and returns the calls whose
+// results differ. Temporary file names are mapped to those created on
+// replay, and calls on files or Chroots that failed to open are reported
+// and skipped.
+func Replay(r io.Reader, fs billy.Filesystem) ([]Divergence, error) {
+	filesystems := map[int]billy.Filesystem{0: fs}
+	files := map[int]billy.File{}
+	names := map[string]string{}
+	var divergences []Divergence
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var recorded RecordedCall
+		if err := json.Unmarshal(scanner.Bytes(), &recorded); err != nil {
+			return divergences, errors.Wrap(err, "Error reading recording")
+		}
+		c := recorded
+		c.N, c.Digest, c.Info, c.Entries, c.Name, c.Err, c.ErrKind = 0, "", nil, nil, "", "", ""
+		c.Path, c.NewPath = translate(names, c.Path), translate(names, c.NewPath)
+
+		var target billy.Filesystem
+		var f billy.File
+		var ok bool
+		if strings.HasPrefix(c.Op, "File.") {
+			f, ok = files[c.Handle]
+		} else {
+			target, ok = filesystems[c.FS]
+		}
+		if !ok {
+			divergences = append(divergences, Divergence{Seq: c.Seq, Op: c.Op, Path: recorded.Path, Field: "handle", Recorded: "open", Replayed: "missing"})
+			continue
+		}
+
+		file, chroot, err := c.apply(target, f, nil)
+		if err == errUnknownOp {
+			return divergences, errors.Wrap(err, c.Op)
+		}
+		if file != nil {
+			files[c.Handle] = file
+		}
+		if chroot != nil {
+			filesystems[c.Handle] = chroot
+		}
+		if c.Op == "File.Close" {
+			delete(files, c.Handle)
+		}
+		if c.Op == "TempFile" && c.Name != "" {
+			names[mountPath(recorded.Name)] = mountPath(c.Name)
+			c.Name = recorded.Name
+		}
+		if d, diverged := compareCalls(&recorded, &c); diverged {
+			divergences = append(divergences, d)
+		}
+	}
+	return divergences, scanner.Err()
+}
+
+// translate maps a recorded temporary file name to the one created on
+// replay, keeping it relative if it was.
+func translate(names map[string]string, name string) string {
+	replayed, ok := names[mountPath(name)]
+	if !ok || name == "" {
+		return name
+	}
+	if strings.HasPrefix(filepath.ToSlash(name), "/") {
+		return replayed
+	}
+	return strings.TrimPrefix(replayed, "/")
+}
+
+// compareCalls returns the first result of replayed differing from
+// recorded.
+func compareCalls(recorded, replayed *RecordedCall) (Divergence, bool) {
+	d := Divergence{Seq: recorded.Seq, Op: recorded.Op, Path: recorded.Path}
+	field := func(name string, a, b interface{}) (Divergence, bool) {
+		d.Field, d.Recorded, d.Replayed = name, fmt.Sprint(a), fmt.Sprint(b)
+		return d, true
+	}
+	switch {
+	case recorded.ErrKind != replayed.ErrKind:
+		return field("error", recorded.Err, replayed.Err)
+	case recorded.N != replayed.N:
+		return field("n", recorded.N, replayed.N)
+	case recorded.Digest != replayed.Digest:
+		return field("digest", recorded.Digest, replayed.Digest)
+	case recorded.Name != replayed.Name:
+		return field("name", recorded.Name, replayed.Name)
+	case (recorded.Info == nil) != (replayed.Info == nil) || recorded.Info != nil && *recorded.Info != *replayed.Info:
+		return field("info", recorded.Info, replayed.Info)
+	case len(recorded.Entries) != len(replayed.Entries):
+		return field("entries", recorded.Entries, replayed.Entries)
+	}
+	for i := range recorded.Entries {
+		if recorded.Entries[i] != replayed.Entries[i] {
+			return field("entries", recorded.Entries, replayed.Entries)
+		}
+	}
+	return d, false
+}
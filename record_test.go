@@ -0,0 +1,118 @@
+package afero
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// recordSession makes a go-git like sequence of calls on fs.
+func recordSession(t *testing.T, fs *Recorder) {
+	if err := fs.MkdirAll("/repo/objects", 0755); err != nil {
+		t.Error("Error creating directory: ", err)
+		return
+	}
+	tmp, err := fs.TempFile("/repo/objects", "tmp_obj_")
+	if err != nil {
+		t.Error("Error creating temp file: ", err)
+		return
+	}
+	tmp.Write([]byte("object content"))
+	tmp.Close()
+	if err := fs.Rename(fs.Join("/", tmp.Name()), "/repo/objects/ab"); err != nil {
+		t.Error("Error renaming temp file: ", err)
+		return
+	}
+
+	chroot, err := fs.Chroot("/repo")
+	if err != nil {
+		t.Error("Error creating chroot: ", err)
+		return
+	}
+	f, err := chroot.Open("/objects/ab")
+	if err != nil {
+		t.Error("Error opening file: ", err)
+		return
+	}
+	f.Lock()
+	data, _ := ioutil.ReadAll(f)
+	f.Unlock()
+	f.Close()
+	if string(data) != "object content" {
+		t.Error("Unexpected content: ", string(data))
+	}
+	chroot.Stat("/HEAD")
+	if err := fs.Chmod("/repo/objects/ab", 0444); err != nil {
+		t.Error("Error changing mode: ", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := fs.Chtimes("/repo/objects/ab", mtime, mtime); err != nil {
+		t.Error("Error changing times: ", err)
+	}
+	// the mode is compared on replay
+	fs.Stat("/repo/objects/ab")
+	fs.ReadDir("/repo/objects")
+	fs.Remove("/repo/objects/ab")
+	if err := fs.RemoveAll("/repo"); err != nil {
+		t.Error("Error removing tree: ", err)
+	}
+	fs.Stat("/repo")
+}
+
+func TestRecordReplay(t *testing.T) {
+	var recording bytes.Buffer
+	fs := NewRecorder(New(afero.NewMemMapFs(), "/", false), &recording)
+	recordSession(t, fs)
+	if fs.Err() != nil {
+		t.Error("Error writing recording: ", fs.Err())
+		return
+	}
+
+	for _, op := range []string{`"RemoveAll"`, `"Chmod"`, `"Chtimes"`, `"File.Lock"`, `"File.Unlock"`} {
+		if !strings.Contains(recording.String(), `"op":`+op) {
+			t.Error("Call not recorded: ", op)
+		}
+	}
+
+	replayed := New(afero.NewMemMapFs(), "/", false)
+	divergences, err := Replay(bytes.NewReader(recording.Bytes()), replayed)
+	if err != nil {
+		t.Error("Error replaying: ", err)
+		return
+	}
+	if len(divergences) != 0 {
+		t.Error("Unexpected divergences: ", divergences)
+	}
+	if _, err := replayed.Stat("/repo"); !os.IsNotExist(err) {
+		t.Error("RemoveAll was not replayed: ", err)
+	}
+}
+
+func TestReplayDivergence(t *testing.T) {
+	var recording bytes.Buffer
+	recordSession(t, NewRecorder(New(afero.NewMemMapFs(), "/", false), &recording))
+
+	backend := afero.NewMemMapFs()
+	afero.WriteFile(backend, "/repo/HEAD", []byte("ref: refs/heads/master\n"), 0644)
+	afero.WriteFile(backend, "/repo/objects/cd", []byte("other object"), 0644)
+	divergences, err := Replay(&recording, New(backend, "/", false))
+	if err != nil {
+		t.Error("Error replaying: ", err)
+		return
+	}
+	if len(divergences) != 2 {
+		t.Error("Expected 2 divergences, got: ", divergences)
+		return
+	}
+	if divergences[0].Op != "Stat" || divergences[0].Field != "error" {
+		t.Error("Unexpected divergence: ", divergences[0])
+	}
+	if divergences[1].Op != "ReadDir" || divergences[1].Field != "entries" {
+		t.Error("Unexpected divergence: ", divergences[1])
+	}
+}
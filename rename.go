@@ -0,0 +1,207 @@
+package afero
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// stagingDir is the hidden directory at the root of a backend holding the
+// temporary entries of operations done in several steps, such as the entries
+// replaced by renameByCopy and the files rewritten by CompressedFs. It is
+// left out of ReadDir listings, and can be removed when nothing runs.
+const (
+	stagingName = ".afero-staging"
+	stagingDir  = "/" + stagingName
+)
+
+// renameVerified renames from to to on fs. Some backends, like older
+// afero.MemMapFs, move a directory entry but leave its children reachable
+// under the old path only; that is detected from the direct children and the
+// rename is then redone entry by entry.
+func renameVerified(fs afero.Fs, from, to string) error {
+	fi, _, err := lstat(fs, from)
+	if err != nil || !fi.IsDir() {
+		return fs.Rename(from, to)
+	}
+	children, err := afero.ReadDir(fs, from)
+	if err != nil {
+		return err
+	}
+	if err := fs.Rename(from, to); err != nil {
+		return err
+	}
+
+	moved := true
+	for _, child := range children {
+		if _, _, err := lstat(fs, filepath.Join(to, child.Name())); err != nil {
+			moved = false
+			break
+		}
+	}
+	if moved {
+		return nil
+	}
+
+	// put the directory back where its children are, then move them across
+	if err := fs.Rename(to, from); err != nil {
+		return err
+	}
+	if err := moveTree(fs, from, to, fi); err != nil {
+		// move back what was moved, so the rename is all or nothing
+		if _, _, lerr := lstat(fs, to); lerr == nil {
+			moveTree(fs, to, from, fi)
+		}
+		return err
+	}
+	return nil
+}
+
+// moveTree renames the directory from to to one entry at a time, where fi
+// describes from. to may exist already, its entries are merged.
+func moveTree(fs afero.Fs, from, to string, fi os.FileInfo) error {
+	if err := fs.Mkdir(to, fi.Mode().Perm()); err != nil {
+		if tfi, _, lerr := lstat(fs, to); lerr != nil || !tfi.IsDir() {
+			return err
+		}
+	}
+	children, err := afero.ReadDir(fs, from)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		oldChild := filepath.Join(from, child.Name())
+		newChild := filepath.Join(to, child.Name())
+		cfi, _, err := lstat(fs, oldChild)
+		if err != nil {
+			return err
+		}
+		if cfi.IsDir() {
+			err = moveTree(fs, oldChild, newChild, cfi)
+		} else {
+			err = fs.Rename(oldChild, newChild)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := fs.Remove(from); err != nil {
+		return err
+	}
+	if err := fs.Chmod(to, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return fs.Chtimes(to, fi.ModTime(), fi.ModTime())
+}
+
+// isRenameUnsupported reports whether a Rename error means the backend cannot
+// move the entry itself, rather than that the move is invalid: EXDEV across
+// devices, or the bare EPERM afero.CopyOnWriteFs returns for base files.
+func isRenameUnsupported(err error) bool {
+	if err == syscall.EPERM {
+		return true
+	}
+	switch e := err.(type) {
+	case *os.LinkError:
+		err = e.Err
+	case *os.PathError:
+		err = e.Err
+	}
+	if e, ok := err.(*os.SyscallError); ok {
+		err = e.Err
+	}
+	return err == syscall.EXDEV
+}
+
+// renameByCopy moves from to to by copying the tree and removing the source.
+// cause is the error of the failed rename, returned if the move cannot be
+// completed. The move is all or nothing: an entry replaced at to is kept
+// aside until the source is gone, and the source is put back if it cannot
+// be removed entirely.
+func (fs *Afero) renameByCopy(from, to string, cause error) error {
+	if _, _, err := lstat(fs.fs, from); err != nil {
+		return cause
+	}
+	// like rename(2), replace files and empty directories only
+	backup := ""
+	if fi, _, err := lstat(fs.fs, to); err == nil {
+		if fi.IsDir() {
+			entries, err := afero.ReadDir(fs.fs, to)
+			if err != nil {
+				return err
+			}
+			if len(entries) > 0 {
+				return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.ENOTEMPTY}
+			}
+		}
+		backup = filepath.Join(stagingDir, newID(time.Now()))
+		if err := fs.fs.MkdirAll(stagingDir, defaultDirectoryMode); err != nil {
+			return err
+		}
+		defer fs.fs.Remove(stagingDir)
+		if err := copyTree(fs.fs, to, fs.fs, backup); err != nil {
+			fs.fs.RemoveAll(backup)
+			return err
+		}
+		if err := fs.fs.Remove(to); err != nil {
+			fs.fs.RemoveAll(backup)
+			return err
+		}
+	}
+
+	err := copyTree(fs.fs, from, fs.fs, to)
+	if err == nil {
+		err = fs.fs.RemoveAll(from)
+		// some backends report success removing entries they cannot delete
+		if _, _, lerr := lstat(fs.fs, from); lerr == nil {
+			if err == nil {
+				err = cause
+			}
+			err = &os.LinkError{Op: "rename", Old: from, New: to, Err: errors.Cause(err)}
+			if rerr := restoreTree(fs.fs, to, fs.fs, from); rerr != nil {
+				return errors.Wrap(err, "Error restoring "+from+": "+rerr.Error())
+			}
+		} else {
+			err = nil
+		}
+	}
+	if err != nil {
+		fs.fs.RemoveAll(to)
+	}
+	if backup == "" {
+		return err
+	}
+	if err != nil {
+		if rerr := copyTree(fs.fs, backup, fs.fs, to); rerr != nil {
+			return errors.Wrap(err, "Error restoring "+to+" from "+backup+": "+rerr.Error())
+		}
+	}
+	fs.fs.RemoveAll(backup)
+	return err
+}
+
+// restoreTree copies back the entries of the tree copy on src missing from
+// the partially removed tree from on dst.
+func restoreTree(src afero.Fs, copy string, dst afero.Fs, from string) error {
+	return afero.Walk(src, copy, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		orig := filepath.Join(from, strings.TrimPrefix(p, copy))
+		if _, _, err := lstat(dst, orig); err == nil {
+			return nil
+		}
+		if err := copyTree(src, p, dst, orig); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
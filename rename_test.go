@@ -0,0 +1,410 @@
+package afero
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/spf13/afero"
+)
+
+// exdevFs fails every rename as if source and destination were on different
+// devices.
+type exdevFs struct {
+	afero.Fs
+}
+
+func (fs exdevFs) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EXDEV}
+}
+
+func newTestRenameFs(t *testing.T, opts ...Option) (afero.Fs, *Afero) {
+	mem := afero.NewMemMapFs()
+	if err := mem.MkdirAll("/dir/nested", defaultDirectoryMode); err != nil {
+		t.Fatal("Error creating test directory: ", err)
+	}
+	if err := afero.WriteFile(mem, "/dir/file1", []byte(dirFileCont1), 0600); err != nil {
+		t.Fatal("Error creating test file: ", err)
+	}
+	if err := afero.WriteFile(mem, "/dir/nested/file", []byte(nestedFileCont), defaultCreateMode); err != nil {
+		t.Fatal("Error creating test file: ", err)
+	}
+	return mem, New(exdevFs{mem}, "/", false, opts...).(*Afero)
+}
+
+func TestRenameFallback(t *testing.T) {
+	mem, fs := newTestRenameFs(t)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := mem.Chtimes("/dir/file1", mtime, mtime); err != nil {
+		t.Error("Error setting test file times: ", err)
+		return
+	}
+
+	err := fs.Rename("/dir/file1", "/moved/file1")
+	if err != nil {
+		t.Error("Error renaming with fallback: ", err)
+		return
+	}
+
+	st, err := mem.Stat("/moved/file1")
+	if err != nil {
+		t.Error("Error stating moved file: ", err)
+		return
+	}
+	if st.Mode().Perm() != 0600 {
+		t.Error("Moved file mode not preserved: ", st.Mode())
+	}
+	if !st.ModTime().Equal(mtime) {
+		t.Error("Moved file modification time not preserved: ", st.ModTime())
+	}
+
+	data, err := afero.ReadFile(mem, "/moved/file1")
+	if err != nil || string(data) != dirFileCont1 {
+		t.Error("Moved file content is not that of original file: ", err)
+	}
+
+	if _, err := mem.Stat("/dir/file1"); !os.IsNotExist(err) {
+		t.Error("Source of fallback rename still exists: ", err)
+	}
+}
+
+func TestRenameFallback2(t *testing.T) {
+	mem, fs := newTestRenameFs(t)
+
+	err := fs.Rename("/dir", "/moved")
+	if err != nil {
+		t.Error("Error renaming directory with fallback: ", err)
+		return
+	}
+
+	data, err := afero.ReadFile(mem, "/moved/nested/file")
+	if err != nil || string(data) != nestedFileCont {
+		t.Error("Nested file was not moved: ", err)
+	}
+	if _, err := mem.Stat("/dir"); !os.IsNotExist(err) {
+		t.Error("Source directory of fallback rename still exists: ", err)
+	}
+}
+
+func TestRenameFallbackDisabled(t *testing.T) {
+	mem, fs := newTestRenameFs(t, WithoutRenameFallback())
+
+	err := fs.Rename("/dir/file1", "/dir/moved")
+	if err == nil {
+		t.Error("Rename succeeded with the fallback disabled")
+		return
+	}
+	if !isRenameUnsupported(err) {
+		t.Error("Rename did not return the backend error: ", err)
+	}
+	if _, err := mem.Stat("/dir/file1"); err != nil {
+		t.Error("Source of failed rename was removed: ", err)
+	}
+}
+
+func TestRenameFallbackCopyOnWrite(t *testing.T) {
+	base := afero.NewMemMapFs()
+	if err := afero.WriteFile(base, "/file", []byte(rootFileCont), defaultCreateMode); err != nil {
+		t.Error("Error creating base file: ", err)
+		return
+	}
+	fs := New(afero.NewCopyOnWriteFs(afero.NewReadOnlyFs(base), afero.NewMemMapFs()), "/", false)
+
+	// the base can't be modified, so the move is undone and the error reported
+	err := fs.Rename("/file", "/moved")
+	if err == nil {
+		t.Error("Rename of undeletable base file reported success")
+	}
+	if _, err := fs.Stat("/moved"); !os.IsNotExist(err) {
+		t.Error("Copy of base file was left behind: ", err)
+	}
+	if data, err := readBillyFile(fs, "/file"); err != nil || data != rootFileCont {
+		t.Error("Base file was changed: ", data, err)
+	}
+
+	// entries of a directory removed before the failure are put back
+	afero.WriteFile(base, "/dir/base", []byte(dirFileCont1), defaultCreateMode)
+	fs.MkdirAll("/dir", defaultDirectoryMode)
+	util.WriteFile(fs, "/dir/layer", []byte(dirFileCont3), defaultCreateMode)
+	if err := fs.Rename("/dir", "/moved"); err == nil {
+		t.Error("Rename of undeletable base directory reported success")
+	}
+	if _, err := fs.Stat("/moved"); !os.IsNotExist(err) {
+		t.Error("Copy of base directory was left behind: ", err)
+	}
+	for name, content := range map[string]string{"/dir/base": dirFileCont1, "/dir/layer": dirFileCont3} {
+		if data, err := readBillyFile(fs, name); err != nil || data != content {
+			t.Error("Directory content was not restored: ", name, " ", data, err)
+		}
+	}
+}
+
+func readBillyFile(fs billy.Filesystem, name string) (string, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	return string(data), err
+}
+
+func TestRenameFallbackSymlink(t *testing.T) {
+	dir, err := afero.TempDir(afero.NewOsFs(), tempDir, "rename.")
+	if err != nil {
+		t.Error("Error creating temp directory: ", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	base := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	// BasePathFs stores symlink targets as real paths
+	base.MkdirAll("/src", defaultDirectoryMode)
+	afero.WriteFile(base, "/target", []byte(rootFileCont), defaultCreateMode)
+	if err := base.(afero.Linker).SymlinkIfPossible("/target", "/src/link"); err != nil {
+		t.Error("Error creating symlink: ", err)
+		return
+	}
+	afero.WriteFile(base, "/replaced", []byte(dirFileCont1), defaultCreateMode)
+	fs := New(base, dir, false).(*Afero)
+
+	if err := fs.renameByCopy("/src", "/dst", syscall.EXDEV); err != nil {
+		t.Error("Error renaming with fallback: ", err)
+		return
+	}
+	if fi, err := fs.Lstat("/dst/link"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Error("Symlink was not copied as a symlink: ", fi, err)
+	}
+	if data, err := readBillyFile(fs, "/dst/link"); err != nil || data != rootFileCont {
+		t.Error("Copied symlink does not resolve: ", data, err)
+	}
+
+	// a symlink replaces a file
+	if err := fs.renameByCopy("/dst/link", "/replaced", syscall.EXDEV); err != nil {
+		t.Error("Error renaming symlink with fallback: ", err)
+		return
+	}
+	if fi, err := fs.Lstat("/replaced"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Error("Symlink did not replace the file: ", fi, err)
+	}
+	if list, _ := fs.ReadDir("/"); len(list) != 3 {
+		t.Error("Unexpected entries left by the fallback: ", list)
+	}
+}
+
+type renameBackend struct {
+	name string
+	// setup returns the filesystem to populate and the one to wrap
+	setup func(t *testing.T) (afero.Fs, afero.Fs)
+}
+
+var renameBackends = []renameBackend{
+	{"MemMapFs", func(t *testing.T) (afero.Fs, afero.Fs) {
+		mem := afero.NewMemMapFs()
+		return mem, mem
+	}},
+	{"OsFs", func(t *testing.T) (afero.Fs, afero.Fs) {
+		dir, err := afero.TempDir(afero.NewOsFs(), tempDir, "rename.")
+		if err != nil {
+			t.Fatal("Error creating temp directory: ", err)
+		}
+		fs := afero.NewBasePathFs(afero.NewOsFs(), dir)
+		return fs, fs
+	}},
+	{"OverlayFs", func(t *testing.T) (afero.Fs, afero.Fs) {
+		base := afero.NewMemMapFs()
+		return base, NewOverlayFs(base, afero.NewMemMapFs())
+	}},
+	{"MountFs", func(t *testing.T) (afero.Fs, afero.Fs) {
+		mem := afero.NewMemMapFs()
+		return mem, NewMountFs(map[string]afero.Fs{"/": mem})
+	}},
+	{"CopyOnWriteFs", func(t *testing.T) (afero.Fs, afero.Fs) {
+		fs := afero.NewCopyOnWriteFs(afero.NewReadOnlyFs(afero.NewMemMapFs()), afero.NewMemMapFs())
+		return fs, fs
+	}},
+}
+
+func populateRenameTree(fs afero.Fs) (bool, error) {
+	if err := fs.MkdirAll("/src/sub/deep", 0750); err != nil {
+		return false, err
+	}
+	files := map[string]string{
+		"/src/a":            rootFileCont,
+		"/src/sub/b":        dirFileCont1,
+		"/src/sub/deep/c":   nestedFileCont,
+		"/src/sub/deep/d.e": dirFileCont3,
+	}
+	for name, content := range files {
+		if err := afero.WriteFile(fs, name, []byte(content), 0640); err != nil {
+			return false, err
+		}
+	}
+	if linker, ok := fs.(afero.Linker); ok {
+		if err := linker.SymlinkIfPossible("a", "/src/link"); err == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestRenameDirectory(t *testing.T) {
+	for _, backend := range renameBackends {
+		populate, wrapped := backend.setup(t)
+		symlinked, err := populateRenameTree(populate)
+		if err != nil {
+			t.Error(backend.name, ": Error creating test tree: ", err)
+			continue
+		}
+		fs := New(wrapped, "/", false)
+
+		if err := fs.Rename("/src", "/dst/moved"); err != nil {
+			t.Error(backend.name, ": Error renaming populated directory: ", err)
+			continue
+		}
+
+		if _, err := fs.Lstat("/src"); !os.IsNotExist(err) {
+			t.Error(backend.name, ": Source directory still exists: ", err)
+		}
+		if _, err := fs.Lstat("/src/sub/b"); !os.IsNotExist(err) {
+			t.Error(backend.name, ": Child still reachable under the old path: ", err)
+		}
+
+		expect := map[string]string{
+			"/dst/moved/a":            rootFileCont,
+			"/dst/moved/sub/b":        dirFileCont1,
+			"/dst/moved/sub/deep/c":   nestedFileCont,
+			"/dst/moved/sub/deep/d.e": dirFileCont3,
+		}
+		for name, content := range expect {
+			st, err := fs.Stat(name)
+			if err != nil {
+				t.Error(backend.name, ": Error stating moved file ", name, ": ", err)
+				continue
+			}
+			if st.Mode().Perm() != 0640 {
+				t.Error(backend.name, ": Mode of ", name, " not preserved: ", st.Mode())
+			}
+			data, err := afero.ReadFile(wrapped, name)
+			if err != nil || string(data) != content {
+				t.Error(backend.name, ": Content of ", name, " not moved: ", err)
+			}
+		}
+
+		st, err := fs.Stat("/dst/moved/sub")
+		if err != nil || st.Mode().Perm() != 0750 {
+			t.Error(backend.name, ": Directory mode not preserved: ", err)
+		}
+
+		sts, err := fs.ReadDir("/dst/moved/sub")
+		if err != nil || len(sts) != 2 {
+			t.Error(backend.name, ": Moved directory does not list its children: ", err)
+		}
+
+		if symlinked {
+			st, err := fs.Lstat("/dst/moved/link")
+			if err != nil || st.Mode()&os.ModeSymlink == 0 {
+				t.Error(backend.name, ": Symlink not preserved: ", err)
+			}
+		}
+	}
+}
+
+// shallowRenameFs renames a directory by creating the new entry only,
+// leaving the children under the old path, as older MemMapFs did. failAfter
+// file renames succeed before one fails, none fail when negative.
+type shallowRenameFs struct {
+	afero.Fs
+	failAfter int
+}
+
+func (fs *shallowRenameFs) Rename(oldname, newname string) error {
+	fi, err := fs.Fs.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		if fs.failAfter == 0 {
+			fs.failAfter = -1
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EIO}
+		}
+		fs.failAfter--
+		return fs.Fs.Rename(oldname, newname)
+	}
+	// renaming back onto the directory holding the children drops the entry
+	if nfi, err := fs.Fs.Stat(newname); err == nil && nfi.IsDir() {
+		return fs.Fs.Remove(oldname)
+	}
+	return fs.Fs.Mkdir(newname, fi.Mode().Perm())
+}
+
+func TestRenameEmulated(t *testing.T) {
+	files := map[string]string{
+		"a":            rootFileCont,
+		"sub/b":        dirFileCont1,
+		"sub/deep/c":   nestedFileCont,
+		"sub/deep/d.e": dirFileCont3,
+	}
+	for _, failAfter := range []int{-1, 2} {
+		mem := afero.NewMemMapFs()
+		if _, err := populateRenameTree(mem); err != nil {
+			t.Error("Error creating test tree: ", err)
+			return
+		}
+		fs := New(&shallowRenameFs{Fs: mem, failAfter: failAfter}, "/", false)
+
+		err := fs.Rename("/src", "/dst")
+		if failAfter < 0 && err != nil {
+			t.Error("Error renaming with emulation: ", err)
+			continue
+		}
+		if failAfter >= 0 && err == nil {
+			t.Error("Failed entry move reported success")
+		}
+		// the tree is either moved or restored in full
+		dir, gone := "/dst", "/src"
+		if failAfter >= 0 {
+			dir, gone = gone, dir
+		}
+		for name, content := range files {
+			if data, err := afero.ReadFile(mem, dir+"/"+name); err != nil || string(data) != content {
+				t.Error("Entry ", name, " is not under ", dir, ": ", err)
+			}
+		}
+		if st, err := mem.Stat(dir + "/sub"); err != nil || st.Mode().Perm() != 0750 {
+			t.Error("Directory mode not kept under ", dir, ": ", err)
+		}
+		if _, err := mem.Stat(gone); !os.IsNotExist(err) {
+			t.Error("Directory ", gone, " was left behind: ", err)
+		}
+	}
+}
+
+func TestRenameFallbackBackup(t *testing.T) {
+	mem, fs := newTestRenameFs(t)
+	afero.WriteFile(mem, "/dir/target", []byte(rootFileCont), defaultCreateMode)
+
+	if err := fs.Rename("/dir/file1", "/dir/target"); err != nil {
+		t.Error("Error renaming over a file with fallback: ", err)
+		return
+	}
+	if data, err := afero.ReadFile(mem, "/dir/target"); err != nil || string(data) != dirFileCont1 {
+		t.Error("Target was not replaced: ", string(data), err)
+	}
+	if _, err := mem.Stat(stagingDir); !os.IsNotExist(err) {
+		t.Error("Backup directory was left behind: ", err)
+	}
+	if list, _ := afero.ReadDir(mem, "/dir"); len(list) != 2 {
+		t.Error("Unexpected entries next to the target: ", list)
+	}
+
+	// backups left by an interrupted rename are not listed
+	mem.MkdirAll(stagingDir+"/leftover", defaultDirectoryMode)
+	if list, err := fs.ReadDir("/"); err != nil || len(list) != 1 || list[0].Name() != "dir" {
+		t.Error("Backup directory was listed: ", list, err)
+	}
+}
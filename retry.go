@@ -0,0 +1,122 @@
+package afero
+
+import (
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy configures retries of backend calls failing with transient
+// errors, see WithRetry. Only the idempotent Stat, Lstat, ReadDir, Readlink
+// and read-only opens are retried unless more operations are listed in Ops.
+type RetryPolicy struct {
+	// MaxAttempts is the number of calls made before giving up, including
+	// the first.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, multiplied by
+	// Multiplier for each following retry up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Retryable reports whether an error is worth retrying, IsTransientError
+	// when nil.
+	Retryable func(error) bool
+	// Ops enables retries of non-idempotent operations, by Afero method
+	// name: "OpenFile" for opens that may write, "Rename", "MkdirAll",
+	// "Remove", "RemoveAll", "Symlink", "TempFile", "Chmod" and "Chtimes".
+	Ops []string
+}
+
+// DefaultRetryPolicy makes up to four attempts, backing off from 50ms.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     2,
+}
+
+// IsTransientError reports whether err looks like a temporary failure of
+// the backend, such as a network timeout or an interrupted system call.
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) && temporary.Temporary() {
+		return true
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EAGAIN, syscall.EINTR, syscall.EBUSY, syscall.ETIMEDOUT,
+			syscall.ECONNRESET, syscall.ECONNABORTED, syscall.EPIPE:
+			return true
+		}
+	}
+	return false
+}
+
+// retrier runs calls under a RetryPolicy, it is shared by every Chroot.
+type retrier struct {
+	policy RetryPolicy
+	ops    map[string]bool
+	clock  clock
+}
+
+func newRetrier(policy RetryPolicy, c clock) *retrier {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = 1
+	}
+	if policy.Retryable == nil {
+		policy.Retryable = IsTransientError
+	}
+	ops := map[string]bool{"Stat": true, "Lstat": true, "ReadDir": true, "Readlink": true, "Open": true}
+	for _, op := range policy.Ops {
+		ops[op] = true
+	}
+	return &retrier{policy: policy, ops: ops, clock: c}
+}
+
+// retry calls fn, retrying it for op as configured. fn must only have an
+// effect through the backend, it is called again after failures.
+func (fs *Afero) retry(op string, fn func() error) error {
+	r := fs.retrier
+	if r == nil || !r.ops[op] {
+		return fn()
+	}
+
+	backoff := r.policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= r.policy.MaxAttempts || !r.policy.Retryable(err) {
+			return err
+		}
+		if fs.Debug {
+			log.Println("Retrying ", op, " after ", backoff, ": ", err)
+		}
+		r.clock.Sleep(backoff)
+		backoff = time.Duration(float64(backoff) * r.policy.Multiplier)
+		if r.policy.MaxBackoff > 0 && backoff > r.policy.MaxBackoff {
+			backoff = r.policy.MaxBackoff
+		}
+	}
+}
+
+// retryOpen is the retry operation name of an open with flag.
+func retryOpen(flag int) string {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return "OpenFile"
+	}
+	return "Open"
+}
@@ -0,0 +1,125 @@
+package afero
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// flakyFs fails the first calls of each operation with EAGAIN.
+type flakyFs struct {
+	afero.Fs
+	failures int
+	calls    map[string]int
+	err      error
+}
+
+func newFlakyFs(failures int) *flakyFs {
+	return &flakyFs{Fs: afero.NewMemMapFs(), failures: failures, calls: map[string]int{}, err: syscall.EAGAIN}
+}
+
+func (f *flakyFs) fail(op, name string) error {
+	f.calls[op]++
+	if f.calls[op] <= f.failures {
+		return &os.PathError{Op: op, Path: name, Err: f.err}
+	}
+	return nil
+}
+
+func (f *flakyFs) Stat(name string) (os.FileInfo, error) {
+	if err := f.fail("stat", name); err != nil {
+		return nil, err
+	}
+	return f.Fs.Stat(name)
+}
+
+func (f *flakyFs) MkdirAll(name string, perm os.FileMode) error {
+	if err := f.fail("mkdirall", name); err != nil {
+		return err
+	}
+	return f.Fs.MkdirAll(name, perm)
+}
+
+func newRetryTestFs(backend afero.Fs, policy RetryPolicy) (*Afero, *fakeClock) {
+	c := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	fs := New(backend, "/", false, WithRetry(policy)).(*Afero)
+	fs.retrier.clock = c
+	return fs, c
+}
+
+func TestRetryTransientError(t *testing.T) {
+	backend := newFlakyFs(2)
+	afero.WriteFile(backend.Fs, "/file", []byte("data"), 0644)
+	fs, c := newRetryTestFs(backend, DefaultRetryPolicy)
+
+	fi, err := fs.Stat("/file")
+	if err != nil {
+		t.Error("Stat was not retried: ", err)
+		return
+	}
+	if fi.Size() != 4 {
+		t.Error("Unexpected size: ", fi.Size())
+	}
+	if backend.calls["stat"] != 3 {
+		t.Error("Expected 3 calls, got: ", backend.calls["stat"])
+	}
+	// 50ms, then 100ms
+	if c.slept != 150*time.Millisecond {
+		t.Error("Unexpected backoff: ", c.slept)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	backend := newFlakyFs(10)
+	fs, c := newRetryTestFs(backend, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: 1500 * time.Millisecond, Multiplier: 2})
+
+	_, err := fs.Stat("/file")
+	if !IsTransientError(err) {
+		t.Error("Expected the transient error, got: ", err)
+	}
+	if backend.calls["stat"] != 3 {
+		t.Error("Expected 3 calls, got: ", backend.calls["stat"])
+	}
+	if c.slept != 2500*time.Millisecond {
+		t.Error("Backoff was not capped: ", c.slept)
+	}
+}
+
+func TestRetryPermanentError(t *testing.T) {
+	backend := newFlakyFs(1)
+	backend.err = syscall.EACCES
+	fs, c := newRetryTestFs(backend, DefaultRetryPolicy)
+
+	_, err := fs.Stat("/file")
+	if !os.IsPermission(err) {
+		t.Error("Expected a permission error, got: ", err)
+	}
+	if backend.calls["stat"] != 1 || c.slept != 0 {
+		t.Error("Permanent error was retried")
+	}
+}
+
+func TestRetryNonIdempotent(t *testing.T) {
+	backend := newFlakyFs(1)
+	fs, _ := newRetryTestFs(backend, DefaultRetryPolicy)
+
+	if err := fs.MkdirAll("/dir", 0755); !IsTransientError(err) {
+		t.Error("MkdirAll was retried without being enabled: ", err)
+	}
+
+	backend = newFlakyFs(1)
+	policy := DefaultRetryPolicy
+	policy.Ops = []string{"MkdirAll"}
+	fs, _ = newRetryTestFs(backend, policy)
+
+	if err := fs.MkdirAll("/dir", 0755); err != nil {
+		t.Error("MkdirAll was not retried: ", err)
+		return
+	}
+	if backend.calls["mkdirall"] != 2 {
+		t.Error("Expected 2 calls, got: ", backend.calls["mkdirall"])
+	}
+}
@@ -0,0 +1,267 @@
+package afero
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// SyncCompare selects how Sync detects changed files.
+type SyncCompare int
+
+const (
+	// SyncSizeModTime treats files of equal size and modification time as
+	// unchanged.
+	SyncSizeModTime SyncCompare = iota
+	// SyncContent compares the sha256 of the files.
+	SyncContent
+)
+
+// SyncOptions configures Sync.
+type SyncOptions struct {
+	Compare SyncCompare
+	// Delete removes destination entries missing from the source.
+	Delete bool
+}
+
+// SyncAction is a change Sync made to the destination, Op being one of
+// "create", "update", "mode" or "delete".
+type SyncAction struct {
+	Op   string
+	Path string
+}
+
+// SyncSummary reports the changes made by Sync.
+type SyncSummary struct {
+	Created   int
+	Updated   int
+	Deleted   int
+	Unchanged int
+	// Bytes is the size of the files copied.
+	Bytes   int64
+	Actions []SyncAction
+}
+
+func (s *SyncSummary) add(op, name string) {
+	switch op {
+	case "create":
+		s.Created++
+	case "update", "mode":
+		s.Updated++
+	case "delete":
+		s.Deleted++
+	}
+	s.Actions = append(s.Actions, SyncAction{Op: op, Path: name})
+}
+
+// Sync makes the tree of dst match the one of src, copying the entries that
+// changed. Symlinks are recreated, and modes and modification times kept
+// when dst implements billy.Change. Entries replaced by one of another type
+// are removed even without Delete.
+func Sync(src, dst billy.Filesystem, opts SyncOptions) (SyncSummary, error) {
+	var summary SyncSummary
+	s := &syncer{src: src, dst: dst, opts: opts, summary: &summary}
+	s.change, _ = dst.(billy.Change)
+	err := s.dir("/")
+	return summary, err
+}
+
+type syncer struct {
+	src, dst billy.Filesystem
+	change   billy.Change
+	opts     SyncOptions
+	summary  *SyncSummary
+}
+
+// dir syncs the entries of the directory name, which exists in both trees.
+func (s *syncer) dir(name string) error {
+	list, err := s.src.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	seen := make(map[string]bool, len(list))
+	for _, fi := range list {
+		seen[fi.Name()] = true
+		if err := s.entry(path.Join(name, fi.Name())); err != nil {
+			return err
+		}
+	}
+	if !s.opts.Delete {
+		return nil
+	}
+
+	list, err = s.dst.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	for _, fi := range list {
+		if seen[fi.Name()] {
+			continue
+		}
+		p := path.Join(name, fi.Name())
+		if err := util.RemoveAll(s.dst, p); err != nil {
+			return err
+		}
+		s.summary.add("delete", p)
+	}
+	return nil
+}
+
+func (s *syncer) entry(name string) error {
+	sfi, err := s.src.Lstat(name)
+	if err != nil {
+		return err
+	}
+	dfi, err := s.dst.Lstat(name)
+	switch {
+	case os.IsNotExist(err):
+		dfi = nil
+	case err != nil:
+		return err
+	case dfi.Mode()&os.ModeType != sfi.Mode()&os.ModeType:
+		if err := util.RemoveAll(s.dst, name); err != nil {
+			return err
+		}
+		dfi = nil
+	}
+
+	op := "update"
+	if dfi == nil {
+		op = "create"
+	}
+	switch {
+	case sfi.IsDir():
+		if dfi == nil {
+			if err := s.dst.MkdirAll(name, sfi.Mode().Perm()); err != nil {
+				return err
+			}
+			s.summary.add(op, name)
+		}
+		if err := s.dir(name); err != nil {
+			return err
+		}
+		// set after the children, creating them touches the directory
+		return s.attributes(name, sfi, dfi)
+
+	case sfi.Mode()&os.ModeSymlink != 0:
+		target, err := s.src.Readlink(name)
+		if err != nil {
+			return err
+		}
+		if dfi != nil {
+			if current, err := s.dst.Readlink(name); err == nil && current == target {
+				s.summary.Unchanged++
+				return nil
+			}
+			if err := s.dst.Remove(name); err != nil {
+				return err
+			}
+		}
+		if err := s.dst.Symlink(target, name); err != nil {
+			return err
+		}
+		s.summary.add(op, name)
+		return nil
+
+	case sfi.Mode().IsRegular():
+		changed, err := s.changed(name, sfi, dfi)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			return s.attributes(name, sfi, dfi)
+		}
+		if err := s.copy(name, sfi); err != nil {
+			return err
+		}
+		s.summary.add(op, name)
+		return s.attributes(name, sfi, nil)
+	}
+	return nil
+}
+
+// changed reports whether the file name needs copying.
+func (s *syncer) changed(name string, sfi, dfi os.FileInfo) (bool, error) {
+	if dfi == nil || sfi.Size() != dfi.Size() {
+		return true, nil
+	}
+	if s.opts.Compare == SyncSizeModTime {
+		return !sfi.ModTime().Equal(dfi.ModTime()), nil
+	}
+	sh, err := hashFile(s.src, name)
+	if err != nil {
+		return false, err
+	}
+	dh, err := hashFile(s.dst, name)
+	if err != nil {
+		return false, err
+	}
+	return sh != dh, nil
+}
+
+func (s *syncer) copy(name string, fi os.FileInfo) error {
+	in, err := s.src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := s.dst.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, in)
+	s.summary.Bytes += n
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// attributes copies the mode and modification time of name when dst
+// supports it, dfi being nil for entries just written.
+func (s *syncer) attributes(name string, sfi, dfi os.FileInfo) error {
+	modeChanged := dfi != nil && dfi.Mode().Perm() != sfi.Mode().Perm()
+	if s.change != nil {
+		if dfi == nil || modeChanged {
+			if err := s.change.Chmod(name, sfi.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+		if dfi == nil || !dfi.ModTime().Equal(sfi.ModTime()) {
+			if err := s.change.Chtimes(name, sfi.ModTime(), sfi.ModTime()); err != nil {
+				return err
+			}
+		}
+	}
+	switch {
+	case dfi == nil:
+	case modeChanged && s.change != nil:
+		s.summary.add("mode", name)
+	case !sfi.IsDir():
+		s.summary.Unchanged++
+	}
+	return nil
+}
+
+// hashFile returns the hex sha256 of the content of the named file.
+func hashFile(fs billy.Filesystem, name string) (string, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
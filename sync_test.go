@@ -0,0 +1,98 @@
+package afero
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/spf13/afero"
+)
+
+func TestSync(t *testing.T) {
+	src := New(afero.NewMemMapFs(), "/", false)
+	dst := New(afero.NewMemMapFs(), "/", false)
+	util.WriteFile(src, "/a/one", []byte("one"), 0644)
+	util.WriteFile(src, "/a/two", []byte("two"), 0600)
+	util.WriteFile(src, "/b/three", []byte("three"), 0644)
+
+	summary, err := Sync(src, dst, SyncOptions{})
+	if err != nil {
+		t.Error("Error syncing trees: ", err)
+		return
+	}
+	if summary.Created != 5 || summary.Bytes != 11 {
+		t.Error("Unexpected summary of the first sync: ", summary)
+	}
+	if fi, err := dst.Stat("/a/two"); err != nil || fi.Mode() != 0600 {
+		t.Error("Mode was not preserved: ", fi, err)
+	}
+
+	summary, err = Sync(src, dst, SyncOptions{})
+	if err != nil || summary.Unchanged != 3 || len(summary.Actions) != 0 {
+		t.Error("Unexpected summary of an unchanged sync: ", summary, err)
+	}
+
+	later := time.Now().Add(time.Hour)
+	util.WriteFile(src, "/a/one", []byte("ONE"), 0644)
+	src.(billy.Change).Chtimes("/a/one", later, later)
+	src.(billy.Change).Chmod("/a/two", 0640)
+	src.Remove("/b/three")
+	src.Remove("/b")
+	util.WriteFile(src, "/b", []byte("now a file"), 0644)
+	util.WriteFile(dst, "/extra", []byte("extra"), 0644)
+
+	summary, err = Sync(src, dst, SyncOptions{Delete: true})
+	if err != nil {
+		t.Error("Error syncing trees: ", err)
+		return
+	}
+	expect := []SyncAction{{"update", "/a/one"}, {"mode", "/a/two"}, {"create", "/b"}, {"delete", "/extra"}}
+	if len(summary.Actions) != len(expect) {
+		t.Error("Unexpected actions: ", summary.Actions)
+		return
+	}
+	for i, action := range summary.Actions {
+		if action != expect[i] {
+			t.Error("Unexpected action: ", action, ", expected: ", expect[i])
+		}
+	}
+	if fi, err := dst.Stat("/b"); err != nil || fi.IsDir() {
+		t.Error("Directory was not replaced by a file: ", fi, err)
+	}
+	if _, err := dst.Stat("/extra"); err == nil {
+		t.Error("Extraneous file was not deleted")
+	}
+}
+
+func TestSyncContent(t *testing.T) {
+	src := New(afero.NewMemMapFs(), "/", false)
+	dst := New(afero.NewMemMapFs(), "/", false)
+	util.WriteFile(src, "/file", []byte("new"), 0644)
+	util.WriteFile(dst, "/file", []byte("old"), 0644)
+	now := time.Now()
+	src.(billy.Change).Chtimes("/file", now, now)
+	dst.(billy.Change).Chtimes("/file", now, now)
+
+	if summary, _ := Sync(src, dst, SyncOptions{}); summary.Unchanged != 1 {
+		t.Error("Size and time comparison copied the file: ", summary)
+	}
+	if summary, _ := Sync(src, dst, SyncOptions{Compare: SyncContent}); summary.Updated != 1 {
+		t.Error("Content comparison did not copy the file: ", summary)
+	}
+}
+
+func TestSyncSymlinks(t *testing.T) {
+	src := testExportTree(t)
+	dst := testExportTree(t)
+	dst.Remove("/run")
+	dst.Symlink("b.txt", "/run")
+
+	summary, err := Sync(src, dst, SyncOptions{Compare: SyncContent})
+	if err != nil || len(summary.Actions) != 1 || summary.Actions[0] != (SyncAction{"update", "/run"}) {
+		t.Error("Unexpected summary: ", summary, err)
+	}
+	if dest, err := dst.Readlink("/run"); err != nil || dest != "/a/script" {
+		t.Error("Symlink was not synced: ", dest, err)
+	}
+}
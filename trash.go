@@ -0,0 +1,245 @@
+package afero
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+const (
+	trashDataName = "data"
+	trashInfoName = "info.json"
+)
+
+// ErrTrashDisabled is returned by the trash methods of a filesystem created
+// without WithTrash.
+var ErrTrashDisabled = errors.New("Trash is not enabled")
+
+// TrashEntry describes an entry moved to the trash by Remove or RemoveAll.
+type TrashEntry struct {
+	ID string `json:"id"`
+	// Path is the original path, relative to the root passed to New.
+	Path    string    `json:"path"`
+	Deleted time.Time `json:"deleted"`
+	IsDir   bool      `json:"isDir"`
+}
+
+// trashInfo is the metadata stored with a trash entry. Name and Base record
+// how the entry was named when removed, so restoring it through the same
+// filesystem uses the same backend path.
+type trashInfo struct {
+	TrashEntry
+	Name string `json:"name"`
+	Base string `json:"base"`
+}
+
+// trash holds deleted entries, each in its own directory named by its ID
+// holding the data and its TrashEntry. It is shared by every Chroot.
+type trash struct {
+	fs  afero.Fs
+	now func() time.Time
+	m   sync.Mutex
+}
+
+func newTrash(fs afero.Fs, now func() time.Time) *trash {
+	return &trash{fs: fs, now: now}
+}
+
+// trashRemove moves name into the trash. all selects RemoveAll semantics,
+// otherwise directories must be empty and name must exist.
+func (fs *Afero) trashRemove(name string, all bool) error {
+	fi, _, err := lstat(fs.fs, name)
+	if err != nil {
+		if all && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.IsDir() && !all {
+		children, err := afero.ReadDir(fs.fs, name)
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+
+	t := fs.trash
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	now := t.now()
+	entry := TrashEntry{ID: newID(now), Path: fs.virtual(name), Deleted: now, IsDir: fi.IsDir()}
+	if err := t.fs.MkdirAll(path.Join("/", entry.ID), defaultDirectoryMode); err != nil {
+		return err
+	}
+	if err := copyTree(fs.fs, name, t.fs, path.Join("/", entry.ID, trashDataName)); err != nil {
+		t.fs.RemoveAll(path.Join("/", entry.ID))
+		return errors.Wrap(err, "Error moving "+name+" to trash")
+	}
+	data, err := json.Marshal(trashInfo{TrashEntry: entry, Name: name, Base: fs.base})
+	if err != nil {
+		return err
+	}
+	if err := afero.WriteFile(t.fs, path.Join("/", entry.ID, trashInfoName), data, defaultCreateMode); err != nil {
+		t.fs.RemoveAll(path.Join("/", entry.ID))
+		return err
+	}
+	if fs.Debug {
+		log.Println("Trashed ", name, " as ", entry.ID)
+	}
+	return fs.fs.RemoveAll(name)
+}
+
+// ListTrash returns the entries in the trash, oldest first.
+func (fs *Afero) ListTrash() ([]TrashEntry, error) {
+	if fs.Debug {
+		log.Println("ListTrash")
+	}
+	if fs.trash == nil {
+		return nil, ErrTrashDisabled
+	}
+	fs.trash.m.Lock()
+	defer fs.trash.m.Unlock()
+	return fs.trash.list()
+}
+
+// Restore moves the trash entry id back to its original path, which must
+// not exist and must be inside this filesystem.
+func (fs *Afero) Restore(id string) (err error) {
+	if fs.Debug {
+		log.Println("Restore ", id)
+	}
+	restored := ""
+	defer func() { fs.audit(AuditRecord{Op: "restore", Path: restored, Target: id}, &err) }()
+	if fs.trash == nil {
+		return ErrTrashDisabled
+	}
+	t := fs.trash
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	info, err := t.info(id)
+	if err != nil {
+		return err
+	}
+	name, ok := info.Name, info.Base == fs.base
+	if !ok {
+		name, ok = fs.local(info.Path)
+	}
+	if !ok {
+		return &os.PathError{Op: "restore", Path: info.Path, Err: os.ErrPermission}
+	}
+	restored = name
+	defer fs.invalidate(name, true)
+	defer fs.recordTree(name, &err)
+	if _, _, err := lstat(fs.fs, name); err == nil {
+		return &os.PathError{Op: "restore", Path: name, Err: os.ErrExist}
+	}
+	if err := fs.createDir(name); err != nil {
+		return err
+	}
+	if err := copyTree(t.fs, path.Join("/", id, trashDataName), fs.fs, name); err != nil {
+		return errors.Wrap(err, "Error restoring "+id+" from trash")
+	}
+	return t.fs.RemoveAll(path.Join("/", id))
+}
+
+// EmptyTrash permanently deletes the trash entries deleted more than
+// olderThan ago. Zero empties the whole trash.
+func (fs *Afero) EmptyTrash(olderThan time.Duration) (err error) {
+	if fs.Debug {
+		log.Println("EmptyTrash ", olderThan)
+	}
+	defer fs.audit(AuditRecord{Op: "emptytrash", Path: "/"}, &err)
+	if fs.trash == nil {
+		return ErrTrashDisabled
+	}
+	t := fs.trash
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	entries, err := t.list()
+	if err != nil {
+		return err
+	}
+	cutoff := t.now().Add(-olderThan)
+	for _, entry := range entries {
+		if olderThan > 0 && entry.Deleted.After(cutoff) {
+			continue
+		}
+		if err := t.fs.RemoveAll(path.Join("/", entry.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// local converts a path relative to the root passed to New into one relative
+// to this filesystem, reporting false if it is outside of it.
+func (fs *Afero) local(virtual string) (string, bool) {
+	if fs.base == "/" {
+		return virtual, true
+	}
+	if virtual == fs.base {
+		return "/", true
+	}
+	if !isBelow(virtual, fs.base) {
+		return "", false
+	}
+	return strings.TrimPrefix(virtual, fs.base), true
+}
+
+func (t *trash) list() ([]TrashEntry, error) {
+	dirs, err := afero.ReadDir(t.fs, "/")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []TrashEntry
+	for _, dir := range dirs {
+		info, err := t.info(dir.Name())
+		if err != nil {
+			// interrupted while trashing, not a complete entry
+			continue
+		}
+		entries = append(entries, info.TrashEntry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Deleted.Before(entries[j].Deleted) })
+	return entries, nil
+}
+
+func (t *trash) info(id string) (trashInfo, error) {
+	var info trashInfo
+	if id == "" || strings.ContainsAny(id, "/\\") {
+		return info, &os.PathError{Op: "restore", Path: id, Err: os.ErrNotExist}
+	}
+	data, err := afero.ReadFile(t.fs, path.Join("/", id, trashInfoName))
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+// newID returns a unique ID that sorts by creation time.
+func newID(now time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return strconv.FormatInt(now.UnixNano(), 36) + "-" + hex.EncodeToString(suffix)
+}
@@ -0,0 +1,158 @@
+package afero
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func newTestTrashFs(t *testing.T) (afero.Fs, *Afero, *time.Time) {
+	mem := afero.NewMemMapFs()
+	if err := mem.MkdirAll("/dir/nested", defaultDirectoryMode); err != nil {
+		t.Fatal("Error creating test directory: ", err)
+	}
+	if err := afero.WriteFile(mem, "/dir/file1", []byte(dirFileCont1), defaultCreateMode); err != nil {
+		t.Fatal("Error creating test file: ", err)
+	}
+	if err := afero.WriteFile(mem, "/dir/nested/file", []byte(nestedFileCont), defaultCreateMode); err != nil {
+		t.Fatal("Error creating test file: ", err)
+	}
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fs := New(mem, "/", false, WithTrash(afero.NewMemMapFs())).(*Afero)
+	fs.trash.now = func() time.Time { return now }
+	return mem, fs, &now
+}
+
+func TestTrashRemove(t *testing.T) {
+	mem, fs, _ := newTestTrashFs(t)
+
+	if err := fs.Remove("/dir/file1"); err != nil {
+		t.Error("Error removing file to trash: ", err)
+		return
+	}
+	if _, err := mem.Stat("/dir/file1"); !os.IsNotExist(err) {
+		t.Error("Trashed file is still visible: ", err)
+	}
+
+	entries, err := fs.ListTrash()
+	if err != nil {
+		t.Error("Error listing trash: ", err)
+		return
+	}
+	if len(entries) != 1 {
+		t.Error("Not the expected number of trash entries: ", len(entries))
+		return
+	}
+	if entries[0].Path != "/dir/file1" || entries[0].IsDir {
+		t.Error("Trash entry does not describe the removed file: ", entries[0])
+	}
+
+	if err := fs.Remove("/dir/nested"); err == nil {
+		t.Error("Removed a non-empty directory to trash")
+	}
+	if err := fs.Remove("/dir/missing"); err == nil {
+		t.Error("Removed a missing file to trash")
+	}
+}
+
+func TestTrashRestore(t *testing.T) {
+	mem, fs, _ := newTestTrashFs(t)
+
+	if err := fs.RemoveAll("/dir"); err != nil {
+		t.Error("Error removing directory to trash: ", err)
+		return
+	}
+	entries, err := fs.ListTrash()
+	if err != nil || len(entries) != 1 {
+		t.Error("Removed directory not listed in trash: ", err)
+		return
+	}
+
+	if err := fs.Restore(entries[0].ID); err != nil {
+		t.Error("Error restoring from trash: ", err)
+		return
+	}
+	data, err := afero.ReadFile(mem, "/dir/nested/file")
+	if err != nil || string(data) != nestedFileCont {
+		t.Error("Restored directory is missing its contents: ", err)
+	}
+
+	entries, err = fs.ListTrash()
+	if err != nil || len(entries) != 0 {
+		t.Error("Restored entry is still in the trash: ", err)
+	}
+}
+
+func TestTrashRestore2(t *testing.T) {
+	_, fs, _ := newTestTrashFs(t)
+
+	chroot, err := fs.Chroot("/dir")
+	if err != nil {
+		t.Error("Error getting chroot: ", err)
+		return
+	}
+	if err := chroot.Remove("file1"); err != nil {
+		t.Error("Error removing file to trash in chroot: ", err)
+		return
+	}
+
+	entries, err := fs.ListTrash()
+	if err != nil || len(entries) != 1 {
+		t.Error("Trash is not shared with the chroot: ", err)
+		return
+	}
+	if entries[0].Path != "/dir/file1" {
+		t.Error("Trash entry path is not relative to the root: ", entries[0].Path)
+	}
+
+	if err := fs.Restore(entries[0].ID); err != nil {
+		t.Error("Error restoring chroot entry from parent: ", err)
+		return
+	}
+	if _, err := chroot.Stat("file1"); err != nil {
+		t.Error("Restored file not visible in chroot: ", err)
+	}
+}
+
+func TestEmptyTrash(t *testing.T) {
+	_, fs, now := newTestTrashFs(t)
+
+	if err := fs.Remove("/dir/file1"); err != nil {
+		t.Error("Error removing file to trash: ", err)
+		return
+	}
+	*now = now.Add(time.Hour)
+	if err := fs.RemoveAll("/dir/nested"); err != nil {
+		t.Error("Error removing directory to trash: ", err)
+		return
+	}
+	*now = now.Add(time.Minute)
+
+	if err := fs.EmptyTrash(30 * time.Minute); err != nil {
+		t.Error("Error emptying trash: ", err)
+		return
+	}
+	entries, err := fs.ListTrash()
+	if err != nil || len(entries) != 1 || entries[0].Path != "/dir/nested" {
+		t.Error("EmptyTrash did not keep only the recent entry: ", entries, err)
+	}
+
+	if err := fs.EmptyTrash(0); err != nil {
+		t.Error("Error emptying trash: ", err)
+		return
+	}
+	entries, err = fs.ListTrash()
+	if err != nil || len(entries) != 0 {
+		t.Error("EmptyTrash(0) did not empty the trash: ", err)
+	}
+}
+
+func TestTrashDisabled(t *testing.T) {
+	fs := New(afero.NewMemMapFs(), "/", false).(*Afero)
+	if _, err := fs.ListTrash(); err != ErrTrashDisabled {
+		t.Error("ListTrash without trash mode did not fail: ", err)
+	}
+}
@@ -0,0 +1,226 @@
+package afero
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// TreeHashFormat selects how TreeHash hashes files and directories.
+type TreeHashFormat int
+
+const (
+	// MerkleSHA256 hashes files by the sha256 of their content, and
+	// directories by the sha256 of the type, permissions, name and hash of
+	// their entries.
+	MerkleSHA256 TreeHashFormat = iota
+	// GitSHA1 computes the blob and tree object ids git gives the entries.
+	// Unlike git, empty directories are hashed, as the empty tree.
+	GitSHA1
+)
+
+// treeHashes caches the hashes of files and directories by virtual path. As
+// for the metadata cache, every invalidation bumps the generation and
+// hashes computed across one are not stored.
+type treeHashes struct {
+	format TreeHashFormat
+	hashes map[string][]byte
+	gen    uint64
+	m      sync.Mutex
+}
+
+func newTreeHashes(format TreeHashFormat) *treeHashes {
+	return &treeHashes{format: format, hashes: map[string][]byte{}}
+}
+
+func (h *treeHashes) get(name string) ([]byte, uint64) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.hashes[name], h.gen
+}
+
+func (h *treeHashes) put(name string, sum []byte, gen uint64) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if gen == h.gen {
+		h.hashes[name] = sum
+	}
+}
+
+// invalidate drops the hashes of name and of the directories containing
+// it, and with tree set of everything below name.
+func (h *treeHashes) invalidate(name string, tree bool) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.gen++
+	for dir := name; ; dir = path.Dir(dir) {
+		delete(h.hashes, dir)
+		if dir == "/" {
+			break
+		}
+	}
+	if !tree {
+		return
+	}
+	for p := range h.hashes {
+		if isBelow(p, name) {
+			delete(h.hashes, p)
+		}
+	}
+}
+
+// TreeHash returns the hex hash of the file, symlink or directory name, in
+// the format set by WithTreeHashes or MerkleSHA256 without it. With
+// WithTreeHashes the hashes of every entry are kept until a change made
+// through the filesystem or any of its Chroots invalidates them, so
+// comparing trees only reads what changed since the last call. Changes made
+// to the backend directly are not seen.
+func (fs *Afero) TreeHash(name string) (string, error) {
+	h := fs.hashes
+	if h == nil {
+		h = newTreeHashes(MerkleSHA256)
+	}
+	fi, err := fs.Lstat(name)
+	if err != nil {
+		return "", err
+	}
+	sum, err := fs.treeHash(h, name, fi)
+	return hex.EncodeToString(sum), err
+}
+
+func (fs *Afero) treeHash(h *treeHashes, name string, fi os.FileInfo) ([]byte, error) {
+	key := fs.virtual(name)
+	sum, gen := h.get(key)
+	if sum != nil {
+		return sum, nil
+	}
+
+	var err error
+	switch {
+	case fi.IsDir():
+		sum, err = fs.dirHash(h, name)
+	case fi.Mode()&os.ModeSymlink != 0:
+		var target string
+		if target, err = fs.Readlink(name); err == nil {
+			sum, err = h.blob(int64(len(target)), bytes.NewReader([]byte(target)))
+		}
+	default:
+		var f io.ReadCloser
+		if f, err = fs.Open(name); err == nil {
+			sum, err = h.blob(fi.Size(), f)
+			f.Close()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.put(key, sum, gen)
+	return sum, nil
+}
+
+// blob hashes content of the given size.
+func (h *treeHashes) blob(size int64, content io.Reader) ([]byte, error) {
+	var d hash.Hash
+	if h.format == GitSHA1 {
+		d = sha1.New()
+		fmt.Fprintf(d, "blob %d\x00", size)
+	} else {
+		d = sha256.New()
+	}
+	n, err := io.Copy(d, content)
+	if err != nil {
+		return nil, err
+	}
+	if h.format == GitSHA1 && n != size {
+		return nil, errors.New("File size changed while hashing")
+	}
+	return d.Sum(nil), nil
+}
+
+type treeHashEntry struct {
+	name string
+	mode string
+	sum  []byte
+	dir  bool
+}
+
+// dirHash hashes the entries of the directory name.
+func (fs *Afero) dirHash(h *treeHashes, name string) ([]byte, error) {
+	list, err := fs.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]treeHashEntry, 0, len(list))
+	for _, fi := range list {
+		child := path.Join(name, fi.Name())
+		// ReadDir follows symlinks on some backends
+		if fi, err = fs.Lstat(child); err != nil {
+			return nil, err
+		}
+		sum, err := fs.treeHash(h, child, fi)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, treeHashEntry{name: fi.Name(), mode: h.mode(fi), sum: sum, dir: fi.IsDir()})
+	}
+
+	if h.format != GitSHA1 {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+		d := sha256.New()
+		for _, e := range entries {
+			fmt.Fprintf(d, "%s %s\x00", e.mode, e.name)
+			d.Write(e.sum)
+		}
+		return d.Sum(nil), nil
+	}
+
+	// git sorts directories as if their name ended with a slash
+	sortName := func(e treeHashEntry) string {
+		if e.dir {
+			return e.name + "/"
+		}
+		return e.name
+	}
+	sort.Slice(entries, func(i, j int) bool { return sortName(entries[i]) < sortName(entries[j]) })
+	var tree bytes.Buffer
+	for _, e := range entries {
+		fmt.Fprintf(&tree, "%s %s\x00", e.mode, e.name)
+		tree.Write(e.sum)
+	}
+	d := sha1.New()
+	fmt.Fprintf(d, "tree %d\x00", tree.Len())
+	d.Write(tree.Bytes())
+	return d.Sum(nil), nil
+}
+
+// mode describes the type and permissions of an entry in a directory hash.
+func (h *treeHashes) mode(fi os.FileInfo) string {
+	if h.format == GitSHA1 {
+		switch {
+		case fi.IsDir():
+			return "40000"
+		case fi.Mode()&os.ModeSymlink != 0:
+			return "120000"
+		case fi.Mode()&0111 != 0:
+			return "100755"
+		}
+		return "100644"
+	}
+	switch {
+	case fi.IsDir():
+		return fmt.Sprintf("d%o", fi.Mode().Perm())
+	case fi.Mode()&os.ModeSymlink != 0:
+		return "l"
+	}
+	return fmt.Sprintf("f%o", fi.Mode().Perm())
+}
@@ -0,0 +1,90 @@
+package afero
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/spf13/afero"
+)
+
+func TestTreeHashGit(t *testing.T) {
+	fs := New(afero.NewMemMapFs(), "/", false, WithTreeHashes(GitSHA1)).(*Afero)
+	util.WriteFile(fs, "/hello", []byte("hello\n"), 0644)
+	util.WriteFile(fs, "/run", []byte("#!"), 0755)
+	util.WriteFile(fs, "/d/e/x", []byte("x"), 0644)
+	util.WriteFile(fs, "/z/empty", nil, 0644)
+
+	// ids computed by git hash-object and git write-tree
+	for name, expect := range map[string]string{
+		"/hello": "ce013625030ba8dba906f756967f9e9ca394464a",
+		"/run":   "7a6e2fdcad05f37bd071608f34a041a8d6552348",
+		"/":      "f823d62fa84978cbd8e4729b157cc07a7b94a0e6",
+	} {
+		if sum, err := fs.TreeHash(name); err != nil || sum != expect {
+			t.Error("Unexpected hash of ", name, ": ", sum, err)
+		}
+	}
+	fs.MkdirAll("/z/sub", 0755)
+	fs.Remove("/z/empty")
+	fs.Remove("/d/e/x")
+	fs.Remove("/d/e")
+	fs.Remove("/d")
+	if sum, _ := fs.TreeHash("/z/sub"); sum != "4b825dc642cb6eb9a060e54bf8d69288fbee4904" {
+		t.Error("Unexpected hash of an empty directory: ", sum)
+	}
+}
+
+func TestTreeHashCache(t *testing.T) {
+	backend := &countingFs{Fs: afero.NewMemMapFs()}
+	fs := New(backend, "/", false, WithTreeHashes(MerkleSHA256)).(*Afero)
+	other := New(afero.NewMemMapFs(), "/", false).(*Afero)
+	for _, fs := range []*Afero{fs, other} {
+		util.WriteFile(fs, "/a/one", []byte("one"), 0644)
+		util.WriteFile(fs, "/a/two", []byte("two"), 0644)
+		util.WriteFile(fs, "/b/three", []byte("three"), 0644)
+	}
+
+	first, err := fs.TreeHash("/")
+	if err != nil {
+		t.Error("Error hashing tree: ", err)
+		return
+	}
+	if sum, _ := other.TreeHash("/"); sum != first {
+		t.Error("Equal trees hash differently: ", sum, first)
+	}
+	reads := backend.reads
+	if sum, _ := fs.TreeHash("/"); sum != first || backend.reads != reads {
+		t.Error("Hash was not cached: ", backend.reads-reads)
+	}
+
+	// a write only rehashes the file changed
+	f, _ := fs.OpenFile("/a/two", os.O_RDWR, 0)
+	f.Write([]byte("TWO"))
+	f.Close()
+	changed, _ := fs.TreeHash("/")
+	if changed == first || backend.reads-reads > 2 {
+		t.Error("Write was not seen or everything was hashed again: ", backend.reads-reads)
+	}
+	if sum, _ := other.TreeHash("/b"); sum != mustTreeHash(t, fs, "/b") {
+		t.Error("Unchanged subtree hash differs")
+	}
+
+	// hashes are shared with chroots, and renames invalidate both sides
+	chroot, _ := fs.Chroot("/a")
+	if sum, _ := chroot.(*Afero).TreeHash("/"); sum != mustTreeHash(t, fs, "/a") {
+		t.Error("Chroot hash differs: ", sum)
+	}
+	chroot.Rename("/one", "/three")
+	if sum := mustTreeHash(t, fs, "/"); sum == changed {
+		t.Error("Rename in a chroot was not seen")
+	}
+}
+
+func mustTreeHash(t *testing.T, fs *Afero, name string) string {
+	sum, err := fs.TreeHash(name)
+	if err != nil {
+		t.Error("Error hashing ", name, ": ", err)
+	}
+	return sum
+}
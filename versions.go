@@ -0,0 +1,310 @@
+package afero
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+const (
+	versionDataExt = ".data"
+	versionInfoExt = ".json"
+)
+
+// ErrVersioningDisabled is returned by the version methods of a filesystem
+// created without WithVersions.
+var ErrVersioningDisabled = errors.New("Versioning is not enabled")
+
+// Version describes a snapshot of a file taken before it was overwritten.
+type Version struct {
+	ID string `json:"id"`
+	// Path is the path of the file, relative to the root passed to New.
+	Path    string      `json:"path"`
+	Created time.Time   `json:"created"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+}
+
+// versions stores snapshots in a directory per file, named by the hash of
+// its path. It is shared by every Chroot.
+type versions struct {
+	fs     afero.Fs
+	keep   int
+	budget int64
+	now    func() time.Time
+	// pinned counts the restores in progress of each version, which are not
+	// pruned until they are done.
+	pinned map[string]int
+	m      sync.Mutex
+}
+
+func newVersions(fs afero.Fs, keep int, budget int64, now func() time.Time) *versions {
+	return &versions{fs: fs, keep: keep, budget: budget, now: now, pinned: map[string]int{}}
+}
+
+// snapshot stores the current content of name as a new version, if it is a
+// non-empty regular file.
+func (fs *Afero) snapshot(name string) error {
+	fi, _, err := lstat(fs.fs, name)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() == 0 {
+		return nil
+	}
+
+	v := fs.versions
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	now := v.now()
+	version := Version{ID: newID(now), Path: fs.virtual(name), Created: now, Size: fi.Size(), Mode: fi.Mode()}
+	dir := versionDir(version.Path)
+	if err := v.fs.MkdirAll(dir, defaultDirectoryMode); err != nil {
+		return err
+	}
+	if err := copyFile(fs.fs, name, v.fs, path.Join(dir, version.ID+versionDataExt), fi); err != nil {
+		v.fs.Remove(path.Join(dir, version.ID+versionDataExt))
+		return errors.Wrap(err, "Error saving version of "+name)
+	}
+	data, err := json.Marshal(version)
+	if err != nil {
+		return err
+	}
+	if err := afero.WriteFile(v.fs, path.Join(dir, version.ID+versionInfoExt), data, defaultCreateMode); err != nil {
+		return err
+	}
+	if fs.Debug {
+		log.Println("Saved version ", version.ID, " of ", name)
+	}
+	return v.prune(dir)
+}
+
+// Versions returns the saved versions of the named file, newest first.
+func (fs *Afero) Versions(name string) ([]Version, error) {
+	if fs.Debug {
+		log.Println("Versions ", name)
+	}
+	if fs.versions == nil {
+		return nil, ErrVersioningDisabled
+	}
+	fs.versions.m.Lock()
+	defer fs.versions.m.Unlock()
+	return fs.versions.list(versionDir(fs.virtual(name)))
+}
+
+// RestoreVersion replaces the content and mode of the named file with the
+// version id. The content being replaced is saved as a new version first.
+func (fs *Afero) RestoreVersion(name, id string) (err error) {
+	if fs.Debug {
+		log.Println("RestoreVersion ", name, " ", id)
+	}
+	defer fs.audit(AuditRecord{Op: "restoreversion", Path: name, Target: id}, &err)
+	defer fs.invalidate(name, false)
+	defer fs.recordTree(name, &err)
+	if fs.versions == nil {
+		return ErrVersioningDisabled
+	}
+
+	v := fs.versions
+	v.m.Lock()
+	dir := versionDir(fs.virtual(name))
+	list, err := v.list(dir)
+	if err != nil {
+		v.m.Unlock()
+		return err
+	}
+	var version *Version
+	for i := range list {
+		if list[i].ID == id {
+			version = &list[i]
+		}
+	}
+	if version == nil {
+		v.m.Unlock()
+		return &os.PathError{Op: "restore", Path: name + "@" + id, Err: os.ErrNotExist}
+	}
+	// the snapshot of the current content must not prune the version restored
+	v.pinned[id]++
+	v.m.Unlock()
+	defer func() {
+		v.m.Lock()
+		defer v.m.Unlock()
+		if v.pinned[id]--; v.pinned[id] == 0 {
+			delete(v.pinned, id)
+		}
+		if err == nil {
+			err = v.prune(dir)
+		}
+	}()
+
+	if err := fs.snapshot(name); err != nil {
+		return err
+	}
+	if err := fs.createDir(name); err != nil {
+		return err
+	}
+
+	v.m.Lock()
+	defer v.m.Unlock()
+	data := path.Join(dir, version.ID+versionDataExt)
+	fi, err := v.fs.Stat(data)
+	if err != nil {
+		return err
+	}
+	return copyFile(v.fs, data, fs.fs, name, versionInfo{FileInfo: fi, mode: version.Mode})
+}
+
+// list returns the versions stored in dir, newest first.
+func (v *versions) list(dir string) ([]Version, error) {
+	entries, err := afero.ReadDir(v.fs, dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []Version
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), versionInfoExt) {
+			continue
+		}
+		data, err := afero.ReadFile(v.fs, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var version Version
+		if err := json.Unmarshal(data, &version); err != nil {
+			return nil, err
+		}
+		list = append(list, version)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	return list, nil
+}
+
+// prune drops the oldest versions in dir beyond the count to keep, then the
+// oldest versions of any file while the store is over budget.
+func (v *versions) prune(dir string) error {
+	if v.keep > 0 {
+		list, err := v.list(dir)
+		if err != nil {
+			return err
+		}
+		for i := v.keep; i < len(list); i++ {
+			if v.pinned[list[i].ID] > 0 {
+				continue
+			}
+			if err := v.remove(list[i]); err != nil {
+				return err
+			}
+		}
+	}
+	if v.budget <= 0 {
+		return nil
+	}
+
+	dirs, err := afero.ReadDir(v.fs, "/")
+	if err != nil {
+		return err
+	}
+	var all []Version
+	var total int64
+	for _, d := range dirs {
+		list, err := v.list(path.Join("/", d.Name()))
+		if err != nil {
+			return err
+		}
+		for _, version := range list {
+			total += version.Size
+			all = append(all, version)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Created.Before(all[j].Created) })
+	for i := 0; total > v.budget && i < len(all); i++ {
+		if v.pinned[all[i].ID] > 0 {
+			continue
+		}
+		if err := v.remove(all[i]); err != nil {
+			return err
+		}
+		total -= all[i].Size
+	}
+	return nil
+}
+
+func (v *versions) remove(version Version) error {
+	dir := versionDir(version.Path)
+	if err := v.fs.Remove(path.Join(dir, version.ID+versionInfoExt)); err != nil {
+		return err
+	}
+	return v.fs.Remove(path.Join(dir, version.ID+versionDataExt))
+}
+
+// versionDir returns the directory holding the versions of the file at the
+// virtual path name.
+func versionDir(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return "/" + hex.EncodeToString(sum[:16])
+}
+
+// versionInfo reports the mode a version was saved with.
+type versionInfo struct {
+	os.FileInfo
+	mode os.FileMode
+}
+
+func (fi versionInfo) Mode() os.FileMode {
+	return fi.mode
+}
+
+// versionedFile saves a version of its file before the first change made
+// through it.
+type versionedFile struct {
+	afero.File
+	snapshot func() error
+}
+
+func (f *versionedFile) before() error {
+	if f.snapshot == nil {
+		return nil
+	}
+	snapshot := f.snapshot
+	f.snapshot = nil
+	return snapshot()
+}
+
+func (f *versionedFile) Write(p []byte) (int, error) {
+	if err := f.before(); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *versionedFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.before(); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *versionedFile) WriteString(s string) (int, error) {
+	if err := f.before(); err != nil {
+		return 0, err
+	}
+	return f.File.WriteString(s)
+}
+
+func (f *versionedFile) Truncate(size int64) error {
+	if err := f.before(); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
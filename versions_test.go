@@ -0,0 +1,188 @@
+package afero
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func newTestVersionsFs(t *testing.T, keep int, budget int64) (afero.Fs, *Afero) {
+	mem := afero.NewMemMapFs()
+	if err := afero.WriteFile(mem, "/file", []byte(rootFileCont), 0600); err != nil {
+		t.Fatal("Error creating test file: ", err)
+	}
+	if err := afero.WriteFile(mem, "/other", []byte(dirFileCont1), defaultCreateMode); err != nil {
+		t.Fatal("Error creating test file: ", err)
+	}
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fs := New(mem, "/", false, WithVersions(afero.NewMemMapFs(), keep, budget)).(*Afero)
+	fs.versions.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	return mem, fs
+}
+
+func writeTestFile(fs *Afero, name, content string) error {
+	f, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func TestVersionsCreate(t *testing.T) {
+	mem, fs := newTestVersionsFs(t, 0, 0)
+
+	if err := writeTestFile(fs, "/file", dirFileCont3); err != nil {
+		t.Error("Error overwriting file: ", err)
+		return
+	}
+
+	list, err := fs.Versions("/file")
+	if err != nil {
+		t.Error("Error listing versions: ", err)
+		return
+	}
+	if len(list) != 1 {
+		t.Error("Not the expected number of versions: ", len(list))
+		return
+	}
+	if list[0].Size != int64(len(rootFileCont)) || list[0].Mode.Perm() != 0600 {
+		t.Error("Version does not describe the overwritten content: ", list[0])
+	}
+
+	if err := fs.RestoreVersion("/file", list[0].ID); err != nil {
+		t.Error("Error restoring version: ", err)
+		return
+	}
+	data, err := afero.ReadFile(mem, "/file")
+	if err != nil || string(data) != rootFileCont {
+		t.Error("Restored file does not have the versioned content: ", err)
+	}
+
+	list, err = fs.Versions("/file")
+	if err != nil || len(list) != 2 {
+		t.Error("Content replaced by restore was not versioned: ", err)
+	}
+}
+
+func TestVersionsOpenFile(t *testing.T) {
+	_, fs := newTestVersionsFs(t, 0, 0)
+
+	f, err := fs.OpenFile("/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Error("Error opening file: ", err)
+		return
+	}
+	list, err := fs.Versions("/file")
+	if err != nil || len(list) != 0 {
+		t.Error("Version saved before anything was written: ", err)
+	}
+
+	_, err = f.Write([]byte("overwritten"))
+	f.Close()
+	if err != nil {
+		t.Error("Error writing to file: ", err)
+		return
+	}
+	list, err = fs.Versions("/file")
+	if err != nil || len(list) != 1 {
+		t.Error("Version not saved before the first write: ", err)
+	}
+}
+
+func TestVersionsRename(t *testing.T) {
+	_, fs := newTestVersionsFs(t, 0, 0)
+
+	if err := fs.Rename("/other", "/file"); err != nil {
+		t.Error("Error renaming over file: ", err)
+		return
+	}
+	list, err := fs.Versions("/file")
+	if err != nil || len(list) != 1 || list[0].Size != int64(len(rootFileCont)) {
+		t.Error("File replaced by rename was not versioned: ", err)
+	}
+}
+
+func TestVersionsKeep(t *testing.T) {
+	_, fs := newTestVersionsFs(t, 2, 0)
+
+	for _, content := range []string{"one", "two", "three", "four"} {
+		if err := writeTestFile(fs, "/file", content); err != nil {
+			t.Error("Error overwriting file: ", err)
+			return
+		}
+	}
+
+	list, err := fs.Versions("/file")
+	if err != nil || len(list) != 2 {
+		t.Error("Not the expected number of versions retained: ", err)
+		return
+	}
+	if list[0].Size != int64(len("three")) || list[1].Size != int64(len("two")) {
+		t.Error("The newest versions were not the ones retained")
+	}
+}
+
+func TestVersionsRestoreOldest(t *testing.T) {
+	mem, fs := newTestVersionsFs(t, 2, 0)
+	for _, content := range []string{"one", "two", "three"} {
+		if err := writeTestFile(fs, "/file", content); err != nil {
+			t.Error("Error overwriting file: ", err)
+			return
+		}
+	}
+	list, _ := fs.Versions("/file")
+	if len(list) != 2 {
+		t.Error("Not the expected number of versions retained: ", list)
+		return
+	}
+
+	// at the limit, the snapshot of the current content must not prune the
+	// version being restored
+	if err := fs.RestoreVersion("/file", list[1].ID); err != nil {
+		t.Error("Error restoring the oldest version: ", err)
+		return
+	}
+	if data, _ := afero.ReadFile(mem, "/file"); string(data) != "one" {
+		t.Error("Unexpected content after restore: ", string(data))
+	}
+	list, err := fs.Versions("/file")
+	if err != nil || len(list) != 2 || list[0].Size != int64(len("three")) {
+		t.Error("Unexpected versions after restore: ", list, err)
+	}
+}
+
+func TestVersionsBudget(t *testing.T) {
+	_, fs := newTestVersionsFs(t, 0, int64(len(rootFileCont)+len(dirFileCont1)))
+
+	if err := writeTestFile(fs, "/file", "x"); err != nil {
+		t.Error("Error overwriting file: ", err)
+		return
+	}
+	if err := writeTestFile(fs, "/other", "x"); err != nil {
+		t.Error("Error overwriting file: ", err)
+		return
+	}
+	if err := writeTestFile(fs, "/file", "y"); err != nil {
+		t.Error("Error overwriting file: ", err)
+		return
+	}
+
+	list, err := fs.Versions("/file")
+	if err != nil || len(list) != 1 || list[0].Size != 1 {
+		t.Error("Oldest version was not dropped to stay in budget: ", list, err)
+	}
+	list, err = fs.Versions("/other")
+	if err != nil || len(list) != 1 {
+		t.Error("Version within budget was dropped: ", err)
+	}
+}